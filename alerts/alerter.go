@@ -0,0 +1,23 @@
+package alerts
+
+import (
+	"context"
+	"log"
+)
+
+// Alerter notifies operators of suspicious activity in a tenant
+type Alerter interface {
+	Alert(ctx context.Context, tenantID, message string) error
+}
+
+// LogAlerter writes alerts to the log as "ALERT tenant=<id>: <message>", for a log metric filter to pick up
+type LogAlerter struct{}
+
+func NewLogAlerter() *LogAlerter {
+	return &LogAlerter{}
+}
+
+func (a *LogAlerter) Alert(ctx context.Context, tenantID, message string) error {
+	log.Printf("ALERT tenant=%s: %s", tenantID, message)
+	return nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"github.com/citizendata/datawallet/wallet-api/store/accesses"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+	"time"
+)
+
+// AccessReport lists, per recipient, everything the wallet shared and every read of it (GDPR Article 15 style)
+type AccessReport struct {
+	WalletID    string             `json:"walletId"`
+	GeneratedAt string             `json:"generatedAt"`
+	Recipients  []*RecipientReport `json:"recipients"`
+}
+
+type RecipientReport struct {
+	WalletID string        `json:"walletId"`
+	Items    []*ItemReport `json:"items"`
+}
+
+type ItemReport struct {
+	ReferenceID string `json:"referenceId"`
+
+	// Versions are the version hashes shared, oldest first, and SharedAt when the first was
+	Versions []string    `json:"versions"`
+	SharedAt string      `json:"sharedAt,omitempty"`
+	Reads    []*ItemRead `json:"reads"`
+}
+
+type ItemRead struct {
+	VersionHash string `json:"versionHash"`
+	DeviceID    string `json:"deviceId,omitempty"`
+	AccessedAt  string `json:"accessedAt"`
+}
+
+// ListShareAccesses lists the reads of items shared by the wallet, optionally for one recipient (?toWallet=) and item (&referenceId=)
+func (c *WalletAPI) ListShareAccesses(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	toWalletID := request.QueryParams["toWallet"]
+	referenceID := request.QueryParams["referenceId"]
+	if referenceID != "" && toWalletID == "" {
+		return NewApiError("referenceId requires toWallet", ErrorValidation)
+	}
+
+	list, err := c.accessStore.ListAccesses(ctx, request.TenantID, walletID, toWalletID, referenceID)
+	if err != nil {
+		return NewApiError("error getting accesses: "+err.Error(), ErrorInternalError)
+	}
+
+	return ApiResponseObject(&accesses.AccessList{
+		Accesses: list,
+	})
+}
+
+// GetAccessReport reports who read what the wallet shared, and when
+func (c *WalletAPI) GetAccessReport(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	shares, err := c.listAllOutgoingShares(ctx, request, walletID)
+	if err != nil {
+		return NewApiError("error getting shares: "+err.Error(), ErrorInternalError)
+	}
+	list, err := c.accessStore.ListAccesses(ctx, request.TenantID, walletID, "", "")
+	if err != nil {
+		return NewApiError("error getting accesses: "+err.Error(), ErrorInternalError)
+	}
+
+	report := &AccessReport{
+		WalletID:    walletID,
+		GeneratedAt: time.Now().UTC().Format(timestampLayout),
+		Recipients:  []*RecipientReport{},
+	}
+	recipients := make(map[string]*RecipientReport)
+	items := make(map[string]*ItemReport)
+	itemReport := func(toWalletID, referenceID string) *ItemReport {
+		if item, ok := items[toWalletID+"/"+referenceID]; ok {
+			return item
+		}
+		recipient, ok := recipients[toWalletID]
+		if !ok {
+			recipient = &RecipientReport{
+				WalletID: toWalletID,
+			}
+			recipients[toWalletID] = recipient
+			report.Recipients = append(report.Recipients, recipient)
+		}
+		item := &ItemReport{
+			ReferenceID: referenceID,
+			Versions:    []string{},
+			Reads:       []*ItemRead{},
+		}
+		items[toWalletID+"/"+referenceID] = item
+		recipient.Items = append(recipient.Items, item)
+		return item
+	}
+
+	for _, share := range shares {
+		item := itemReport(share.ToWalletID, share.ReferenceID)
+		for _, version := range share.Versions {
+			item.Versions = append(item.Versions, version.VersionHash)
+		}
+		if len(share.Versions) > 0 {
+			item.SharedAt = share.Versions[0].CreatedAt
+		}
+	}
+	for _, access := range list {
+		item := itemReport(access.ToWalletID, access.ReferenceID)
+		item.Reads = append(item.Reads, &ItemRead{
+			VersionHash: access.VersionHash,
+			DeviceID:    access.DeviceID,
+			AccessedAt:  access.AccessedAt,
+		})
+	}
+
+	return ApiResponseObject(report)
+}
+
+// recordAccess records a read of a shared item for its sharer, a failure to record does not fail the read
+func (c *WalletAPI) recordAccess(ctx context.Context, request *ApiRequest, fromWalletID, toWalletID, referenceID, versionHash string) {
+	err := c.accessStore.RecordAccess(ctx, &accesses.Access{
+		TenantID:     request.TenantID,
+		FromWalletID: fromWalletID,
+		ToWalletID:   toWalletID,
+		ReferenceID:  referenceID,
+		VersionHash:  versionHash,
+		DeviceID:     request.Principal.DeviceID,
+		AccessedAt:   time.Now().UTC().Format(timestampLayout),
+	})
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
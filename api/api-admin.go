@@ -0,0 +1,510 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/ratelimit"
+	"github.com/citizendata/datawallet/wallet-api/recovery"
+	"github.com/citizendata/datawallet/wallet-api/store/tenants"
+	"github.com/citizendata/datawallet/wallet-api/store/usage"
+	"github.com/google/uuid"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultRotationGrace is how long a rotated key keeps working unless the rotation sets gracePeriod
+	defaultRotationGrace = 24 * time.Hour
+	maxRotationGrace     = 7 * 24 * time.Hour
+)
+
+// AdminAPI manages tenants and their API keys. It is not behind tenant API keys, requests are signed
+// with the admin key instead (RFC 9421 only, so the method is signed). A tenant key with the admin scope
+// can also manage its own tenant's keys (request.TenantID is then set).
+type AdminAPI struct {
+	tenantStore    tenants.TenantStore
+	gatewayKeys    tenants.GatewayKeys
+	usageStore     usage.UsageStore
+	adminPublicKey string
+
+	// allowLocalVerifier lets tenants be created with the local recovery verifier
+	allowLocalVerifier bool
+}
+
+// NewTenant is the body of a tenant creation
+type NewTenant struct {
+	TenantID         string            `json:"tenantId"`
+	Name             string            `json:"name"`
+	RecoveryVerifier string            `json:"recoveryVerifier"`
+	Quotas           *usage.Quotas     `json:"quotas"`
+	RateLimits       *ratelimit.Limits `json:"rateLimits"`
+}
+
+// TenantStatusChange is the body of a tenant status change
+type TenantStatusChange struct {
+	Status string `json:"status"`
+}
+
+// ApiKeyRotation is the optional body of an API key rotation
+type ApiKeyRotation struct {
+	// GracePeriod is how long the old key keeps working, in seconds (default a day, at most a week, 0 to revoke it now)
+	GracePeriod *int64 `json:"gracePeriod"`
+}
+
+// NewApiKey is the body of an API key issue
+type NewApiKey struct {
+	Label  string   `json:"label"`
+	Scopes []string `json:"scopes"`
+
+	// ExpiresAt is when the key stops working, blank for never (format: 2006-01-02T15:04:05.000Z)
+	ExpiresAt string `json:"expiresAt"`
+}
+
+func NewAdminAPI(tenantStore tenants.TenantStore, gatewayKeys tenants.GatewayKeys, usageStore usage.UsageStore, adminPublicKeyBase64 string, allowLocalVerifier bool) *AdminAPI {
+	return &AdminAPI{
+		tenantStore:        tenantStore,
+		gatewayKeys:        gatewayKeys,
+		usageStore:         usageStore,
+		adminPublicKey:     adminPublicKeyBase64,
+		allowLocalVerifier: allowLocalVerifier,
+	}
+}
+
+func (c *AdminAPI) authorizeAdmin(request *ApiRequest) *ApiResponse {
+	if request.TenantID != "" {
+		return NewApiError("tenant keys cannot use this route", ErrorForbidden)
+	}
+	if c.adminPublicKey == "" {
+		return NewApiError("admin API is not configured", ErrorForbidden)
+	}
+	// x-api-signature does not sign the method, a signed GET could be replayed as a POST issuing a key
+	if !request.HasMessageSignature() {
+		return NewApiError("admin requests must be signed with RFC 9421 (Signature-Input covering @method)", ErrorUnauthorized)
+	}
+	err := request.ValidateSignature(c.adminPublicKey)
+	if err != nil {
+		return NewApiError("invalid signature: "+err.Error(), ErrorUnauthorized)
+	}
+	return nil
+}
+
+// authorizeTenant authorizes the admin, or a tenant key with the admin scope for its own tenant, and loads the tenant in the path
+func (c *AdminAPI) authorizeTenant(ctx context.Context, request *ApiRequest) (*tenants.Tenant, *ApiResponse) {
+	if request.TenantID != "" {
+		if request.PathParams["tenant"] != request.TenantID {
+			return nil, NewApiError("tenant keys can only manage their own tenant", ErrorForbidden)
+		}
+	} else if authErr := c.authorizeAdmin(request); authErr != nil {
+		return nil, authErr
+	}
+	return c.pathTenant(ctx, request)
+}
+
+// CreateTenant creates a tenant (the tenant ID is generated if blank)
+func (c *AdminAPI) CreateTenant(ctx context.Context, request *ApiRequest) *ApiResponse {
+	if authErr := c.authorizeAdmin(request); authErr != nil {
+		return authErr
+	}
+
+	var body NewTenant
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if body.Name == "" {
+		return NewApiError("name is required", ErrorValidation)
+	}
+	if body.TenantID == "" {
+		body.TenantID = uuid.New().String()
+	}
+	if authErr := validateQuotas(body.Quotas); authErr != nil {
+		return authErr
+	}
+	if authErr := validateRateLimits(body.RateLimits); authErr != nil {
+		return authErr
+	}
+	err = recovery.CheckVerifierName(body.RecoveryVerifier, c.allowLocalVerifier)
+	if err != nil {
+		return NewApiError("invalid recoveryVerifier: "+err.Error(), ErrorValidation)
+	}
+
+	tenant := &tenants.Tenant{
+		TenantId:         body.TenantID,
+		Name:             body.Name,
+		Status:           tenants.TenantActive,
+		Quotas:           body.Quotas,
+		RateLimits:       body.RateLimits,
+		RecoveryVerifier: body.RecoveryVerifier,
+		CreatedAt:        time.Now().UTC().Format(timestampLayout),
+	}
+	err = c.tenantStore.CreateTenant(ctx, tenant)
+	if err == tenants.ErrTenantExists {
+		return NewApiError("tenant "+tenant.TenantId+" already exists", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store tenant", ErrorInternalError)
+	}
+
+	return ApiResponseObject(tenant)
+}
+
+// SetTenantStatus activates, suspends or deletes a tenant, its keys are rejected unless it is active
+func (c *AdminAPI) SetTenantStatus(ctx context.Context, request *ApiRequest) *ApiResponse {
+	if authErr := c.authorizeAdmin(request); authErr != nil {
+		return authErr
+	}
+
+	tenant, authErr := c.pathTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	var body TenantStatusChange
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if !tenants.ValidTenantStatus(body.Status) {
+		return NewApiError("unknown status "+body.Status, ErrorValidation)
+	}
+
+	err = c.tenantStore.SetTenantStatus(ctx, tenant.TenantId, body.Status)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not update tenant", ErrorInternalError)
+	}
+	tenant.Status = body.Status
+
+	return ApiResponseObject(tenant)
+}
+
+// SetTenantQuotas replaces the tenant's storage quotas, null restores the defaults
+func (c *AdminAPI) SetTenantQuotas(ctx context.Context, request *ApiRequest) *ApiResponse {
+	if authErr := c.authorizeAdmin(request); authErr != nil {
+		return authErr
+	}
+
+	tenant, authErr := c.pathTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	var quotas *usage.Quotas
+	err := json.Unmarshal([]byte(request.Body), &quotas)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if authErr := validateQuotas(quotas); authErr != nil {
+		return authErr
+	}
+
+	err = c.tenantStore.SetTenantQuotas(ctx, tenant.TenantId, quotas)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not update tenant", ErrorInternalError)
+	}
+	tenant.Quotas = quotas
+
+	return ApiResponseObject(tenant)
+}
+
+// SetTenantRateLimits replaces the tenant's request limits, null restores the defaults
+func (c *AdminAPI) SetTenantRateLimits(ctx context.Context, request *ApiRequest) *ApiResponse {
+	if authErr := c.authorizeAdmin(request); authErr != nil {
+		return authErr
+	}
+
+	tenant, authErr := c.pathTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	var limits *ratelimit.Limits
+	err := json.Unmarshal([]byte(request.Body), &limits)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if authErr := validateRateLimits(limits); authErr != nil {
+		return authErr
+	}
+
+	err = c.tenantStore.SetTenantRateLimits(ctx, tenant.TenantId, limits)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not update tenant", ErrorInternalError)
+	}
+	tenant.RateLimits = limits
+
+	return ApiResponseObject(tenant)
+}
+
+// GetTenantUsage reports the storage used by the tenant against its quota
+func (c *AdminAPI) GetTenantUsage(ctx context.Context, request *ApiRequest) *ApiResponse {
+	tenant, authErr := c.authorizeTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	used, err := c.usageStore.GetUsage(ctx, tenant.TenantId, "")
+	if err != nil {
+		return NewApiError("error getting usage: "+err.Error(), ErrorInternalError)
+	}
+
+	quotas := tenant.Quotas
+	if quotas == nil {
+		quotas = usage.DefaultQuotas
+	}
+	return ApiResponseObject(&usage.Report{
+		Usage:  used,
+		Limits: quotas.Tenant,
+	})
+}
+
+// IssueApiKey creates an API key for the tenant, the key value is only returned here
+func (c *AdminAPI) IssueApiKey(ctx context.Context, request *ApiRequest) *ApiResponse {
+	tenant, authErr := c.authorizeTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	var body NewApiKey
+	if request.Body != "" {
+		err := json.Unmarshal([]byte(request.Body), &body)
+		if err != nil {
+			return NewApiError("could not unmarshal payload", ErrorValidation)
+		}
+	}
+
+	for _, scope := range body.Scopes {
+		if !tenants.ValidScope(scope) {
+			return NewApiError("unknown scope "+scope, ErrorValidation)
+		}
+	}
+	if body.ExpiresAt != "" {
+		expires, err := time.Parse(timestampLayout, body.ExpiresAt)
+		if err != nil || expires.Before(time.Now().UTC()) {
+			return NewApiError("expiresAt must be a future time (format: "+timestampLayout+")", ErrorValidation)
+		}
+	}
+
+	key, authErr := c.issueApiKey(ctx, tenant, &body)
+	if authErr != nil {
+		return authErr
+	}
+	return ApiResponseObject(key)
+}
+
+// ListApiKeys lists the tenant's keys, without their values
+func (c *AdminAPI) ListApiKeys(ctx context.Context, request *ApiRequest) *ApiResponse {
+	tenant, authErr := c.authorizeTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	keys, err := c.tenantStore.ListApiKeys(ctx, tenant.TenantId)
+	if err != nil {
+		return NewApiError("error getting keys: "+err.Error(), ErrorInternalError)
+	}
+
+	return ApiResponseObject(&tenants.ApiKeyList{
+		Keys: keys,
+	})
+}
+
+// RotateApiKey issues a new key with the same label, scopes and expiry, and revokes the old one once the grace
+// period ends so clients can move to the new key
+func (c *AdminAPI) RotateApiKey(ctx context.Context, request *ApiRequest) *ApiResponse {
+	tenant, authErr := c.authorizeTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	old, authErr := c.pathKey(ctx, request, tenant)
+	if authErr != nil {
+		return authErr
+	}
+
+	var body ApiKeyRotation
+	if request.Body != "" {
+		err := json.Unmarshal([]byte(request.Body), &body)
+		if err != nil {
+			return NewApiError("could not unmarshal payload", ErrorValidation)
+		}
+	}
+	grace := defaultRotationGrace
+	if body.GracePeriod != nil {
+		grace = time.Duration(*body.GracePeriod) * time.Second
+		if grace < 0 || grace > maxRotationGrace {
+			return NewApiError("gracePeriod must be between 0 and "+strconv.Itoa(int(maxRotationGrace/time.Second))+" seconds", ErrorValidation)
+		}
+	}
+
+	key, authErr := c.issueApiKey(ctx, tenant, &NewApiKey{
+		Label:     old.Label,
+		Scopes:    old.Scopes,
+		ExpiresAt: old.ExpiresAt,
+	})
+	if authErr != nil {
+		return authErr
+	}
+
+	if grace == 0 {
+		authErr = c.revokeApiKey(ctx, old)
+	} else {
+		// the old key stays enabled in the gateway, the API rejects it once revokedAt has passed and
+		// disables it in the gateway then (see lambdas.tenantKey)
+		authErr = c.setRevokedAt(ctx, old, time.Now().UTC().Add(grace))
+	}
+	if authErr != nil {
+		return authErr
+	}
+
+	return ApiResponseObject(key)
+}
+
+// RevokeApiKey revokes a key, requests with it are rejected right away
+func (c *AdminAPI) RevokeApiKey(ctx context.Context, request *ApiRequest) *ApiResponse {
+	tenant, authErr := c.authorizeTenant(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	key, authErr := c.pathKey(ctx, request, tenant)
+	if authErr != nil {
+		return authErr
+	}
+
+	if authErr := c.revokeApiKey(ctx, key); authErr != nil {
+		return authErr
+	}
+	return ApiSuccessMessage("key revoked")
+}
+
+func (c *AdminAPI) issueApiKey(ctx context.Context, tenant *tenants.Tenant, body *NewApiKey) (*tenants.ApiKey, *ApiResponse) {
+	value := make([]byte, 32)
+	_, err := rand.Read(value)
+	if err != nil {
+		return nil, NewApiError("could not generate key", ErrorInternalError)
+	}
+
+	key := &tenants.ApiKey{
+		Key:              base64.RawURLEncoding.EncodeToString(value),
+		KeyID:            uuid.New().String(),
+		Label:            body.Label,
+		Scopes:           body.Scopes,
+		ExpiresAt:        body.ExpiresAt,
+		TenantId:         tenant.TenantId,
+		TenantName:       tenant.Name,
+		TenantStatus:     tenant.Status,
+		TenantQuotas:     tenant.Quotas,
+		TenantRateLimits: tenant.RateLimits,
+		RecoveryVerifier: tenant.RecoveryVerifier,
+		CreatedAt:        time.Now().UTC().Format(timestampLayout),
+	}
+
+	key.GatewayKeyID, err = c.gatewayKeys.Register(ctx, tenant.TenantId+"/"+key.KeyID, key.Key)
+	if err != nil {
+		log.Print(err.Error())
+		return nil, NewApiError("could not register key with the gateway", ErrorInternalError)
+	}
+
+	err = c.tenantStore.CreateApiKey(ctx, key)
+	if err != nil {
+		log.Print(err.Error())
+		// a registered key that is not stored would let requests through the gateway for nothing
+		if err := c.gatewayKeys.Deregister(ctx, key.GatewayKeyID); err != nil {
+			log.Print(err.Error())
+		}
+		return nil, NewApiError("could not store key", ErrorInternalError)
+	}
+	return key, nil
+}
+
+func (c *AdminAPI) revokeApiKey(ctx context.Context, key *tenants.ApiKey) *ApiResponse {
+	if key.GatewayKeyID != "" {
+		err := c.gatewayKeys.Disable(ctx, key.GatewayKeyID)
+		if err != nil {
+			log.Print(err.Error())
+			return NewApiError("could not disable key in the gateway", ErrorInternalError)
+		}
+	}
+
+	return c.setRevokedAt(ctx, key, time.Now().UTC())
+}
+
+// setRevokedAt sets when the API starts rejecting the key
+func (c *AdminAPI) setRevokedAt(ctx context.Context, key *tenants.ApiKey, at time.Time) *ApiResponse {
+	err := c.tenantStore.RevokeApiKey(ctx, key.TenantId, key.KeyID, at.Format(timestampLayout))
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not revoke key", ErrorInternalError)
+	}
+	return nil
+}
+
+func (c *AdminAPI) pathTenant(ctx context.Context, request *ApiRequest) (*tenants.Tenant, *ApiResponse) {
+	tenantID, ok := request.PathParams["tenant"]
+	if !ok {
+		return nil, NewApiError("invalid tenant ID in path", ErrorValidation)
+	}
+
+	tenant, err := c.tenantStore.GetTenantByID(ctx, tenantID)
+	if err == tenants.ErrNotFound {
+		return nil, NewApiError("unknown tenant "+tenantID, ErrorValidation)
+	}
+	if err != nil {
+		return nil, NewApiError("error getting tenant "+tenantID+": "+err.Error(), ErrorInternalError)
+	}
+	return tenant, nil
+}
+
+func (c *AdminAPI) pathKey(ctx context.Context, request *ApiRequest, tenant *tenants.Tenant) (*tenants.ApiKey, *ApiResponse) {
+	keyID, ok := request.PathParams["keyId"]
+	if !ok {
+		return nil, NewApiError("invalid key ID in path", ErrorValidation)
+	}
+
+	key, err := c.tenantStore.GetApiKey(ctx, tenant.TenantId, keyID)
+	if err == tenants.ErrNotFound {
+		return nil, NewApiError("unknown key "+keyID, ErrorValidation)
+	}
+	if err != nil {
+		return nil, NewApiError("error getting key "+keyID+": "+err.Error(), ErrorInternalError)
+	}
+	// a rotated key can still be revoked during its grace period
+	if key.RevokedAt != "" && key.RevokedAt <= time.Now().UTC().Format(timestampLayout) {
+		return nil, NewApiError("key "+keyID+" is already revoked", ErrorConflict)
+	}
+	return key, nil
+}
+
+// validateQuotas checks quotas are complete and not negative (nil for the defaults)
+func validateQuotas(quotas *usage.Quotas) *ApiResponse {
+	if quotas == nil {
+		return nil
+	}
+	for _, l := range []*usage.Limits{quotas.Tenant, quotas.Wallet} {
+		if l == nil {
+			return NewApiError("quotas need tenant and wallet limits", ErrorValidation)
+		}
+		if l.MaxItems < 0 || l.MaxVersions < 0 || l.MaxBytes < 0 {
+			return NewApiError("quota limits cannot be negative", ErrorValidation)
+		}
+	}
+	return nil
+}
+
+// validateRateLimits checks limits allow at least one request (nil for the defaults)
+func validateRateLimits(limits *ratelimit.Limits) *ApiResponse {
+	if limits == nil {
+		return nil
+	}
+	for _, l := range []*ratelimit.Limit{limits.Tenant, limits.Wallet, limits.Share} {
+		if l != nil && (l.Rate <= 0 || l.Burst < 1) {
+			return NewApiError("rate limits need a positive rate and a burst of at least 1", ErrorValidation)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"github.com/citizendata/datawallet/wallet-api/store/audit"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// operations recorded in the audit log, alongside custodian, member and lockout events
+	AuditCreate     = "create"
+	AuditAdd        = "add"
+	AuditRead       = "read"
+	AuditShare      = "share"
+	AuditReadShared = "read-shared"
+	AuditKeyLookup  = "key-lookup"
+
+	defaultAuditPage = 100
+	maxAuditPage     = 1000
+)
+
+// AuditVerification is the result of walking a wallet's whole audit log
+type AuditVerification struct {
+	Verified bool   `json:"verified"`
+	Events   int64  `json:"events"`
+	HeadHash string `json:"headHash,omitempty"`
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ListAuditEvents pages through the audit log of the wallet, oldest first (see VerifyAuditLog to check the chain)
+func (c *WalletAPI) ListAuditEvents(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	from, limit, authErr := auditPage(request)
+	if authErr != nil {
+		return authErr
+	}
+
+	events, err := c.auditStore.ListEvents(ctx, request.TenantID, walletID, from, limit)
+	if err != nil {
+		return NewApiError("error getting audit events: "+err.Error(), ErrorInternalError)
+	}
+
+	list := &audit.EventList{
+		Events: events,
+	}
+	if len(events) == limit {
+		list.Next = events[len(events)-1].Sequence + 1
+	}
+	return ApiResponseObject(list)
+}
+
+// VerifyAuditLog walks the wallet's audit log from the first event, checks every hash, link and sequence, and that
+// the log ends at the wallet's head
+func (c *WalletAPI) VerifyAuditLog(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	// read first, events appended during the walk are past it
+	head, err := c.auditStore.Head(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting audit events: "+err.Error(), ErrorInternalError)
+	}
+
+	result := &AuditVerification{}
+	var prev *audit.Event
+	for from := int64(1); ; {
+		events, err := c.auditStore.ListEvents(ctx, request.TenantID, walletID, from, maxAuditPage)
+		if err != nil {
+			return NewApiError("error getting audit events: "+err.Error(), ErrorInternalError)
+		}
+		if head == 0 && len(events) > 0 && from == 1 {
+			// the log was opened by the listing
+			head, err = c.auditStore.Head(ctx, request.TenantID, walletID)
+			if err != nil {
+				return NewApiError("error getting audit events: "+err.Error(), ErrorInternalError)
+			}
+		}
+
+		brokenAt, err := c.auditStore.VerifyEvents(prev, events)
+		if err != nil {
+			result.BrokenAt = brokenAt
+			result.Error = err.Error()
+			return ApiResponseObject(result)
+		}
+		if len(events) > 0 {
+			prev = events[len(events)-1]
+			result.Events = prev.Sequence
+			result.HeadHash = prev.Hash
+		}
+		if len(events) < maxAuditPage || result.Events >= head {
+			break
+		}
+		from = prev.Sequence + 1
+	}
+
+	// every event counted up to the head must have been walked
+	if result.Events < head {
+		result.BrokenAt = result.Events + 1
+		result.Error = "event " + strconv.FormatInt(result.BrokenAt, 10) + " is missing"
+		return ApiResponseObject(result)
+	}
+
+	result.Verified = true
+	return ApiResponseObject(result)
+}
+
+// auditPage reads the from and limit query parameters
+func auditPage(request *ApiRequest) (int64, int, *ApiResponse) {
+	from := int64(1)
+	if v, ok := request.QueryParams["from"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return 0, 0, NewApiError("from must be a sequence number of at least 1", ErrorValidation)
+		}
+		from = n
+	}
+	limit, authErr := pageLimit(request, defaultAuditPage, maxAuditPage)
+	if authErr != nil {
+		return 0, 0, authErr
+	}
+	return from, limit, nil
+}
+
+func (c *WalletAPI) recordAudit(ctx context.Context, request *ApiRequest, walletID, operation, target string) {
+	c.recordEvent(ctx, request, &audit.Event{
+		WalletID:  walletID,
+		Operation: operation,
+		Target:    target,
+		Outcome:   audit.OutcomeSuccess,
+	})
+}
+
+// auditResponse records the outcome of an authorized operation and passes its response through
+func (c *WalletAPI) auditResponse(ctx context.Context, request *ApiRequest, walletID, operation, target, versionHash string, resp *ApiResponse) *ApiResponse {
+	outcome := audit.OutcomeSuccess
+	if resp.StatusCode >= 400 {
+		outcome = audit.OutcomeFailed
+	}
+
+	c.recordEvent(ctx, request, &audit.Event{
+		WalletID:    walletID,
+		Operation:   operation,
+		Target:      target,
+		VersionHash: versionHash,
+		Outcome:     outcome,
+	})
+	return resp
+}
+
+// recordEvent appends the event to the wallet's log, a failure to record does not fail the request. Events of
+// requests not signed by a wallet (key lookups) record the source IP instead of an actor.
+func (c *WalletAPI) recordEvent(ctx context.Context, request *ApiRequest, event *audit.Event) {
+	event.TenantID = request.TenantID
+	event.CreatedAt = time.Now().UTC().Format(timestampLayout)
+	if request.Principal != nil {
+		event.ActorID = request.Principal.WalletID
+		event.DeviceID = request.Principal.DeviceID
+	} else {
+		event.Source = lockoutSource(request)
+	}
+
+	err := c.auditStore.RecordEvent(ctx, event)
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"time"
+)
+
+const (
+	headerCapability = "x-api-capability"
+	headerActor      = "x-api-actor"
+
+	// operations that can be granted by a capability
+	CapabilityGetData        = "get-data"
+	CapabilityGetDataHistory = "get-data-history"
+)
+
+// authorizeRead authorizes the wallet owner (or a custodian with the read right), or the holder of a capability granting operation on referenceID
+func (c *WalletAPI) authorizeRead(ctx context.Context, request *ApiRequest, operation, referenceID string) (string, *ApiResponse) {
+	if limited := c.rateLimit(ctx, request); limited != nil {
+		return "", limited
+	}
+
+	token := request.Header(headerCapability)
+	if token == "" {
+		return c.authorizeRight(ctx, request, wallets.RightRead)
+	}
+
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return "", NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+
+	capability, err := security.DecodeCapability(token)
+	if err != nil {
+		return "", NewApiError("invalid capability: "+err.Error(), ErrorUnauthorized)
+	}
+	if capability.TenantID != request.TenantID || capability.WalletID != walletID {
+		return "", NewApiError("capability not issued for wallet "+walletID, ErrorUnauthorized)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return "", NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	pubKey, err := security.ParsePublicKey(wallet.PublicKeyBase64)
+	if err != nil {
+		return "", NewApiError("invalid wallet public key", ErrorInternalError)
+	}
+
+	caveats, err := capability.Verify(pubKey)
+	if err != nil {
+		return "", NewApiError("invalid capability: "+err.Error(), ErrorUnauthorized)
+	}
+
+	audience, deviceID, authErr := c.capabilityAudience(ctx, request, caveats)
+	if authErr != nil {
+		return "", authErr
+	}
+
+	now := time.Now().UTC()
+	for _, cv := range caveats {
+		err = cv.Allows(operation, referenceID, audience, now)
+		if err != nil {
+			return "", NewApiError(err.Error(), ErrorForbidden)
+		}
+	}
+
+	request.Principal = &Principal{
+		WalletID: audience,
+		DeviceID: deviceID,
+	}
+	return walletID, nil
+}
+
+// capabilityAudience authenticates the presenting wallet when a caveat restricts the audience
+func (c *WalletAPI) capabilityAudience(ctx context.Context, request *ApiRequest, caveats []*security.Caveats) (string, string, *ApiResponse) {
+	restricted := false
+	for _, cv := range caveats {
+		restricted = restricted || cv.Audience != ""
+	}
+	if !restricted {
+		return "", "", nil
+	}
+
+	return c.authorizeActor(ctx, request)
+}
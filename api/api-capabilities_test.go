@@ -0,0 +1,87 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCapabilityAllows(t *testing.T) {
+	ownerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name        string
+		caveats     []*security.Caveats
+		operation   string
+		referenceID string
+		audience    string
+		wantErr     bool
+	}{
+		{"no caveats", []*security.Caveats{{}}, CapabilityGetDataHistory, "ref-1", "", false},
+		{"allowed operation", []*security.Caveats{{Operations: []string{CapabilityGetData}}}, CapabilityGetData, "ref-1", "", false},
+		{"other operation", []*security.Caveats{{Operations: []string{CapabilityGetData}}}, CapabilityGetDataHistory, "ref-1", "", true},
+		{"allowed reference", []*security.Caveats{{ReferenceIDs: []string{"ref-1", "ref-2"}}}, CapabilityGetData, "ref-2", "", false},
+		{"other reference", []*security.Caveats{{ReferenceIDs: []string{"ref-1"}}}, CapabilityGetData, "ref-2", "", true},
+		{"not expired", []*security.Caveats{{ExpiresAt: now.Unix()}}, CapabilityGetData, "ref-1", "", false},
+		{"expired", []*security.Caveats{{ExpiresAt: now.Unix() - 1}}, CapabilityGetData, "ref-1", "", true},
+		{"audience", []*security.Caveats{{Audience: "bank"}}, CapabilityGetData, "ref-1", "bank", false},
+		{"other audience", []*security.Caveats{{Audience: "bank"}}, CapabilityGetData, "ref-1", "shop", true},
+		{"no audience presented", []*security.Caveats{{Audience: "bank"}}, CapabilityGetData, "ref-1", "", true},
+		{
+			name: "attenuated to one operation",
+			caveats: []*security.Caveats{
+				{Operations: []string{CapabilityGetData, CapabilityGetDataHistory}},
+				{Operations: []string{CapabilityGetData}},
+			},
+			operation:   CapabilityGetDataHistory,
+			referenceID: "ref-1",
+			wantErr:     true,
+		},
+		{
+			name: "attenuated to one reference",
+			caveats: []*security.Caveats{
+				{Operations: []string{CapabilityGetData}},
+				{ReferenceIDs: []string{"ref-1"}},
+			},
+			operation:   CapabilityGetData,
+			referenceID: "ref-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capability, err := security.NewCapability("tenant", "wallet", tt.caveats[0], ownerKey)
+			assert.NoError(t, err)
+			for _, cv := range tt.caveats[1:] {
+				capability, err = capability.Attenuate(cv)
+				assert.NoError(t, err)
+			}
+
+			token, err := capability.Encode()
+			assert.NoError(t, err)
+			capability, err = security.DecodeCapability(token)
+			assert.NoError(t, err)
+			caveats, err := capability.Verify(&ownerKey.PublicKey)
+			assert.NoError(t, err)
+
+			// every block must allow the operation, as in authorizeRead
+			for _, cv := range caveats {
+				err = cv.Allows(tt.operation, tt.referenceID, tt.audience, now)
+				if err != nil {
+					break
+				}
+			}
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+	"time"
+)
+
+// CustodianGrant is the body to add or update a custodian
+type CustodianGrant struct {
+	Rights []string `json:"rights"`
+
+	// HandOverAt is when the custodian's rights end (format: 2006-01-02T15:04:05.000Z)
+	HandOverAt string `json:"handOverAt"`
+}
+
+// authorizeCustodian authenticates the acting wallet and checks it is an active custodian of wallet
+func (c *WalletAPI) authorizeCustodian(ctx context.Context, request *ApiRequest, wallet *wallets.Wallet) (string, string, *ApiResponse) {
+	actorID, deviceID, authErr := c.authorizeActor(ctx, request)
+	if authErr != nil {
+		return "", "", authErr
+	}
+	if _, ok := wallet.Custodian(actorID, time.Now().UTC().Format(timestampLayout)); !ok {
+		return "", "", NewApiError("wallet "+actorID+" is not a custodian of wallet "+wallet.WalletID, ErrorForbidden)
+	}
+	return actorID, deviceID, nil
+}
+
+// authorizeCustodyChange authorizes changes to custodians: the wallet's primary key (the dependent), or an active
+// custodian while the wallet is in custody. It returns whether the dependent signed.
+func (c *WalletAPI) authorizeCustodyChange(ctx context.Context, request *ApiRequest) (*wallets.Wallet, bool, *ApiResponse) {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return nil, false, NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return nil, false, NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	actorID := requestActor(request)
+	if wallet.InCustody(time.Now().UTC().Format(timestampLayout)) && actorID != "" && actorID != walletID {
+		actorID, deviceID, authErr := c.authorizeCustodian(ctx, request, wallet)
+		if authErr != nil {
+			return nil, false, authErr
+		}
+		request.Principal = &Principal{
+			WalletID: actorID,
+			DeviceID: deviceID,
+		}
+		return wallet, false, nil
+	}
+
+	_, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return nil, false, authErr
+	}
+	if request.Principal.DeviceID != wallets.PrimaryDeviceID {
+		return nil, false, NewApiError("custodians can only be added with the primary key", ErrorForbidden)
+	}
+	return wallet, true, nil
+}
+
+// PutCustodian adds or updates a custodian of a dependent's wallet
+func (c *WalletAPI) PutCustodian(ctx context.Context, request *ApiRequest) *ApiResponse {
+	wallet, dependent, authErr := c.authorizeCustodyChange(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	custodianID, ok := request.PathParams["custodian"]
+	if !ok || custodianID == wallet.WalletID {
+		return NewApiError("invalid custodian wallet ID in path", ErrorValidation)
+	}
+
+	var grant CustodianGrant
+	err := json.Unmarshal([]byte(request.Body), &grant)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	for _, r := range grant.Rights {
+		if r != wallets.RightRead && r != wallets.RightAdd && r != wallets.RightShare {
+			return NewApiError("unknown right "+r, ErrorValidation)
+		}
+	}
+	handOver, err := time.Parse(timestampLayout, grant.HandOverAt)
+	if err != nil || handOver.Before(time.Now().UTC()) {
+		return NewApiError("handOverAt must be a future time (format: "+timestampLayout+")", ErrorValidation)
+	}
+
+	_, err = c.walletStore.GetWallet(ctx, request.TenantID, custodianID)
+	if err != nil {
+		return NewApiError("error getting custodian wallet "+custodianID+": "+err.Error(), ErrorValidation)
+	}
+
+	now := time.Now().UTC().Format(timestampLayout)
+	custodian, ok := wallet.Custodian(custodianID, now)
+
+	// a custodian cannot give itself or another wallet more than it holds, only the dependent can
+	if !dependent {
+		bound := custodian
+		if !ok {
+			bound, _ = wallet.Custodian(request.Principal.WalletID, now)
+		}
+		if !bound.Covers(grant.Rights, grant.HandOverAt) {
+			return NewApiError("custodians cannot extend a hand-over date or widen rights, the dependent must sign the change", ErrorForbidden)
+		}
+	}
+
+	if !ok {
+		custodian = &wallets.Custodian{
+			WalletID: custodianID,
+			AddedAt:  request.RequestTimeUTC,
+			AddedBy:  request.Principal.WalletID,
+		}
+		wallet.Custodians = append(wallet.Custodians, custodian)
+	}
+	custodian.Rights = grant.Rights
+	custodian.HandOverAt = grant.HandOverAt
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+	c.recordAudit(ctx, request, wallet.WalletID, "custodian-set", custodianID)
+
+	return ApiResponseObject(custodian)
+}
+
+// RemoveCustodian ends a custodianship before its hand-over date, signed by an active custodian
+func (c *WalletAPI) RemoveCustodian(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+	custodianID, ok := request.PathParams["custodian"]
+	if !ok {
+		return NewApiError("invalid custodian wallet ID in path", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	actorID, deviceID, authErr := c.authorizeCustodian(ctx, request, wallet)
+	if authErr != nil {
+		return authErr
+	}
+	request.Principal = &Principal{
+		WalletID: actorID,
+		DeviceID: deviceID,
+	}
+
+	custodian, ok := wallet.Custodian(custodianID, time.Now().UTC().Format(timestampLayout))
+	if !ok {
+		return NewApiError("wallet "+custodianID+" is not a custodian", ErrorValidation)
+	}
+	custodian.RemovedAt = request.RequestTimeUTC
+	custodian.RemovedBy = actorID
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+	c.recordAudit(ctx, request, walletID, "custodian-removed", custodianID)
+
+	return ApiSuccessMessage("custodian removed")
+}
+
+// ListCustodians lists every custodian of the wallet, including past ones
+func (c *WalletAPI) ListCustodians(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	return ApiResponseObject(&wallets.CustodianList{
+		Custodians: wallet.Custodians,
+	})
+}
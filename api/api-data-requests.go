@@ -0,0 +1,320 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/store/datarequests"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"github.com/google/uuid"
+	"log"
+	"time"
+)
+
+const (
+	defaultDataRequestPage = 100
+	maxDataRequestPage     = 1000
+)
+
+// NewDataRequest is the body of a data request, signed by the requesting wallet
+type NewDataRequest struct {
+	ToWalletID   string   `json:"toWalletId"`
+	ReferenceIDs []string `json:"referenceIds"`
+	DataTypes    []string `json:"dataTypes"`
+	Purpose      string   `json:"purpose"`
+	LegalBasis   string   `json:"legalBasis"`
+	Deadline     string   `json:"deadline"`
+}
+
+// DataRequestDecline is the body to decline a data request
+type DataRequestDecline struct {
+	Reason string `json:"reason"`
+}
+
+// CreateDataRequest sends a request for data from the wallet in the path to toWalletId
+func (c *WalletAPI) CreateDataRequest(ctx context.Context, request *ApiRequest) *ApiResponse {
+	var body NewDataRequest
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+
+	// requests count against the same limit as shares between the two wallets
+	if limited := c.rateLimitShare(ctx, request, body.ToWalletID); limited != nil {
+		return limited
+	}
+
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightShare)
+	if authErr != nil {
+		return authErr
+	}
+	if body.ToWalletID == "" || body.ToWalletID == walletID {
+		return NewApiError("toWalletId must be another wallet", ErrorValidation)
+	}
+	if len(body.ReferenceIDs) == 0 && len(body.DataTypes) == 0 {
+		return NewApiError("referenceIds or dataTypes is required", ErrorValidation)
+	}
+	if body.Purpose == "" || body.LegalBasis == "" {
+		return NewApiError("purpose and legalBasis are required", ErrorValidation)
+	}
+	deadline, err := time.Parse(timestampLayout, body.Deadline)
+	if err != nil || deadline.Before(time.Now().UTC()) {
+		return NewApiError("deadline must be a future time (format: 2006-01-02T15:04:05.000Z)", ErrorValidation)
+	}
+
+	// a blocked requester gets the same error as for a wallet that does not exist
+	owner, err := c.walletStore.GetWallet(ctx, request.TenantID, body.ToWalletID)
+	if err != nil || owner.Blocks(walletID) {
+		return NewApiError("cannot send a data request to wallet "+body.ToWalletID, ErrorValidation)
+	}
+
+	dataRequest := &datarequests.DataRequest{
+		RequestID:    uuid.New().String(),
+		TenantID:     request.TenantID,
+		FromWalletID: walletID,
+		ToWalletID:   body.ToWalletID,
+		ReferenceIDs: body.ReferenceIDs,
+		DataTypes:    body.DataTypes,
+		Purpose:      body.Purpose,
+		LegalBasis:   body.LegalBasis,
+		Deadline:     body.Deadline,
+		Status:       datarequests.StatusOpen,
+		CreatedAt:    request.RequestTimeUTC,
+	}
+
+	err = c.dataRequestStore.CreateDataRequest(ctx, dataRequest)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store data request", ErrorInternalError)
+	}
+	c.recordAudit(ctx, request, walletID, "data-request-sent", dataRequest.RequestID)
+	c.recordAudit(ctx, request, body.ToWalletID, "data-request-received", dataRequest.RequestID)
+
+	return ApiResponseObject(dataRequest)
+}
+
+// dataRequestPage is where the next page of each list starts, blank for a list at its end
+type dataRequestPage struct {
+	Received string `json:"received,omitempty"`
+	Sent     string `json:"sent,omitempty"`
+}
+
+// ListDataRequests pages through the data requests received and sent by the wallet, newest first (?next=&limit=).
+// Requests from wallets it blocked are left out.
+func (c *WalletAPI) ListDataRequests(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	limit, authErr := pageLimit(request, defaultDataRequestPage, maxDataRequestPage)
+	if authErr != nil {
+		return authErr
+	}
+
+	// the first page starts both lists, later ones continue those not at their end
+	var page dataRequestPage
+	first := true
+	if next := request.QueryParams["next"]; next != "" {
+		b, err := base64.RawURLEncoding.DecodeString(next)
+		if err != nil || json.Unmarshal(b, &page) != nil {
+			return NewApiError("invalid next", ErrorValidation)
+		}
+		first = false
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	list := &datarequests.DataRequestList{
+		Received: []*datarequests.DataRequest{},
+		Sent:     []*datarequests.DataRequest{},
+	}
+	var nextPage dataRequestPage
+	if first || page.Received != "" {
+		var received []*datarequests.DataRequest
+		received, nextPage.Received, err = c.dataRequestStore.ListReceived(ctx, request.TenantID, walletID, page.Received, limit)
+		if err == datarequests.ErrInvalidNext {
+			return NewApiError("invalid next", ErrorValidation)
+		}
+		if err != nil {
+			return NewApiError("error getting data requests: "+err.Error(), ErrorInternalError)
+		}
+		for _, r := range received {
+			if !wallet.Blocks(r.FromWalletID) {
+				list.Received = append(list.Received, r)
+			}
+		}
+	}
+	if first || page.Sent != "" {
+		list.Sent, nextPage.Sent, err = c.dataRequestStore.ListSent(ctx, request.TenantID, walletID, page.Sent, limit)
+		if err == datarequests.ErrInvalidNext {
+			return NewApiError("invalid next", ErrorValidation)
+		}
+		if err != nil {
+			return NewApiError("error getting data requests: "+err.Error(), ErrorInternalError)
+		}
+	}
+	if nextPage.Received != "" || nextPage.Sent != "" {
+		b, _ := json.Marshal(&nextPage)
+		list.Next = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	now := time.Now().UTC().Format(timestampLayout)
+	for _, r := range append(list.Received, list.Sent...) {
+		showExpiry(r, now)
+	}
+	return ApiResponseObject(list)
+}
+
+// GetDataRequest returns a data request to its requester or its owner
+func (c *WalletAPI) GetDataRequest(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	dataRequest, authErr := c.dataRequest(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	if dataRequest.FromWalletID != walletID && dataRequest.ToWalletID != walletID {
+		return NewApiError("data request not found", ErrorValidation)
+	}
+
+	showExpiry(dataRequest, time.Now().UTC().Format(timestampLayout))
+	return ApiResponseObject(dataRequest)
+}
+
+// FulfilDataRequest shares the item in the body with the requester, linked to the request
+func (c *WalletAPI) FulfilDataRequest(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightShare)
+	if authErr != nil {
+		return authErr
+	}
+
+	dataRequest, authErr := c.openDataRequest(ctx, request, walletID, request.PathParams["requestId"])
+	if authErr != nil {
+		return authErr
+	}
+
+	// from here on this is a share to the requester, queued operations replay it with the request ID
+	request.PathParams["toWallet"] = dataRequest.FromWalletID
+	request.DataRequestID = dataRequest.RequestID
+	if limited := c.rateLimitShare(ctx, request, dataRequest.FromWalletID); limited != nil {
+		return limited
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if queued := c.guardOperation(ctx, request, wallet, OperationShareData); queued != nil {
+		return queued
+	}
+
+	return c.shareDataItem(ctx, request, walletID, dataRequest.RequestID)
+}
+
+// DeclineDataRequest refuses an open data request, with an optional reason for the requester
+func (c *WalletAPI) DeclineDataRequest(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightShare)
+	if authErr != nil {
+		return authErr
+	}
+
+	var body DataRequestDecline
+	if request.Body != "" {
+		err := json.Unmarshal([]byte(request.Body), &body)
+		if err != nil {
+			return NewApiError("could not unmarshal payload", ErrorValidation)
+		}
+	}
+
+	dataRequest, authErr := c.openDataRequest(ctx, request, walletID, request.PathParams["requestId"])
+	if authErr != nil {
+		return authErr
+	}
+
+	err := c.dataRequestStore.Decline(ctx, dataRequest.RequestID, body.Reason, request.RequestTimeUTC)
+	if err == datarequests.ErrNotOpen {
+		return NewApiError("data request is no longer open", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not update data request", ErrorInternalError)
+	}
+	c.recordAudit(ctx, request, walletID, "data-request-declined", dataRequest.RequestID)
+
+	return ApiSuccessMessage("data request declined")
+}
+
+// dataRequest loads the data request in the path
+func (c *WalletAPI) dataRequest(ctx context.Context, request *ApiRequest) (*datarequests.DataRequest, *ApiResponse) {
+	requestID, ok := request.PathParams["requestId"]
+	if !ok {
+		return nil, NewApiError("invalid request ID in path", ErrorValidation)
+	}
+	return c.loadDataRequest(ctx, request, requestID)
+}
+
+// loadDataRequest loads a data request of the request's tenant
+func (c *WalletAPI) loadDataRequest(ctx context.Context, request *ApiRequest, requestID string) (*datarequests.DataRequest, *ApiResponse) {
+	dataRequest, err := c.dataRequestStore.GetDataRequest(ctx, requestID)
+	if err == datarequests.ErrNotFound || (err == nil && dataRequest.TenantID != request.TenantID) {
+		return nil, NewApiError("data request not found", ErrorValidation)
+	}
+	if err != nil {
+		return nil, NewApiError("error getting data request: "+err.Error(), ErrorInternalError)
+	}
+	return dataRequest, nil
+}
+
+// openDataRequest loads the data request if it was sent to the wallet and can still be answered
+func (c *WalletAPI) openDataRequest(ctx context.Context, request *ApiRequest, walletID, requestID string) (*datarequests.DataRequest, *ApiResponse) {
+	if requestID == "" {
+		return nil, NewApiError("invalid request ID in path", ErrorValidation)
+	}
+	dataRequest, authErr := c.loadDataRequest(ctx, request, requestID)
+	if authErr != nil {
+		return nil, authErr
+	}
+	if dataRequest.ToWalletID != walletID {
+		return nil, NewApiError("data request not found", ErrorValidation)
+	}
+	if dataRequest.Status == datarequests.StatusDeclined {
+		return nil, NewApiError("data request was declined", ErrorConflict)
+	}
+	if dataRequest.Expired(time.Now().UTC().Format(timestampLayout)) {
+		return nil, NewApiError("data request has expired", ErrorConflict)
+	}
+	return dataRequest, nil
+}
+
+// recordFulfilment links an item shared in response to a data request. The share itself is already stored, so a
+// request declined or expired in the meantime is reported to the caller rather than left unlinked silently.
+func (c *WalletAPI) recordFulfilment(ctx context.Context, request *ApiRequest, walletID, requestID string, dataItem *wallets.WalletDataItem) *ApiResponse {
+	err := c.dataRequestStore.AddFulfilment(ctx, requestID, &datarequests.Fulfilment{
+		ReferenceID: dataItem.ReferenceID,
+		VersionHash: dataItem.VersionHash,
+		SharedAt:    dataItem.CreatedAt,
+	})
+	if err == datarequests.ErrNotOpen {
+		return NewApiError("data shared, but data request "+requestID+" was declined or expired meanwhile and does not list it", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("data shared, but it could not be linked to data request "+requestID, ErrorInternalError)
+	}
+	c.recordAudit(ctx, request, walletID, "data-request-fulfilled", requestID)
+	return nil
+}
+
+// showExpiry reports open requests past their deadline as expired
+func showExpiry(dataRequest *datarequests.DataRequest, now string) {
+	if dataRequest.Status == datarequests.StatusOpen && dataRequest.Expired(now) {
+		dataRequest.Status = datarequests.StatusExpired
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"github.com/google/uuid"
+	"log"
+)
+
+// NewDevice is the body of a device addition
+type NewDevice struct {
+	Name            string `json:"name"`
+	PublicKeyBase64 string `json:"publicKeyBase64"`
+}
+
+// AddDevice adds a device key to the wallet, authorized by an existing key
+func (c *WalletAPI) AddDevice(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	var newDevice NewDevice
+	err := json.Unmarshal([]byte(request.Body), &newDevice)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if newDevice.Name == "" {
+		return NewApiError("name is required", ErrorValidation)
+	}
+	_, err = security.PemBase64ToPublicKey(newDevice.PublicKeyBase64)
+	if err != nil {
+		return NewApiError("invalid publicKeyBase64: "+err.Error(), ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	for _, d := range wallet.ActiveDevices() {
+		if d.PublicKeyBase64 == newDevice.PublicKeyBase64 {
+			return NewApiError("key is already a device of this wallet", ErrorConflict)
+		}
+	}
+
+	device := &wallets.DeviceKey{
+		DeviceID:        uuid.New().String(),
+		Name:            newDevice.Name,
+		PublicKeyBase64: newDevice.PublicKeyBase64,
+		AddedAt:         request.RequestTimeUTC,
+		AddedBy:         request.Principal.DeviceID,
+	}
+	wallet.Devices = append(wallet.Devices, device)
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+
+	return ApiResponseObject(device)
+}
+
+// RemoveDevice removes a device key from the wallet and ends all sessions
+func (c *WalletAPI) RemoveDevice(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if queued := c.guardOperation(ctx, request, wallet, OperationRemoveDevice); queued != nil {
+		return queued
+	}
+
+	return c.removeDevice(ctx, request, walletID)
+}
+
+func (c *WalletAPI) removeDevice(ctx context.Context, request *ApiRequest, walletID string) *ApiResponse {
+	deviceID, ok := request.PathParams["deviceId"]
+	if !ok {
+		return NewApiError("invalid device ID in path", ErrorValidation)
+	}
+	if deviceID == wallets.PrimaryDeviceID {
+		return NewApiError("the primary key cannot be removed, rotate it instead", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	device, ok := wallet.Device(deviceID)
+	if !ok {
+		return NewApiError("unknown device "+deviceID, ErrorValidation)
+	}
+	device.RemovedAt = request.RequestTimeUTC
+	device.RemovedBy = request.Principal.DeviceID
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+
+	// sessions may have been started with the removed device
+	err = c.sessionStore.RevokeAllSessions(ctx, request.TenantID, walletID)
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	return ApiSuccessMessage("device removed")
+}
+
+// ListDevices lists the device keys of the wallet, including removed ones
+func (c *WalletAPI) ListDevices(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	devices := wallet.ActiveDevices()[:1]
+	devices = append(devices, wallet.Devices...)
+
+	return ApiResponseObject(&wallets.DeviceList{
+		Devices: devices,
+	})
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+)
+
+// KeyRotation is the body of a key rotation, the request itself must be signed with the new key
+type KeyRotation struct {
+	PublicKeyBase64     string `json:"publicKeyBase64"`
+	PrivateKeyEncrypted string `json:"privateKeyEncrypted"`
+
+	// RecoveryPublicKeyBase64 replaces the recovery key (optional, the current one is kept if blank),
+	// only a rotation signed by the recovery key can change it
+	RecoveryPublicKeyBase64 string `json:"recoveryPublicKeyBase64"`
+
+	// RotationSignature is base64(PKCS1v15(sha256(wallets.RotationStatement))) by the current key or the recovery key,
+	// using the request timestamp as createdAt
+	RotationSignature string `json:"rotationSignature"`
+}
+
+// RotateKey replaces the wallet key while keeping the wallet ID
+func (c *WalletAPI) RotateKey(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+	if request.HasMessageSignature() {
+		keyID, err := request.SignatureKeyID()
+		if err != nil || keyID != walletID {
+			return NewApiError("invalid signature: keyid must be the wallet ID "+walletID, ErrorUnauthorized)
+		}
+	}
+
+	var rotation KeyRotation
+	err := json.Unmarshal([]byte(request.Body), &rotation)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+
+	_, err = security.PemBase64ToPublicKey(rotation.PublicKeyBase64)
+	if err != nil {
+		return NewApiError("invalid publicKeyBase64: "+err.Error(), ErrorValidation)
+	}
+	if rotation.RecoveryPublicKeyBase64 != "" {
+		_, err = security.PemBase64ToPublicKey(rotation.RecoveryPublicKeyBase64)
+		if err != nil {
+			return NewApiError("invalid recoveryPublicKeyBase64: "+err.Error(), ErrorValidation)
+		}
+	}
+
+	// proves possession of the new key
+	err = request.ValidateSignature(rotation.PublicKeyBase64)
+	if err != nil {
+		return NewApiError("invalid signature (must be signed with the new key): "+err.Error(), ErrorUnauthorized)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	// a locked out wallet can still be rotated with its recovery key, which is the only way to lift the lockout early
+	found, locked := c.checkLockout(ctx, request, walletID)
+	_, signedBy, authErr := verifyRotation(wallet, &rotation, request.RequestTimeUTC)
+	if authErr != nil {
+		if locked != nil {
+			return locked
+		}
+		c.recordSignatureFailure(ctx, request, walletID)
+		return authErr
+	}
+	if locked != nil && signedBy == wallet.PublicKeyBase64 {
+		return locked
+	}
+	deviceID := wallets.PrimaryDeviceID
+	if signedBy != wallet.PublicKeyBase64 {
+		deviceID = wallets.RecoveryDeviceID
+	}
+	c.clearLockout(ctx, request, walletID, found, deviceID == wallets.RecoveryDeviceID)
+	request.Principal = &Principal{
+		WalletID: walletID,
+		DeviceID: deviceID,
+	}
+	if queued := c.guardOperation(ctx, request, wallet, OperationRotateKey); queued != nil {
+		return queued
+	}
+
+	return c.rotateKey(ctx, request, walletID)
+}
+
+// rotateKey applies a rotation, the rotation signature is checked again against the wallet as it is now
+func (c *WalletAPI) rotateKey(ctx context.Context, request *ApiRequest, walletID string) *ApiResponse {
+	var rotation KeyRotation
+	err := json.Unmarshal([]byte(request.Body), &rotation)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	recoveryKey, signedBy, authErr := verifyRotation(wallet, &rotation, request.RequestTimeUTC)
+	if authErr != nil {
+		return authErr
+	}
+
+	history := wallet.CurrentKeyHistory()
+	history[len(history)-1].ValidUntil = request.RequestTimeUTC
+	wallet.KeyHistory = append(history, &wallets.WalletKey{
+		PublicKeyBase64:         rotation.PublicKeyBase64,
+		ValidFrom:               request.RequestTimeUTC,
+		RotationSignature:       rotation.RotationSignature,
+		SignedBy:                signedBy,
+		RecoveryPublicKeyBase64: recoveryKey,
+	})
+	wallet.PublicKeyBase64 = rotation.PublicKeyBase64
+	wallet.PrivateKeyEncrypted = rotation.PrivateKeyEncrypted
+	wallet.RecoveryPublicKeyBase64 = recoveryKey
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+
+	// sessions were started with the old key
+	err = c.sessionStore.RevokeAllSessions(ctx, request.TenantID, walletID)
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	return ApiResponseObject(wallet)
+}
+
+// verifyRotation checks the rotation signature by the current or recovery key, returning the new recovery key and the signer
+func verifyRotation(wallet *wallets.Wallet, rotation *KeyRotation, createdAt string) (string, string, *ApiResponse) {
+	recoveryKey := rotation.RecoveryPublicKeyBase64
+	if recoveryKey == "" {
+		recoveryKey = wallet.RecoveryPublicKeyBase64
+	}
+
+	statement, err := wallets.RotationStatement(wallet.WalletID, wallet.PublicKeyBase64, rotation.PublicKeyBase64, recoveryKey, createdAt)
+	if err != nil {
+		return "", "", NewApiError("could not create rotation statement: "+err.Error(), ErrorValidation)
+	}
+
+	signedBy := ""
+	for _, key := range []string{wallet.PublicKeyBase64, wallet.RecoveryPublicKeyBase64} {
+		if key == "" {
+			continue
+		}
+		pubKey, err := security.ParsePublicKey(key)
+		if err == nil && security.VerifySignature(statement, rotation.RotationSignature, pubKey) == nil {
+			signedBy = key
+			break
+		}
+	}
+	if signedBy == "" {
+		return "", "", NewApiError("invalid rotationSignature: must be signed by the current or recovery key", ErrorUnauthorized)
+	}
+
+	// a stolen primary key must not be able to lock the owner out of recovery
+	if recoveryKey != wallet.RecoveryPublicKeyBase64 && signedBy != wallet.RecoveryPublicKeyBase64 {
+		return "", "", NewApiError("the recovery key can only be changed by a rotation signed with the recovery key", ErrorForbidden)
+	}
+
+	return recoveryKey, signedBy, nil
+}
+
+// RecoveryUpdate is the body of an update of the escrowed private key
+type RecoveryUpdate struct {
+	PrivateKeyEncrypted string `json:"privateKeyEncrypted"`
+
+	// RecoveryContact replaces the contact used for recovery (optional)
+	RecoveryContact string `json:"recoveryContact"`
+}
+
+// UpdateRecovery replaces the encrypted private key, signed by the primary key
+func (c *WalletAPI) UpdateRecovery(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	if request.Principal.DeviceID != wallets.PrimaryDeviceID {
+		return NewApiError("recovery can only be updated with the primary key", ErrorForbidden)
+	}
+
+	var update RecoveryUpdate
+	err := json.Unmarshal([]byte(request.Body), &update)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if update.PrivateKeyEncrypted == "" {
+		return NewApiError("privateKeyEncrypted is required", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	wallet.PrivateKeyEncrypted = update.PrivateKeyEncrypted
+	if update.RecoveryContact != "" {
+		wallet.RecoveryContact = update.RecoveryContact
+	}
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+
+	return ApiSuccessMessage("recovery updated")
+}
+
+// GetKeyHistory returns every key the wallet has had, with the signatures authorizing each rotation
+func (c *WalletAPI) GetKeyHistory(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	return c.auditResponse(ctx, request, walletID, AuditKeyLookup, "history", "", ApiResponseObject(&wallets.WalletKeyHistory{
+		WalletID: walletID,
+		Keys:     wallet.CurrentKeyHistory(),
+	}))
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type testKey struct {
+	private *rsa.PrivateKey
+	base64  string
+}
+
+func newTestKey(t *testing.T) *testKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	return &testKey{
+		private: key,
+		base64:  base64.StdEncoding.EncodeToString(pemKey),
+	}
+}
+
+func (k *testKey) sign(t *testing.T, payload []byte) string {
+	hashed := sha256.Sum256(payload)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.private, crypto.SHA256, hashed[:])
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestVerifyRotation(t *testing.T) {
+	current, recovery, next, otherRecovery := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	createdAt := "2024-03-01T10:00:00.000Z"
+
+	tests := []struct {
+		name        string
+		recoveryKey string
+		newRecovery string
+		signer      *testKey
+		signedBy    string
+		status      int
+	}{
+		{"current key keeps recovery key", recovery.base64, "", current, current.base64, 0},
+		{"current key repeats recovery key", recovery.base64, recovery.base64, current, current.base64, 0},
+		{"recovery key keeps recovery key", recovery.base64, "", recovery, recovery.base64, 0},
+		{"recovery key replaces recovery key", recovery.base64, otherRecovery.base64, recovery, recovery.base64, 0},
+		{"current key replaces recovery key", recovery.base64, otherRecovery.base64, current, "", 403},
+		{"current key sets first recovery key", "", otherRecovery.base64, current, "", 403},
+		{"signed by another key", recovery.base64, "", otherRecovery, "", 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wallet := &wallets.Wallet{
+				WalletID:                "wallet",
+				PublicKeyBase64:         current.base64,
+				RecoveryPublicKeyBase64: tt.recoveryKey,
+			}
+
+			wantRecovery := tt.newRecovery
+			if wantRecovery == "" {
+				wantRecovery = tt.recoveryKey
+			}
+			statement, err := wallets.RotationStatement(wallet.WalletID, current.base64, next.base64, wantRecovery, createdAt)
+			assert.NoError(t, err)
+
+			rotation := &KeyRotation{
+				PublicKeyBase64:         next.base64,
+				RecoveryPublicKeyBase64: tt.newRecovery,
+				RotationSignature:       tt.signer.sign(t, statement),
+			}
+
+			recoveryKey, signedBy, authErr := verifyRotation(wallet, rotation, createdAt)
+			if tt.status != 0 {
+				if assert.NotNil(t, authErr) {
+					assert.Equal(t, tt.status, authErr.StatusCode)
+				}
+				return
+			}
+			assert.Nil(t, authErr)
+			assert.Equal(t, wantRecovery, recoveryKey)
+			assert.Equal(t, tt.signedBy, signedBy)
+		})
+	}
+}
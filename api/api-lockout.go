@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/citizendata/datawallet/wallet-api/store/audit"
+	"github.com/citizendata/datawallet/wallet-api/store/lockouts"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// signature failures from a source allowed before each further one locks the wallet out for that source, for twice
+	// as long each time
+	lockoutFreeFailures = 3
+	lockoutBaseDelay    = 30 * time.Second
+	lockoutMaxDelay     = time.Hour
+
+	// lockoutAllSources counts the wallet's failures from every source, so that changing source does not get around
+	// the lockout; it allows more failures before locking the wallet out for everyone
+	lockoutAllSources         = "*"
+	lockoutWalletFreeFailures = 10
+
+	// lockoutWindow is how long failures are remembered after the last one
+	lockoutWindow = 24 * time.Hour
+
+	// tenantAlertFailures signature failures in a tenant within an hour raise an alert
+	tenantAlertFailures = 100
+)
+
+// GetLockout returns the recent signature failures of the wallet from the caller's source, signed by the wallet or
+// with a session. It is refused like any request while the wallet is locked out (the 429 tells until when), the
+// failures are read before the valid signature clears them.
+func (c *WalletAPI) GetLockout(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+
+	source := lockoutSource(request)
+	lockout, err := c.lockoutStore.GetLockout(ctx, request.TenantID, walletID, source)
+	if err != nil {
+		return NewApiError("error getting lockout: "+err.Error(), ErrorInternalError)
+	}
+
+	_, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	if lockout == nil {
+		lockout = &lockouts.Lockout{
+			TenantID: request.TenantID,
+			WalletID: walletID,
+			Source:   source,
+		}
+	}
+	setLockedUntil(lockout)
+	return ApiResponseObject(lockout)
+}
+
+// lockoutSource is where the request came from, failures are counted per wallet and source so that failures from
+// one client do not lock the wallet out for the others
+func lockoutSource(request *ApiRequest) string {
+	if request.SourceIP == "" {
+		return "unknown"
+	}
+	return request.SourceIP
+}
+
+// setLockedUntil sets when the lockout ends: each failure past lockoutFreeFailures (lockoutWalletFreeFailures from all
+// sources) locks the wallet out from the last failure, for twice as long as the one before
+func setLockedUntil(lockout *lockouts.Lockout) {
+	lockout.LockedUntil = ""
+	free := lockoutFreeFailures
+	if lockout.Source == lockoutAllSources {
+		free = lockoutWalletFreeFailures
+	}
+	n := lockout.Failures - free
+	if n <= 0 {
+		return
+	}
+	last, err := time.Parse(timestampLayout, lockout.LastFailureAt)
+	if err != nil {
+		return
+	}
+
+	delay := lockoutMaxDelay
+	if n < 16 && lockoutBaseDelay<<uint(n-1) < lockoutMaxDelay {
+		delay = lockoutBaseDelay << uint(n-1)
+	}
+	lockout.LockedUntil = last.Add(delay).Format(timestampLayout)
+}
+
+// checkLockout refuses signatures of a wallet locked out for the request's source or for all sources, it also returns
+// the lockouts found. Lockout store errors are logged and the signature is checked.
+func (c *WalletAPI) checkLockout(ctx context.Context, request *ApiRequest, walletID string) ([]*lockouts.Lockout, *ApiResponse) {
+	if c.lockoutStore == nil {
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	var found []*lockouts.Lockout
+	var resp *ApiResponse
+	for _, source := range []string{lockoutSource(request), lockoutAllSources} {
+		lockout, err := c.lockoutStore.GetLockout(ctx, request.TenantID, walletID, source)
+		if err != nil {
+			log.Print(err.Error())
+			continue
+		}
+		if lockout == nil {
+			continue
+		}
+		found = append(found, lockout)
+
+		setLockedUntil(lockout)
+		if resp == nil && lockout.Locked(now.Format(timestampLayout)) {
+			until, _ := time.Parse(timestampLayout, lockout.LockedUntil)
+			resp = NewApiError("wallet "+walletID+" is locked after repeated signature failures until "+lockout.LockedUntil, ErrorTooManyRequests)
+			resp.Headers = map[string]string{
+				"Retry-After": strconv.Itoa(int(until.Sub(now).Seconds()) + 1),
+			}
+		}
+	}
+	return found, resp
+}
+
+// recordSignatureFailure counts a failed signature of the wallet from the request's source and from all sources,
+// locking it out once past their free failures
+func (c *WalletAPI) recordSignatureFailure(ctx context.Context, request *ApiRequest, walletID string) {
+	if c.lockoutStore == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, source := range []string{lockoutSource(request), lockoutAllSources} {
+		lockout, err := c.lockoutStore.AddFailure(ctx, request.TenantID, walletID, source,
+			now.Format(timestampLayout), now.Add(-lockoutWindow).Format(timestampLayout), now.Add(lockoutWindow).Unix())
+		if err != nil {
+			log.Print(err.Error())
+			continue
+		}
+		setLockedUntil(lockout)
+		if lockout.LockedUntil != "" {
+			c.recordLockoutAudit(ctx, request, walletID, "wallet-locked", source+" until "+lockout.LockedUntil)
+		}
+	}
+
+	window := now.Truncate(time.Hour)
+	failures, err := c.lockoutStore.CountTenantFailure(ctx, request.TenantID, window.Format(timestampLayout), window.Add(2*time.Hour).Unix())
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	if failures == tenantAlertFailures {
+		err = c.alerter.Alert(ctx, request.TenantID, fmt.Sprintf("%d signature failures since %s (last on wallet %s)", failures, window.Format(timestampLayout), walletID))
+		if err != nil {
+			log.Print(err.Error())
+		}
+	}
+}
+
+// clearLockout forgets the wallet's failures from the request's source after a valid signature, they stay in the
+// audit log. The failures from all sources are only forgotten with a rotation signed by the recovery key (withRecovery)
+// or after lockoutWindow, so a lockout of the wallet can only be lifted with the recovery key.
+func (c *WalletAPI) clearLockout(ctx context.Context, request *ApiRequest, walletID string, found []*lockouts.Lockout, withRecovery bool) {
+	for _, lockout := range found {
+		if lockout.Source == lockoutAllSources && !withRecovery {
+			continue
+		}
+		err := c.lockoutStore.DeleteLockout(ctx, request.TenantID, walletID, lockout.Source)
+		if err != nil {
+			log.Print(err.Error())
+		}
+		c.recordLockoutAudit(ctx, request, walletID, "signature-failures-cleared", lockout.Source+": "+strconv.Itoa(lockout.Failures))
+	}
+}
+
+func (c *WalletAPI) recordLockoutAudit(ctx context.Context, request *ApiRequest, walletID, operation, target string) {
+	c.recordEvent(ctx, request, &audit.Event{
+		WalletID:  walletID,
+		Operation: operation,
+		Target:    target,
+	})
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"github.com/citizendata/datawallet/wallet-api/store/lockouts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSetLockedUntil(t *testing.T) {
+	tests := []struct {
+		name          string
+		source        string
+		failures      int
+		lastFailureAt string
+		lockedUntil   string
+	}{
+		{"free failures", "10.0.0.1", 3, "2024-03-01T10:00:00.000Z", ""},
+		{"first lockout", "10.0.0.1", 4, "2024-03-01T10:00:00.000Z", "2024-03-01T10:00:30.000Z"},
+		{"doubled", "10.0.0.1", 6, "2024-03-01T10:00:00.000Z", "2024-03-01T10:02:00.000Z"},
+		{"capped", "10.0.0.1", 12, "2024-03-01T10:00:00.000Z", "2024-03-01T11:00:00.000Z"},
+		{"far past the cap", "10.0.0.1", 80, "2024-03-01T10:00:00.000Z", "2024-03-01T11:00:00.000Z"},
+		{"invalid last failure", "10.0.0.1", 5, "", ""},
+		{"all sources free failures", lockoutAllSources, 10, "2024-03-01T10:00:00.000Z", ""},
+		{"all sources lockout", lockoutAllSources, 11, "2024-03-01T10:00:00.000Z", "2024-03-01T10:00:30.000Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lockout := &lockouts.Lockout{
+				Source:        tt.source,
+				Failures:      tt.failures,
+				LastFailureAt: tt.lastFailureAt,
+				LockedUntil:   "2024-01-01T00:00:00.000Z",
+			}
+			setLockedUntil(lockout)
+			assert.Equal(t, tt.lockedUntil, lockout.LockedUntil)
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+)
+
+// MemberRole is the body to add a member or change its role
+type MemberRole struct {
+	Role string `json:"role"`
+}
+
+// PutMember adds a member to an organization wallet or changes its role, signed by the organization or an admin
+func (c *WalletAPI) PutMember(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightManage)
+	if authErr != nil {
+		return authErr
+	}
+
+	memberID, ok := request.PathParams["member"]
+	if !ok || memberID == walletID {
+		return NewApiError("invalid member wallet ID in path", ErrorValidation)
+	}
+
+	var body MemberRole
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if !wallets.ValidRole(body.Role) {
+		return NewApiError("unknown role "+body.Role, ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if !wallet.Organization {
+		return NewApiError("wallet "+walletID+" is not an organization wallet", ErrorValidation)
+	}
+
+	_, err = c.walletStore.GetWallet(ctx, request.TenantID, memberID)
+	if err != nil {
+		return NewApiError("error getting member wallet "+memberID+": "+err.Error(), ErrorValidation)
+	}
+
+	member, ok := wallet.Member(memberID)
+	if !ok {
+		member = &wallets.Member{
+			WalletID: memberID,
+			AddedAt:  request.RequestTimeUTC,
+			AddedBy:  request.Principal.WalletID,
+		}
+		wallet.Members = append(wallet.Members, member)
+	}
+	member.Role = body.Role
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+	c.recordAudit(ctx, request, walletID, "member-set", memberID)
+
+	return ApiResponseObject(member)
+}
+
+// RemoveMember removes a member from an organization wallet, signed by the organization or an admin
+func (c *WalletAPI) RemoveMember(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightManage)
+	if authErr != nil {
+		return authErr
+	}
+
+	memberID, ok := request.PathParams["member"]
+	if !ok {
+		return NewApiError("invalid member wallet ID in path", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	member, ok := wallet.Member(memberID)
+	if !ok {
+		return NewApiError("wallet "+memberID+" is not a member", ErrorValidation)
+	}
+	member.RemovedAt = request.RequestTimeUTC
+	member.RemovedBy = request.Principal.WalletID
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+	c.recordAudit(ctx, request, walletID, "member-removed", memberID)
+
+	return ApiSuccessMessage("member removed")
+}
+
+// ListMembers lists the members of an organization wallet, including removed ones
+func (c *WalletAPI) ListMembers(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	return ApiResponseObject(&wallets.MemberList{
+		Members: wallet.Members,
+	})
+}
@@ -0,0 +1,334 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/store/operations"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"github.com/google/uuid"
+	"log"
+	"time"
+)
+
+const (
+	operationTTL = 7 * 24 * time.Hour
+
+	// operations that can require co-signers
+	OperationShareData    = "share-data"
+	OperationRotateKey    = "rotate-key"
+	OperationRemoveDevice = "remove-device"
+	OperationSetPolicies  = "set-policies"
+)
+
+// operationExecutor runs an operation once authorized (and approved), walletID is the wallet in the path
+type operationExecutor func(ctx context.Context, request *ApiRequest, walletID string) *ApiResponse
+
+func (c *WalletAPI) executor(operation string) operationExecutor {
+	switch operation {
+	case OperationShareData:
+		return func(ctx context.Context, request *ApiRequest, walletID string) *ApiResponse {
+			return c.shareDataItem(ctx, request, walletID, request.DataRequestID)
+		}
+	case OperationRotateKey:
+		return c.rotateKey
+	case OperationRemoveDevice:
+		return c.removeDevice
+	case OperationSetPolicies:
+		return c.setPolicies
+	}
+	return nil
+}
+
+// guardOperation queues the authorized request if the wallet has a policy for the operation.
+// It returns nil if the operation can be executed right away.
+func (c *WalletAPI) guardOperation(ctx context.Context, request *ApiRequest, wallet *wallets.Wallet, operation string) *ApiResponse {
+	policy := wallet.Policy(operation)
+	if policy == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	op := &operations.Operation{
+		OperationID: uuid.New().String(),
+		TenantID:    request.TenantID,
+		WalletID:    wallet.WalletID,
+		Type:        operation,
+		Request: &operations.Request{
+			Method:         request.Method,
+			PathParams:     request.PathParams,
+			QueryParams:    request.QueryParams,
+			Body:           request.Body,
+			RequestTimeUTC: request.RequestTimeUTC,
+			WalletID:       request.Principal.WalletID,
+			DeviceID:       request.Principal.DeviceID,
+			DataRequestID:  request.DataRequestID,
+		},
+		Threshold: policy.Threshold,
+		Signers:   policy.Signers,
+		Approvals: map[string]*operations.Approval{},
+		Status:    operations.StatusPending,
+		CreatedAt: now.Format(timestampLayout),
+		ExpiresAt: now.Add(operationTTL).Unix(),
+	}
+
+	// the initiator counts as the first co-signer
+	if signer := matchSigner(policy.Signers, request.Principal.WalletID, request.Principal.DeviceID); signer != "" {
+		op.Approvals[signer] = &operations.Approval{
+			Signer:     signer,
+			WalletID:   request.Principal.WalletID,
+			DeviceID:   request.Principal.DeviceID,
+			ApprovedAt: request.RequestTimeUTC,
+		}
+	}
+	if op.Approved() {
+		return nil
+	}
+
+	err := c.operationStore.CreateOperation(ctx, op)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store pending operation", ErrorInternalError)
+	}
+
+	return apiAccepted(op)
+}
+
+// matchSigner returns the policy signer for the key, preferring a signer naming the device
+func matchSigner(signers []string, walletID, deviceID string) string {
+	for _, s := range signers {
+		if s == walletID+"#"+deviceID {
+			return s
+		}
+	}
+	for _, s := range signers {
+		if s == walletID {
+			return s
+		}
+	}
+	return ""
+}
+
+// executeOperation runs an approved operation, at most once
+func (c *WalletAPI) executeOperation(ctx context.Context, op *operations.Operation) *ApiResponse {
+	execute := c.executor(op.Type)
+	if execute == nil {
+		return NewApiError("unknown operation "+op.Type, ErrorInternalError)
+	}
+
+	err := c.operationStore.ClaimOperation(ctx, op.OperationID)
+	if err == operations.ErrNotPending {
+		return NewApiError("operation was already executed", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not execute operation", ErrorInternalError)
+	}
+
+	request := &ApiRequest{
+		RequestTimeUTC: op.Request.RequestTimeUTC,
+		Method:         op.Request.Method,
+		Body:           op.Request.Body,
+		PathParams:     op.Request.PathParams,
+		QueryParams:    op.Request.QueryParams,
+		TenantID:       op.TenantID,
+		DataRequestID:  op.Request.DataRequestID,
+		Principal: &Principal{
+			WalletID: op.Request.WalletID,
+			DeviceID: op.Request.DeviceID,
+		},
+	}
+	resp := execute(ctx, request, op.WalletID)
+
+	status := operations.StatusExecuted
+	if resp.StatusCode >= 300 {
+		status = operations.StatusFailed
+	}
+	err = c.operationStore.FinishOperation(ctx, op.OperationID, status, resp.StatusCode, resp.Body)
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	return resp
+}
+
+// ApproveOperation adds a co-signer's approval and executes the operation once the threshold is met
+func (c *WalletAPI) ApproveOperation(ctx context.Context, request *ApiRequest) *ApiResponse {
+	op, authErr := c.pendingOperation(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	// the approval may execute the share, which the key must allow like the share route itself
+	if op.Type == OperationShareData && request.NoShare {
+		return NewApiError("api key scope does not allow sharing data", ErrorForbidden)
+	}
+
+	actorID, deviceID, authErr := c.authorizeActor(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	signer := matchSigner(op.Signers, actorID, deviceID)
+	if signer == "" {
+		return NewApiError("not a co-signer of this operation", ErrorForbidden)
+	}
+
+	op, err := c.operationStore.AddApproval(ctx, op.OperationID, &operations.Approval{
+		Signer:     signer,
+		WalletID:   actorID,
+		DeviceID:   deviceID,
+		ApprovedAt: request.RequestTimeUTC,
+	})
+	if err == operations.ErrAlreadyApproved {
+		return NewApiError("already approved by "+signer, ErrorConflict)
+	}
+	if err == operations.ErrNotPending {
+		return NewApiError("operation is not pending", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store approval", ErrorInternalError)
+	}
+
+	if !op.Approved() {
+		return apiAccepted(op)
+	}
+	return c.executeOperation(ctx, op)
+}
+
+// GetOperation returns an operation to the wallet owner or one of its co-signers
+func (c *WalletAPI) GetOperation(ctx context.Context, request *ApiRequest) *ApiResponse {
+	op, authErr := c.operation(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	actorID, deviceID, authErr := c.authorizeActor(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	if actorID != op.WalletID && matchSigner(op.Signers, actorID, deviceID) == "" {
+		return NewApiError("not a co-signer of this operation", ErrorForbidden)
+	}
+
+	return ApiResponseObject(op)
+}
+
+// ListOperations lists the operations of the wallet, newest first
+func (c *WalletAPI) ListOperations(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	ops, err := c.operationStore.ListOperations(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting operations: "+err.Error(), ErrorInternalError)
+	}
+
+	return ApiResponseObject(&operations.OperationList{
+		Operations: ops,
+	})
+}
+
+// SetPolicies replaces the wallet's co-signing policies, signed by the primary key
+func (c *WalletAPI) SetPolicies(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	if request.Principal.DeviceID != wallets.PrimaryDeviceID {
+		return NewApiError("policies can only be set with the primary key", ErrorForbidden)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if queued := c.guardOperation(ctx, request, wallet, OperationSetPolicies); queued != nil {
+		return queued
+	}
+
+	return c.setPolicies(ctx, request, walletID)
+}
+
+func (c *WalletAPI) setPolicies(ctx context.Context, request *ApiRequest, walletID string) *ApiResponse {
+	var list wallets.PolicyList
+	err := json.Unmarshal([]byte(request.Body), &list)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+
+	seen := map[string]bool{}
+	for _, p := range list.Policies {
+		if c.executor(p.Operation) == nil {
+			return NewApiError("unknown operation "+p.Operation, ErrorValidation)
+		}
+		if seen[p.Operation] {
+			return NewApiError("duplicate policy for "+p.Operation, ErrorValidation)
+		}
+		seen[p.Operation] = true
+		if p.Threshold < 1 || p.Threshold > len(p.Signers) {
+			return NewApiError("threshold must be between 1 and the number of signers", ErrorValidation)
+		}
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	wallet.Policies = list.Policies
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+
+	return ApiResponseObject(&wallets.PolicyList{
+		Policies: wallet.Policies,
+	})
+}
+
+// operation loads the operation in the path
+func (c *WalletAPI) operation(ctx context.Context, request *ApiRequest) (*operations.Operation, *ApiResponse) {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return nil, NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+	operationID, ok := request.PathParams["operationId"]
+	if !ok {
+		return nil, NewApiError("invalid operation ID in path", ErrorValidation)
+	}
+
+	op, err := c.operationStore.GetOperation(ctx, operationID)
+	if err != nil || op.TenantID != request.TenantID || op.WalletID != walletID {
+		return nil, NewApiError("unknown operation "+operationID, ErrorValidation)
+	}
+	return op, nil
+}
+
+// pendingOperation loads the operation in the path if it can still be approved
+func (c *WalletAPI) pendingOperation(ctx context.Context, request *ApiRequest) (*operations.Operation, *ApiResponse) {
+	op, authErr := c.operation(ctx, request)
+	if authErr != nil {
+		return nil, authErr
+	}
+	if op.Status != operations.StatusPending {
+		return nil, NewApiError("operation is "+op.Status, ErrorConflict)
+	}
+	if time.Now().UTC().Unix() > op.ExpiresAt {
+		return nil, NewApiError("operation expired", ErrorForbidden)
+	}
+	return op, nil
+}
+
+// apiAccepted responds 202 with an operation waiting for approvals
+func apiAccepted(op *operations.Operation) *ApiResponse {
+	resp := ApiResponseObject(op)
+	if resp.StatusCode == 200 {
+		resp.StatusCode = 202
+	}
+	return resp
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// limiterRetry is the Retry-After of requests rejected because the limiter failed
+const limiterRetry = time.Second
+
+// rateLimit applies the tenant's and the path wallet's request limits, once per request and before
+// signatures are checked. If the limits cannot be checked the request is rejected, to be retried.
+func (c *WalletAPI) rateLimit(ctx context.Context, request *ApiRequest) *ApiResponse {
+	if c.limiter == nil || request.rateLimited {
+		return nil
+	}
+	request.rateLimited = true
+
+	wait, err := c.limiter.Allow(ctx, request.TenantID, request.PathParams["wallet"])
+	if err != nil {
+		log.Print(err.Error())
+		return apiRateLimited(limiterRetry)
+	}
+	return apiRateLimited(wait)
+}
+
+// rateLimitShare applies the limit on shares (and data requests) from the path wallet to toWalletID, then the
+// request limits
+func (c *WalletAPI) rateLimitShare(ctx context.Context, request *ApiRequest, toWalletID string) *ApiResponse {
+	if c.limiter == nil {
+		return nil
+	}
+
+	wait, err := c.limiter.AllowShare(ctx, request.TenantID, request.PathParams["wallet"], toWalletID)
+	if err != nil {
+		log.Print(err.Error())
+		return apiRateLimited(limiterRetry)
+	}
+	if limited := apiRateLimited(wait); limited != nil {
+		return limited
+	}
+	return c.rateLimit(ctx, request)
+}
+
+// apiRateLimited responds 429 with a Retry-After in seconds, or nil if there is no wait
+func apiRateLimited(wait time.Duration) *ApiResponse {
+	if wait <= 0 {
+		return nil
+	}
+	resp := NewApiError("rate limit exceeded, retry later", ErrorTooManyRequests)
+	resp.Headers = map[string]string{
+		"Retry-After": strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+	}
+	return resp
+}
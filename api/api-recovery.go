@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/recovery"
+	"github.com/citizendata/datawallet/wallet-api/store/recoveries"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"github.com/google/uuid"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryChallengeTTL  = 15 * time.Minute
+	recoveryMaxAttempts   = 5
+	recoveryMaxChallenges = 3
+	recoveryWindow        = time.Hour
+)
+
+// RecoveryAPI releases a wallet's encrypted private key once the owner passes the tenant's second factor
+type RecoveryAPI struct {
+	walletAPI     *WalletAPI
+	walletStore   wallets.WalletStore
+	recoveryStore recoveries.RecoveryStore
+	verifierName  string
+	verifier      recovery.Verifier
+}
+
+// RecoveryChallenge is returned when a recovery is started
+type RecoveryChallenge struct {
+	ChallengeID string `json:"challengeId"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	SentTo      string `json:"sentTo"`
+}
+
+// RecoveryResponse is the body to complete a recovery
+type RecoveryResponse struct {
+	ChallengeID string `json:"challengeId"`
+	Response    string `json:"response"`
+}
+
+type RecoveredWallet struct {
+	WalletID            string `json:"walletId"`
+	PublicKeyBase64     string `json:"publicKeyBase64"`
+	PrivateKeyEncrypted string `json:"privateKeyEncrypted"`
+}
+
+// NewRecoveryAPI creates the API, verifier is nil if the tenant has no recovery verifier
+func NewRecoveryAPI(walletAPI *WalletAPI, walletStore wallets.WalletStore, recoveryStore recoveries.RecoveryStore, verifierName string, verifier recovery.Verifier) *RecoveryAPI {
+	return &RecoveryAPI{
+		walletAPI:     walletAPI,
+		walletStore:   walletStore,
+		recoveryStore: recoveryStore,
+		verifierName:  verifierName,
+		verifier:      verifier,
+	}
+}
+
+func (c *RecoveryAPI) recordEvent(ctx context.Context, request *ApiRequest, walletID, eventType, challengeID string) {
+	err := c.recoveryStore.RecordEvent(ctx, &recoveries.Event{
+		TenantID:    request.TenantID,
+		WalletID:    walletID,
+		Type:        eventType,
+		ChallengeID: challengeID,
+		CreatedAt:   time.Now().UTC().Format(timestampLayout),
+		SourceIP:    request.SourceIP,
+	})
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
+
+// StartRecovery sends a challenge to the wallet's recovery contact
+func (c *RecoveryAPI) StartRecovery(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+	if c.verifier == nil {
+		return NewApiError("recovery is not enabled for this tenant", ErrorForbidden)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if wallet.RecoveryContact == "" || wallet.PrivateKeyEncrypted == "" {
+		return NewApiError("recovery is not set up for wallet "+walletID, ErrorValidation)
+	}
+
+	now := time.Now().UTC()
+	events, err := c.recoveryStore.ListEvents(ctx, request.TenantID, walletID, now.Add(-recoveryWindow).Format(timestampLayout))
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not check recovery attempts", ErrorInternalError)
+	}
+	started := 0
+	for _, e := range events {
+		if e.Type == recoveries.EventChallengeStarted {
+			started++
+		}
+	}
+	if started >= recoveryMaxChallenges {
+		c.recordEvent(ctx, request, walletID, recoveries.EventRateLimited, "")
+		return NewApiError("too many recovery attempts, try again later", ErrorTooManyRequests)
+	}
+
+	state, err := c.verifier.Start(ctx, request.TenantID, walletID, wallet.RecoveryContact)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not send recovery challenge", ErrorInternalError)
+	}
+
+	challenge := &recoveries.Challenge{
+		ChallengeID: uuid.New().String(),
+		TenantID:    request.TenantID,
+		WalletID:    walletID,
+		Verifier:    c.verifierName,
+		State:       state,
+		CreatedAt:   now.Format(timestampLayout),
+		ExpiresAt:   now.Add(recoveryChallengeTTL).Unix(),
+	}
+	err = c.recoveryStore.CreateChallenge(ctx, challenge)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store recovery challenge", ErrorInternalError)
+	}
+	c.recordEvent(ctx, request, walletID, recoveries.EventChallengeStarted, challenge.ChallengeID)
+
+	return ApiResponseObject(&RecoveryChallenge{
+		ChallengeID: challenge.ChallengeID,
+		ExpiresAt:   challenge.ExpiresAt,
+		SentTo:      maskContact(wallet.RecoveryContact),
+	})
+}
+
+// CompleteRecovery verifies the response to the challenge and returns the encrypted private key
+func (c *RecoveryAPI) CompleteRecovery(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+	if c.verifier == nil {
+		return NewApiError("recovery is not enabled for this tenant", ErrorForbidden)
+	}
+
+	var response RecoveryResponse
+	err := json.Unmarshal([]byte(request.Body), &response)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+
+	challenge, err := c.recoveryStore.AddAttempt(ctx, response.ChallengeID)
+	if err != nil {
+		return NewApiError("invalid recovery challenge", ErrorUnauthorized)
+	}
+	if challenge.TenantID != request.TenantID || challenge.WalletID != walletID ||
+		challenge.CompletedAt != "" || time.Now().UTC().Unix() > challenge.ExpiresAt {
+		return NewApiError("invalid recovery challenge", ErrorUnauthorized)
+	}
+	if challenge.Attempts > recoveryMaxAttempts {
+		c.recordEvent(ctx, request, walletID, recoveries.EventRateLimited, challenge.ChallengeID)
+		return NewApiError("too many attempts, start a new recovery", ErrorTooManyRequests)
+	}
+
+	err = c.verifier.Verify(ctx, challenge.State, response.Response)
+	if err != nil {
+		c.recordEvent(ctx, request, walletID, recoveries.EventVerifyFailed, challenge.ChallengeID)
+		return NewApiError("recovery verification failed", ErrorUnauthorized)
+	}
+
+	err = c.recoveryStore.CompleteChallenge(ctx, challenge.ChallengeID, time.Now().UTC().Format(timestampLayout))
+	if err != nil {
+		return NewApiError("invalid recovery challenge", ErrorUnauthorized)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	c.recordEvent(ctx, request, walletID, recoveries.EventRecovered, challenge.ChallengeID)
+
+	return ApiResponseObject(&RecoveredWallet{
+		WalletID:            wallet.WalletID,
+		PublicKeyBase64:     wallet.PublicKeyBase64,
+		PrivateKeyEncrypted: wallet.PrivateKeyEncrypted,
+	})
+}
+
+// ListRecoveryEvents lets the owner see every recovery attempt on the wallet
+func (c *RecoveryAPI) ListRecoveryEvents(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.walletAPI.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	events, err := c.recoveryStore.ListEvents(ctx, request.TenantID, walletID, "")
+	if err != nil {
+		return NewApiError("error getting recovery events: "+err.Error(), ErrorInternalError)
+	}
+
+	return ApiResponseObject(&recoveries.EventList{
+		Events: events,
+	})
+}
+
+// maskContact hides most of an email address or phone number
+func maskContact(contact string) string {
+	name, domain := contact, ""
+	if i := strings.LastIndex(contact, "@"); i >= 0 {
+		name, domain = contact[:i], contact[i:]
+	}
+	if len(name) <= 2 {
+		return strings.Repeat("*", len(name)) + domain
+	}
+	return name[:1] + strings.Repeat("*", len(name)-2) + name[len(name)-1:] + domain
+}
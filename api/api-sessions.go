@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/citizendata/datawallet/wallet-api/store/sessions"
+	"github.com/google/uuid"
+	"log"
+	"time"
+)
+
+const (
+	challengeTTL = 60 * time.Second
+	sessionTTL   = 15 * time.Minute
+)
+
+// SessionLogin is the body of a login: the challenge signed with the wallet key
+type SessionLogin struct {
+	ChallengeID string `json:"challengeId"`
+
+	// DeviceID of the key that signed the challenge (optional, any active device key is tried)
+	DeviceID string `json:"deviceId"`
+
+	// Signature is base64(PKCS1v15(sha256(challenge)))
+	Signature string `json:"signature"`
+}
+
+type SessionToken struct {
+	SessionID string `json:"sessionId"`
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// sessionClaims are the JWT claims of a session token
+type sessionClaims struct {
+	ID        string `json:"jti"`
+	Subject   string `json:"sub"`
+	TenantID  string `json:"tid"`
+	DeviceID  string `json:"did"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (c *WalletAPI) authorizeSession(ctx context.Context, request *ApiRequest, token string) (string, *ApiResponse) {
+	var claims sessionClaims
+	err := security.ParseToken(token, c.tokenSecret, &claims)
+	if err != nil {
+		return "", NewApiError("invalid session token: "+err.Error(), ErrorUnauthorized)
+	}
+
+	if time.Now().UTC().Unix() > claims.ExpiresAt {
+		return "", NewApiError("session token expired", ErrorUnauthorized)
+	}
+	if claims.TenantID != request.TenantID {
+		return "", NewApiError("session token not valid for tenant", ErrorUnauthorized)
+	}
+	if walletID, ok := request.PathParams["wallet"]; ok && walletID != claims.Subject {
+		return "", NewApiError("session token not valid for wallet "+walletID, ErrorUnauthorized)
+	}
+
+	session, err := c.sessionStore.GetSession(ctx, claims.ID)
+	if err != nil {
+		return "", NewApiError("session not found", ErrorUnauthorized)
+	}
+	if session.Revoked() {
+		return "", NewApiError("session revoked", ErrorUnauthorized)
+	}
+
+	request.Principal = &Principal{
+		WalletID: claims.Subject,
+		DeviceID: claims.DeviceID,
+	}
+	return claims.Subject, nil
+}
+
+// CreateSessionChallenge issues a single-use challenge for the wallet to sign
+func (c *WalletAPI) CreateSessionChallenge(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+
+	_, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	nonce := make([]byte, 32)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return NewApiError("could not create challenge", ErrorInternalError)
+	}
+
+	challenge := &sessions.Challenge{
+		ChallengeID: uuid.New().String(),
+		TenantID:    request.TenantID,
+		WalletID:    walletID,
+		Challenge:   base64.StdEncoding.EncodeToString(nonce),
+		ExpiresAt:   time.Now().UTC().Add(challengeTTL).Unix(),
+	}
+
+	err = c.sessionStore.CreateChallenge(ctx, challenge)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store challenge", ErrorInternalError)
+	}
+
+	return ApiResponseObject(challenge)
+}
+
+// CreateSession exchanges a signed challenge for a short-lived session token
+func (c *WalletAPI) CreateSession(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+
+	var login SessionLogin
+	err := json.Unmarshal([]byte(request.Body), &login)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+
+	challenge, err := c.sessionStore.ConsumeChallenge(ctx, request.TenantID, walletID, login.ChallengeID)
+	if err != nil {
+		return NewApiError("invalid challenge", ErrorUnauthorized)
+	}
+
+	now := time.Now().UTC()
+	if challenge.TenantID != request.TenantID || challenge.WalletID != walletID || now.Unix() > challenge.ExpiresAt {
+		return NewApiError("invalid challenge", ErrorUnauthorized)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	found, authErr := c.checkLockout(ctx, request, walletID)
+	if authErr != nil {
+		return authErr
+	}
+	deviceID, err := verifyDeviceSignature(wallet, login.DeviceID, func(publicKeyBase64 string) error {
+		pubKey, err := security.ParsePublicKey(publicKeyBase64)
+		if err != nil {
+			return err
+		}
+		return security.VerifySignature([]byte(challenge.Challenge), login.Signature, pubKey)
+	})
+	if err != nil {
+		c.recordSignatureFailure(ctx, request, walletID)
+		return NewApiError("invalid signature: "+err.Error(), ErrorUnauthorized)
+	}
+	c.clearLockout(ctx, request, walletID, found, false)
+
+	session := &sessions.Session{
+		SessionID: uuid.New().String(),
+		TenantID:  request.TenantID,
+		WalletID:  walletID,
+		DeviceID:  deviceID,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(sessionTTL).Unix(),
+	}
+
+	token, err := security.SignToken(&sessionClaims{
+		ID:        session.SessionID,
+		Subject:   session.WalletID,
+		TenantID:  session.TenantID,
+		DeviceID:  session.DeviceID,
+		IssuedAt:  session.CreatedAt,
+		ExpiresAt: session.ExpiresAt,
+	}, c.tokenSecret)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not sign session token", ErrorInternalError)
+	}
+
+	err = c.sessionStore.CreateSession(ctx, session)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store session", ErrorInternalError)
+	}
+
+	return ApiResponseObject(&SessionToken{
+		SessionID: session.SessionID,
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
+	})
+}
+
+// RevokeSession revokes one session (or "all" sessions) of the wallet
+func (c *WalletAPI) RevokeSession(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	sessionID, ok := request.PathParams["sessionId"]
+	if !ok {
+		return NewApiError("invalid session ID in path", ErrorValidation)
+	}
+
+	var err error
+	if sessionID == "all" {
+		err = c.sessionStore.RevokeAllSessions(ctx, request.TenantID, walletID)
+	} else {
+		err = c.sessionStore.RevokeSession(ctx, request.TenantID, walletID, sessionID)
+	}
+
+	if errors.Is(err, sessions.ErrNotFound) {
+		return NewApiError("session not found", ErrorValidation)
+	}
+	if err != nil {
+		return NewApiError(fmt.Sprintf("error revoking session: %s", err.Error()), ErrorInternalError)
+	}
+
+	return ApiSuccessMessage("session revoked")
+}
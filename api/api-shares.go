@@ -0,0 +1,290 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+)
+
+const (
+	defaultSharePage = 100
+	maxSharePage     = 1000
+
+	maxShareMessage = 500
+
+	// maxBlockedSenders bounds the block list, it is kept in the wallet's item
+	maxBlockedSenders = 500
+)
+
+// ShareMessage is the optional note to the recipient in the body of a share, next to the data item
+type ShareMessage struct {
+	Message string `json:"message"`
+}
+
+// ListOutgoingShares pages through what the wallet shared, grouped by recipient and reference ID (?next=&limit=)
+func (c *WalletAPI) ListOutgoingShares(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	limit, authErr := pageLimit(request, defaultSharePage, maxSharePage)
+	if authErr != nil {
+		return authErr
+	}
+
+	list, err := c.walletStore.ListOutgoingShares(ctx, request.TenantID, walletID, request.QueryParams["next"], limit)
+	if err != nil {
+		return NewApiError("error getting shares: "+err.Error(), ErrorInternalError)
+	}
+
+	return ApiResponseObject(list)
+}
+
+// listAllOutgoingShares reads every page of the wallet's outgoing shares
+func (c *WalletAPI) listAllOutgoingShares(ctx context.Context, request *ApiRequest, walletID string) ([]*wallets.OutgoingShare, error) {
+	var shares []*wallets.OutgoingShare
+	next := ""
+	for {
+		list, err := c.walletStore.ListOutgoingShares(ctx, request.TenantID, walletID, next, maxSharePage)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, list.Shares...)
+		if list.Next == "" {
+			return shares, nil
+		}
+		next = list.Next
+	}
+}
+
+// shareDetails reads the message of a share, fingerprints the sender's current key and applies the recipient's acceptance,
+// dataRequestID is the data request the share answers (blank for none)
+func (c *WalletAPI) shareDetails(ctx context.Context, request *ApiRequest, walletID, toWalletID, dataRequestID string) (*wallets.ShareDetails, *ApiResponse) {
+	var msg ShareMessage
+	err := json.Unmarshal([]byte(request.Body), &msg)
+	if err != nil {
+		return nil, NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if len(msg.Message) > maxShareMessage {
+		return nil, NewApiError(fmt.Sprintf("message is longer than %d bytes", maxShareMessage), ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return nil, NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	fingerprint, err := wallets.KeyFingerprint(wallet.PublicKeyBase64)
+	if err != nil {
+		return nil, NewApiError("invalid wallet public key", ErrorInternalError)
+	}
+
+	// a blocked sender gets the same error as for a wallet that does not exist
+	recipient, err := c.walletStore.GetWallet(ctx, request.TenantID, toWalletID)
+	if err != nil || recipient.Blocks(walletID) {
+		return nil, NewApiError("cannot share with wallet "+toWalletID, ErrorValidation)
+	}
+
+	details := &wallets.ShareDetails{
+		FromKeyFingerprint: fingerprint,
+		Message:            msg.Message,
+		Status:             recipient.IncomingShareStatus(walletID),
+	}
+
+	// shares answering a data request (see FulfilDataRequest) were asked for by their recipient
+	if dataRequestID != "" {
+		details.RequestID = dataRequestID
+		details.Status = wallets.ShareAccepted
+	}
+	return details, nil
+}
+
+// AcceptShare makes the pending versions of an item shared with the wallet readable
+func (c *WalletAPI) AcceptShare(ctx context.Context, request *ApiRequest) *ApiResponse {
+	return c.setShareStatus(ctx, request, wallets.ShareAccepted)
+}
+
+// RejectShare deletes the payloads of the versions of an item shared with the wallet
+func (c *WalletAPI) RejectShare(ctx context.Context, request *ApiRequest) *ApiResponse {
+	return c.setShareStatus(ctx, request, wallets.ShareRejected)
+}
+
+func (c *WalletAPI) setShareStatus(ctx context.Context, request *ApiRequest, status string) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	fromWalletID, ok := request.PathParams["fromWallet"]
+	if !ok {
+		return NewApiError("invalid fromWalletID in path", ErrorValidation)
+	}
+	refID, ok := request.PathParams["referenceId"]
+	if !ok {
+		return NewApiError("invalid reference ID in path", ErrorValidation)
+	}
+
+	changed, err := c.walletStore.SetShareStatus(ctx, request.TenantID, fromWalletID, walletID, refID, status)
+	if len(changed) > 0 {
+		c.recordAudit(ctx, request, walletID, "share-"+status, fromWalletID+"/"+refID)
+	}
+	if len(changed) > 0 && status == wallets.ShareRejected {
+		// the payloads are gone, the sender gets their usage back
+		releaseErr := c.usageStore.ReleaseVersions(ctx, request.TenantID, fromWalletID, "share/"+walletID+"/"+refID, changed, err == nil)
+		if releaseErr != nil {
+			log.Print(releaseErr.Error())
+		}
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not update share", ErrorInternalError)
+	}
+	if len(changed) == 0 {
+		return NewApiError("no share of "+refID+" from "+fromWalletID+" to "+status, ErrorValidation)
+	}
+
+	return ApiSuccessMessage(fmt.Sprintf("%d version(s) %s", len(changed), status))
+}
+
+// SetShareAcceptance sets whether shares from other wallets wait for acceptance, and the senders accepted on arrival
+func (c *WalletAPI) SetShareAcceptance(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	var acceptance wallets.ShareAcceptance
+	err := json.Unmarshal([]byte(request.Body), &acceptance)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	for _, sender := range acceptance.AutoAccept {
+		if sender == "" {
+			return NewApiError("autoAccept senders must be wallet IDs", ErrorValidation)
+		}
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	wallet.ShareAcceptance = &acceptance
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+
+	return ApiResponseObject(wallet.ShareAcceptance)
+}
+
+// BlockSender refuses further shares from a wallet and hides its earlier shares from the inbox
+func (c *WalletAPI) BlockSender(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightShare)
+	if authErr != nil {
+		return authErr
+	}
+
+	senderID, ok := request.PathParams["sender"]
+	if !ok || senderID == walletID {
+		return NewApiError("invalid sender wallet ID in path", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if wallet.Blocks(senderID) {
+		return ApiSuccessMessage("sender blocked")
+	}
+	if len(wallet.Blocked) >= maxBlockedSenders {
+		return NewApiError(fmt.Sprintf("a wallet can block at most %d senders", maxBlockedSenders), ErrorValidation)
+	}
+	wallet.Blocked = append(wallet.Blocked, &wallets.BlockedSender{
+		WalletID:  senderID,
+		BlockedAt: request.RequestTimeUTC,
+	})
+
+	authErr = c.updateBlocked(ctx, request, wallet)
+	if authErr != nil {
+		return authErr
+	}
+	c.recordAudit(ctx, request, walletID, "sender-blocked", senderID)
+
+	return ApiSuccessMessage("sender blocked")
+}
+
+// UnblockSender accepts shares from a blocked wallet again
+func (c *WalletAPI) UnblockSender(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightShare)
+	if authErr != nil {
+		return authErr
+	}
+
+	senderID, ok := request.PathParams["sender"]
+	if !ok {
+		return NewApiError("invalid sender wallet ID in path", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if !wallet.Blocks(senderID) {
+		return NewApiError("wallet "+senderID+" is not blocked", ErrorValidation)
+	}
+	blocked := wallet.Blocked[:0]
+	for _, b := range wallet.Blocked {
+		if b.WalletID != senderID {
+			blocked = append(blocked, b)
+		}
+	}
+	wallet.Blocked = blocked
+
+	authErr = c.updateBlocked(ctx, request, wallet)
+	if authErr != nil {
+		return authErr
+	}
+	c.recordAudit(ctx, request, walletID, "sender-unblocked", senderID)
+
+	return ApiSuccessMessage("sender unblocked")
+}
+
+// ListBlockedSenders lists the wallets the wallet blocked
+func (c *WalletAPI) ListBlockedSenders(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	blocked := wallet.Blocked
+	if blocked == nil {
+		blocked = []*wallets.BlockedSender{}
+	}
+	return ApiResponseObject(&wallets.BlockList{
+		Blocked: blocked,
+	})
+}
+
+func (c *WalletAPI) updateBlocked(ctx context.Context, request *ApiRequest, wallet *wallets.Wallet) *ApiResponse {
+	err := c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/citizendata/datawallet/wallet-api/store/recoveries"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"github.com/google/uuid"
+	"log"
+	"time"
+)
+
+const (
+	socialRecoveryTTL = 7 * 24 * time.Hour
+)
+
+// GuardianSetup is the body to set the guardians of a wallet, an empty list disables social recovery
+type GuardianSetup struct {
+	Threshold int      `json:"threshold"`
+	Guardians []string `json:"guardians"`
+
+	// RecoveryKeyEncrypted is the recovery private key encrypted with the secret split among the guardians
+	RecoveryKeyEncrypted string `json:"recoveryKeyEncrypted"`
+}
+
+// SocialRecoveryStart is the body to start a social recovery, the request must be signed with PublicKeyBase64
+type SocialRecoveryStart struct {
+	PublicKeyBase64 string `json:"publicKeyBase64"`
+}
+
+// GuardianApprovalBody is a guardian's approval, with its share encrypted to the requester's key
+type GuardianApprovalBody struct {
+	EncryptedShare string `json:"encryptedShare"`
+}
+
+// SocialRecoveryStatus is a social recovery request, shares and the encrypted recovery key are only included once approved
+type SocialRecoveryStatus struct {
+	*recoveries.SocialRequest
+	Approved             bool   `json:"approved"`
+	RecoveryKeyEncrypted string `json:"recoveryKeyEncrypted,omitempty"`
+}
+
+// SetGuardians replaces the guardians of the wallet, signed by the primary key
+func (c *WalletAPI) SetGuardians(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeWallet(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	if request.Principal.DeviceID != wallets.PrimaryDeviceID {
+		return NewApiError("guardians can only be set with the primary key", ErrorForbidden)
+	}
+
+	var setup GuardianSetup
+	err := json.Unmarshal([]byte(request.Body), &setup)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+
+	if len(setup.Guardians) == 0 {
+		wallet.SocialRecovery = nil
+	} else {
+		if wallet.RecoveryPublicKeyBase64 == "" {
+			return NewApiError("social recovery requires a recovery key (recoveryPublicKeyBase64)", ErrorValidation)
+		}
+		if setup.Threshold < 1 || setup.Threshold > len(setup.Guardians) {
+			return NewApiError("threshold must be between 1 and the number of guardians", ErrorValidation)
+		}
+		if setup.RecoveryKeyEncrypted == "" {
+			return NewApiError("recoveryKeyEncrypted is required", ErrorValidation)
+		}
+
+		seen := map[string]bool{}
+		for _, guardianID := range setup.Guardians {
+			if guardianID == walletID || seen[guardianID] {
+				return NewApiError("guardians must be distinct wallets other than the owner", ErrorValidation)
+			}
+			seen[guardianID] = true
+
+			_, err = c.walletStore.GetWallet(ctx, request.TenantID, guardianID)
+			if err != nil {
+				return NewApiError("error getting guardian wallet "+guardianID+": "+err.Error(), ErrorValidation)
+			}
+		}
+
+		wallet.SocialRecovery = &wallets.SocialRecovery{
+			Threshold:            setup.Threshold,
+			Guardians:            setup.Guardians,
+			RecoveryKeyEncrypted: setup.RecoveryKeyEncrypted,
+			UpdatedAt:            request.RequestTimeUTC,
+		}
+	}
+
+	err = c.walletStore.UpdateWallet(ctx, wallet)
+	if err == wallets.ErrVersionConflict {
+		return NewApiError("wallet was modified, retry", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store wallet", ErrorInternalError)
+	}
+
+	return ApiResponseObject(wallet.SocialRecovery)
+}
+
+// StartSocialRecovery opens a recovery request for the wallet's guardians to approve
+func (c *RecoveryAPI) StartSocialRecovery(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+
+	var start SocialRecoveryStart
+	err := json.Unmarshal([]byte(request.Body), &start)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	_, err = security.PemBase64ToPublicKey(start.PublicKeyBase64)
+	if err != nil {
+		return NewApiError("invalid publicKeyBase64: "+err.Error(), ErrorValidation)
+	}
+
+	// proves possession of the key the shares are encrypted to
+	err = request.ValidateSignature(start.PublicKeyBase64)
+	if err != nil {
+		return NewApiError("invalid signature (must be signed with publicKeyBase64): "+err.Error(), ErrorUnauthorized)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if wallet.SocialRecovery == nil {
+		return NewApiError("social recovery is not set up for wallet "+walletID, ErrorValidation)
+	}
+
+	now := time.Now().UTC()
+	events, err := c.recoveryStore.ListEvents(ctx, request.TenantID, walletID, now.Add(-recoveryWindow).Format(timestampLayout))
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not check recovery attempts", ErrorInternalError)
+	}
+	started := 0
+	for _, e := range events {
+		if e.Type == recoveries.EventSocialStarted {
+			started++
+		}
+	}
+	if started >= recoveryMaxChallenges {
+		c.recordEvent(ctx, request, walletID, recoveries.EventRateLimited, "")
+		return NewApiError("too many recovery attempts, try again later", ErrorTooManyRequests)
+	}
+
+	socialRequest := &recoveries.SocialRequest{
+		RequestID:       uuid.New().String(),
+		TenantID:        request.TenantID,
+		WalletID:        walletID,
+		PublicKeyBase64: start.PublicKeyBase64,
+		Threshold:       wallet.SocialRecovery.Threshold,
+		Guardians:       wallet.SocialRecovery.Guardians,
+		CreatedAt:       now.Format(timestampLayout),
+		ExpiresAt:       now.Add(socialRecoveryTTL).Unix(),
+	}
+	err = c.recoveryStore.CreateSocialRequest(ctx, socialRequest)
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store recovery request", ErrorInternalError)
+	}
+	c.recordEvent(ctx, request, walletID, recoveries.EventSocialStarted, socialRequest.RequestID)
+
+	return ApiResponseObject(socialRequest)
+}
+
+// ApproveSocialRecovery records a guardian's approval, signed by the guardian wallet
+func (c *RecoveryAPI) ApproveSocialRecovery(ctx context.Context, request *ApiRequest) *ApiResponse {
+	socialRequest, authErr := c.socialRequest(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	guardianID, deviceID, authErr := c.walletAPI.authorizeActor(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+	if !socialRequest.IsGuardian(guardianID) {
+		return NewApiError("wallet "+guardianID+" is not a guardian of this recovery", ErrorForbidden)
+	}
+
+	var body GuardianApprovalBody
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if err != nil {
+		return NewApiError("could not unmarshal payload", ErrorValidation)
+	}
+	if body.EncryptedShare == "" {
+		return NewApiError("encryptedShare is required", ErrorValidation)
+	}
+
+	err = c.recoveryStore.AddApproval(ctx, socialRequest.RequestID, &recoveries.GuardianApproval{
+		GuardianID:     guardianID,
+		DeviceID:       deviceID,
+		EncryptedShare: body.EncryptedShare,
+		ApprovedAt:     request.RequestTimeUTC,
+	})
+	if err == recoveries.ErrAlreadyApproved {
+		return NewApiError("guardian already approved", ErrorConflict)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return NewApiError("could not store approval", ErrorInternalError)
+	}
+	c.recordEvent(ctx, request, socialRequest.WalletID, recoveries.EventGuardianApproved, socialRequest.RequestID)
+
+	return ApiSuccessMessage("recovery approved")
+}
+
+// GetSocialRecovery returns the request to its requester or a guardian. Once approved, the requester also gets
+// the shares and the encrypted recovery key, to sign a key rotation with the recovery key.
+func (c *RecoveryAPI) GetSocialRecovery(ctx context.Context, request *ApiRequest) *ApiResponse {
+	socialRequest, authErr := c.socialRequest(ctx, request)
+	if authErr != nil {
+		return authErr
+	}
+
+	// guardians read the request to encrypt their share to its key
+	requester := request.ValidateSignature(socialRequest.PublicKeyBase64) == nil
+	if !requester {
+		guardianID, _, authErr := c.walletAPI.authorizeActor(ctx, request)
+		if authErr != nil {
+			return authErr
+		}
+		if !socialRequest.IsGuardian(guardianID) {
+			return NewApiError("wallet "+guardianID+" is not a guardian of this recovery", ErrorForbidden)
+		}
+	}
+
+	status := &SocialRecoveryStatus{
+		SocialRequest: socialRequest,
+		Approved:      socialRequest.Approved(),
+	}
+	if !status.Approved || !requester {
+		approvals := map[string]*recoveries.GuardianApproval{}
+		for id, a := range socialRequest.Approvals {
+			approvals[id] = &recoveries.GuardianApproval{
+				GuardianID: a.GuardianID,
+				DeviceID:   a.DeviceID,
+				ApprovedAt: a.ApprovedAt,
+			}
+		}
+		socialRequest.Approvals = approvals
+		return ApiResponseObject(status)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, socialRequest.WalletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+socialRequest.WalletID+": "+err.Error(), ErrorValidation)
+	}
+	if wallet.SocialRecovery == nil {
+		return NewApiError("social recovery was disabled for wallet "+wallet.WalletID, ErrorForbidden)
+	}
+	status.RecoveryKeyEncrypted = wallet.SocialRecovery.RecoveryKeyEncrypted
+	c.recordEvent(ctx, request, socialRequest.WalletID, recoveries.EventSharesReleased, socialRequest.RequestID)
+
+	return ApiResponseObject(status)
+}
+
+// socialRequest loads the open recovery request in the path
+func (c *RecoveryAPI) socialRequest(ctx context.Context, request *ApiRequest) (*recoveries.SocialRequest, *ApiResponse) {
+	walletID, ok := request.PathParams["wallet"]
+	if !ok {
+		return nil, NewApiError("invalid wallet ID in path", ErrorValidation)
+	}
+	requestID, ok := request.PathParams["requestId"]
+	if !ok {
+		return nil, NewApiError("invalid request ID in path", ErrorValidation)
+	}
+
+	socialRequest, err := c.recoveryStore.GetSocialRequest(ctx, requestID)
+	if err != nil {
+		return nil, NewApiError("unknown recovery request "+requestID, ErrorValidation)
+	}
+	if socialRequest.TenantID != request.TenantID || socialRequest.WalletID != walletID {
+		return nil, NewApiError("unknown recovery request "+requestID, ErrorValidation)
+	}
+	if time.Now().UTC().Unix() > socialRequest.ExpiresAt {
+		return nil, NewApiError("recovery request expired", ErrorForbidden)
+	}
+
+	return socialRequest, nil
+}
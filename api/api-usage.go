@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"github.com/citizendata/datawallet/wallet-api/store/usage"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+)
+
+// WalletUsage is a wallet's storage usage against its quota and the tenant's
+type WalletUsage struct {
+	Wallet *usage.Report `json:"wallet"`
+	Tenant *usage.Report `json:"tenant"`
+}
+
+// GetUsage reports the storage used by the wallet and its tenant against their quotas
+func (c *WalletAPI) GetUsage(ctx context.Context, request *ApiRequest) *ApiResponse {
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
+	if authErr != nil {
+		return authErr
+	}
+
+	walletUsage, err := c.usageStore.GetUsage(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting usage: "+err.Error(), ErrorInternalError)
+	}
+	tenantUsage, err := c.usageStore.GetUsage(ctx, request.TenantID, "")
+	if err != nil {
+		return NewApiError("error getting usage: "+err.Error(), ErrorInternalError)
+	}
+
+	return ApiResponseObject(&WalletUsage{
+		Wallet: &usage.Report{
+			Usage:  walletUsage,
+			Limits: c.quotas.Wallet,
+		},
+		Tenant: &usage.Report{
+			Usage:  tenantUsage,
+			Limits: c.quotas.Tenant,
+		},
+	})
+}
+
+// reserveUsage counts a write of len(request.Body) bytes against the quotas before it is stored, a version
+// written again is not counted twice
+func (c *WalletAPI) reserveUsage(ctx context.Context, request *ApiRequest, walletID, itemKey, versionHash string) (*usage.Usage, *ApiResponse) {
+	reserved, err := c.usageStore.Reserve(ctx, request.TenantID, walletID, itemKey, versionHash, int64(len(request.Body)), c.quotas)
+	if err == usage.ErrQuotaExceeded {
+		return nil, NewApiError("storage quota exceeded", ErrorQuotaExceeded)
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return nil, NewApiError("could not check storage quota", ErrorInternalError)
+	}
+	return reserved, nil
+}
+
+// releaseUsage gives back a reservation after a failed write
+func (c *WalletAPI) releaseUsage(ctx context.Context, request *ApiRequest, walletID, itemKey, versionHash string, reserved *usage.Usage) {
+	err := c.usageStore.Release(ctx, request.TenantID, walletID, itemKey, versionHash, reserved)
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
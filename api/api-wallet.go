@@ -5,23 +5,89 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"github.com/citizendata/datawallet/wallet-api/alerts"
+	"github.com/citizendata/datawallet/wallet-api/ratelimit"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/citizendata/datawallet/wallet-api/store/accesses"
+	"github.com/citizendata/datawallet/wallet-api/store/audit"
+	"github.com/citizendata/datawallet/wallet-api/store/datarequests"
+	"github.com/citizendata/datawallet/wallet-api/store/lockouts"
+	"github.com/citizendata/datawallet/wallet-api/store/operations"
+	"github.com/citizendata/datawallet/wallet-api/store/sessions"
+	"github.com/citizendata/datawallet/wallet-api/store/usage"
 	"github.com/citizendata/datawallet/wallet-api/store/wallets"
 	"log"
 	"strings"
+	"time"
 )
 
+// Principal is the authenticated caller of a request
+type Principal struct {
+	// WalletID is the wallet that signed the request (blank for capability bearers)
+	WalletID string
+	DeviceID string
+}
+
 type WalletAPI struct {
-	walletStore wallets.WalletStore
+	walletStore      wallets.WalletStore
+	sessionStore     sessions.SessionStore
+	operationStore   operations.OperationStore
+	auditStore       audit.AuditStore
+	accessStore      accesses.AccessStore
+	dataRequestStore datarequests.DataRequestStore
+	usageStore       usage.UsageStore
+	quotas           *usage.Quotas
+	limiter          *ratelimit.Limiter
+	lockoutStore     lockouts.LockoutStore
+	alerter          alerts.Alerter
+	tokenSecret      []byte
 }
 
-func NewWalletAPI(store wallets.WalletStore) *WalletAPI {
+// NewWalletAPI creates the API of a tenant, quotas are the tenant's storage quotas and limiter applies its request limits (nil for none).
+// Wallets are locked out after repeated signature failures unless lockoutStore is nil.
+func NewWalletAPI(store wallets.WalletStore, sessionStore sessions.SessionStore, operationStore operations.OperationStore, auditStore audit.AuditStore, accessStore accesses.AccessStore, dataRequestStore datarequests.DataRequestStore, usageStore usage.UsageStore, quotas *usage.Quotas, limiter *ratelimit.Limiter, lockoutStore lockouts.LockoutStore, alerter alerts.Alerter, tokenSecret []byte) *WalletAPI {
 	return &WalletAPI{
-		walletStore: store,
+		walletStore:      store,
+		sessionStore:     sessionStore,
+		operationStore:   operationStore,
+		auditStore:       auditStore,
+		accessStore:      accessStore,
+		dataRequestStore: dataRequestStore,
+		usageStore:       usageStore,
+		quotas:           quotas,
+		limiter:          limiter,
+		lockoutStore:     lockoutStore,
+		alerter:          alerter,
+		tokenSecret:      tokenSecret,
 	}
 }
 
 func (c *WalletAPI) authorizeWallet(ctx context.Context, request *ApiRequest) (string, *ApiResponse) {
+	if limited := c.rateLimit(ctx, request); limited != nil {
+		return "", limited
+	}
+
+	if token := request.BearerToken(); token != "" {
+		return c.authorizeSession(ctx, request, token)
+	}
+
 	walletID, ok := request.PathParams["wallet"]
+	deviceID := request.Header(headerDevice)
+
+	// RFC 9421 signatures identify the wallet (and device) by keyid
+	if request.HasMessageSignature() {
+		keyID, err := request.SignatureKeyID()
+		if err != nil {
+			return "", NewApiError("invalid signature: "+err.Error(), ErrorUnauthorized)
+		}
+		keyWalletID, keyDeviceID := splitKeyID(keyID)
+		if ok && keyWalletID != walletID {
+			return "", NewApiError("signature keyid does not match wallet in path", ErrorUnauthorized)
+		}
+		walletID, deviceID, ok = keyWalletID, keyDeviceID, true
+	}
+
 	if !ok {
 		return "", NewApiError("invalid wallet ID in path", ErrorValidation)
 	}
@@ -31,15 +97,142 @@ func (c *WalletAPI) authorizeWallet(ctx context.Context, request *ApiRequest) (s
 		return "", NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
 	}
 
-	err = request.ValidateSignature(wallet.PublicKeyBase64)
+	found, locked := c.checkLockout(ctx, request, walletID)
+	if locked != nil {
+		return "", locked
+	}
+	deviceID, err = verifyDeviceSignature(wallet, deviceID, func(publicKeyBase64 string) error {
+		return request.ValidateSignature(publicKeyBase64)
+	})
+	if err != nil {
+		c.recordSignatureFailure(ctx, request, walletID)
+		return "", NewApiError("invalid signature: "+err.Error(), ErrorUnauthorized)
+	}
+	c.clearLockout(ctx, request, walletID, found, false)
+
+	request.Principal = &Principal{
+		WalletID: walletID,
+		DeviceID: deviceID,
+	}
+	return walletID, nil
+}
+
+// verifyDeviceSignature checks the signature against the device's key, or any active device if deviceID is blank
+func verifyDeviceSignature(wallet *wallets.Wallet, deviceID string, verify func(publicKeyBase64 string) error) (string, error) {
+	if deviceID != "" {
+		device, ok := wallet.Device(deviceID)
+		if !ok {
+			return "", errors.New("unknown device " + deviceID)
+		}
+		return deviceID, verify(device.PublicKeyBase64)
+	}
+
+	var err error
+	for _, device := range wallet.ActiveDevices() {
+		err = verify(device.PublicKeyBase64)
+		if err == nil {
+			return device.DeviceID, nil
+		}
+	}
+	return "", err
+}
+
+// authorizeActor authenticates a wallet other than the one in the path, identified by the keyid or x-api-actor
+func (c *WalletAPI) authorizeActor(ctx context.Context, request *ApiRequest) (string, string, *ApiResponse) {
+	if limited := c.rateLimit(ctx, request); limited != nil {
+		return "", "", limited
+	}
+
+	actorID := request.Header(headerActor)
+	deviceID := request.Header(headerDevice)
+	if request.HasMessageSignature() {
+		keyID, err := request.SignatureKeyID()
+		if err != nil {
+			return "", "", NewApiError("invalid signature: "+err.Error(), ErrorUnauthorized)
+		}
+		actorID, deviceID = splitKeyID(keyID)
+	}
+	if actorID == "" {
+		return "", "", NewApiError("a signature from the acting wallet is required ("+headerActor+")", ErrorUnauthorized)
+	}
+
+	actor, err := c.walletStore.GetWallet(ctx, request.TenantID, actorID)
+	if err != nil {
+		return "", "", NewApiError("error getting wallet "+actorID+": "+err.Error(), ErrorValidation)
+	}
+
+	found, authErr := c.checkLockout(ctx, request, actorID)
+	if authErr != nil {
+		return "", "", authErr
+	}
+	deviceID, err = verifyDeviceSignature(actor, deviceID, func(publicKeyBase64 string) error {
+		return request.ValidateSignature(publicKeyBase64)
+	})
+	if err != nil {
+		c.recordSignatureFailure(ctx, request, actorID)
+		return "", "", NewApiError("invalid signature: "+err.Error(), ErrorUnauthorized)
+	}
+	c.clearLockout(ctx, request, actorID, found, false)
+
+	return actorID, deviceID, nil
+}
+
+// authorizeRight authorizes the wallet owner, or another wallet holding right on it: an active custodian
+// or a member of an organization wallet. Actions of other wallets are recorded in the audit log.
+func (c *WalletAPI) authorizeRight(ctx context.Context, request *ApiRequest, right string) (string, *ApiResponse) {
+	walletID, ok := request.PathParams["wallet"]
+	actorID := requestActor(request)
+	if !ok || actorID == "" || actorID == walletID || request.BearerToken() != "" {
+		return c.authorizeWallet(ctx, request)
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
 	if err != nil {
-		return "", NewApiError("invalid signature: "+err.Error()+", pub="+wallet.PublicKeyBase64, ErrorUnauthorized)
+		return "", NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	actorID, deviceID, authErr := c.authorizeActor(ctx, request)
+	if authErr != nil {
+		return "", authErr
+	}
+
+	relation := ""
+	if custodian, ok := wallet.Custodian(actorID, time.Now().UTC().Format(timestampLayout)); ok && custodian.HasRight(right) {
+		relation = "custodian"
+	} else if member, ok := wallet.Member(actorID); ok && member.HasRight(right) {
+		relation = "member"
+	}
+	if relation == "" {
+		return "", NewApiError("wallet "+actorID+" has no "+right+" right on wallet "+walletID, ErrorForbidden)
+	}
+
+	request.Principal = &Principal{
+		WalletID: actorID,
+		DeviceID: deviceID,
 	}
+	c.recordAudit(ctx, request, walletID, relation+"-"+right, request.Path)
 	return walletID, nil
 }
 
+// requestActor is the wallet the request claims to act as (keyid or x-api-actor), blank if not given
+func requestActor(request *ApiRequest) string {
+	if request.HasMessageSignature() {
+		keyID, _ := request.SignatureKeyID()
+		actorID, _ := splitKeyID(keyID)
+		return actorID
+	}
+	return request.Header(headerActor)
+}
+
+// splitKeyID splits a keyid of the form walletID or walletID#deviceID
+func splitKeyID(keyID string) (string, string) {
+	if i := strings.Index(keyID, "#"); i >= 0 {
+		return keyID[:i], keyID[i+1:]
+	}
+	return keyID, ""
+}
+
 func (c *WalletAPI) AddData(ctx context.Context, request *ApiRequest) *ApiResponse {
-	walletID, authErr := c.authorizeWallet(ctx, request)
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightAdd)
 	if authErr != nil {
 		return authErr
 	}
@@ -47,34 +240,39 @@ func (c *WalletAPI) AddData(ctx context.Context, request *ApiRequest) *ApiRespon
 	var dataItem wallets.WalletDataItem
 	err := json.Unmarshal([]byte(request.Body), &dataItem)
 	if err != nil {
-		return NewApiError("could not unmarshal payload", ErrorValidation)
+		return c.auditResponse(ctx, request, walletID, AuditAdd, "", "", NewApiError("could not unmarshal payload", ErrorValidation))
 	}
 
 	if dataItem.ReferenceID == "" {
-		return NewApiError("ReferenceID is required", ErrorValidation)
+		return c.auditResponse(ctx, request, walletID, AuditAdd, "", "", NewApiError("ReferenceID is required", ErrorValidation))
 	}
 
 	dataItem.CreatedAt = request.RequestTimeUTC
+	dataItem.DeviceID = request.Principal.DeviceID
+	if request.Principal.WalletID != walletID {
+		dataItem.ActorWalletID = request.Principal.WalletID
+	}
 
 	encrypted := strings.Join(dataItem.EncryptedChunks,"")
 	hash := sha256.Sum256([]byte(encrypted))
 	dataItem.VersionHash = base64.URLEncoding.EncodeToString(hash[:])
 
+	reserved, authErr := c.reserveUsage(ctx, request, walletID, dataItem.ReferenceID, dataItem.VersionHash)
+	if authErr != nil {
+		return c.auditResponse(ctx, request, walletID, AuditAdd, dataItem.ReferenceID, dataItem.VersionHash, authErr)
+	}
+
 	err = c.walletStore.AddDataItem(ctx, request.TenantID, walletID, &dataItem)
 
 	if err != nil {
-		return NewApiError("error saving data: "+err.Error(), ErrorValidation)
+		c.releaseUsage(ctx, request, walletID, dataItem.ReferenceID, dataItem.VersionHash, reserved)
+		return c.auditResponse(ctx, request, walletID, AuditAdd, dataItem.ReferenceID, dataItem.VersionHash, NewApiError("error saving data: "+err.Error(), ErrorValidation))
 	}
 
-	return ApiSuccessMessage("data saved successfully")
+	return c.auditResponse(ctx, request, walletID, AuditAdd, dataItem.ReferenceID, dataItem.VersionHash, ApiSuccessMessage("data saved successfully"))
 }
 
 func (c *WalletAPI) GetData(ctx context.Context, request *ApiRequest) *ApiResponse {
-	walletID, authErr := c.authorizeWallet(ctx, request)
-	if authErr != nil {
-		return authErr
-	}
-
 	refID, ok := request.PathParams["referenceId"]
 	if !ok {
 		return NewApiError("invalid reference ID in path", ErrorValidation)
@@ -85,52 +283,57 @@ func (c *WalletAPI) GetData(ctx context.Context, request *ApiRequest) *ApiRespon
 		return NewApiError("invalid version in path", ErrorValidation)
 	}
 
+	walletID, authErr := c.authorizeRead(ctx, request, CapabilityGetData, refID)
+	if authErr != nil {
+		return authErr
+	}
+
 
 	if version == "latest" {
 		res, err := c.walletStore.GetLatestDataItem(ctx, request.TenantID, walletID, refID)
 		if err != nil {
-			return NewApiError("error getting data: "+err.Error(), ErrorInternalError)
+			return c.auditResponse(ctx, request, walletID, AuditRead, refID, "", NewApiError("error getting data: "+err.Error(), ErrorInternalError))
 		}
-		return ApiResponseObject(res)
+		return c.auditResponse(ctx, request, walletID, AuditRead, refID, res.VersionHash, ApiResponseObject(res))
 	} else {
 		res, err := c.walletStore.GetDataItem(ctx, request.TenantID, walletID, refID, version)
 		if err != nil {
-			return NewApiError("error getting data: "+err.Error(), ErrorInternalError)
+			return c.auditResponse(ctx, request, walletID, AuditRead, refID, version, NewApiError("error getting data: "+err.Error(), ErrorInternalError))
 		}
-		return ApiResponseObject(res)
+		return c.auditResponse(ctx, request, walletID, AuditRead, refID, res.VersionHash, ApiResponseObject(res))
 	}
 }
 
 func (c *WalletAPI) GetDataHistory(ctx context.Context, request *ApiRequest) *ApiResponse {
-	walletID, authErr := c.authorizeWallet(ctx, request)
-	if authErr != nil {
-		return authErr
-	}
-
 	refID, ok := request.PathParams["referenceId"]
 	if !ok {
 		return NewApiError("invalid reference ID in path", ErrorValidation)
 	}
 
+	walletID, authErr := c.authorizeRead(ctx, request, CapabilityGetDataHistory, refID)
+	if authErr != nil {
+		return authErr
+	}
+
 	res, err := c.walletStore.GetDataItemHistory(ctx, request.TenantID, walletID, refID)
 	if err != nil {
-		return NewApiError("error getting data: "+err.Error(), ErrorInternalError)
+		return c.auditResponse(ctx, request, walletID, AuditRead, refID, "", NewApiError("error getting data: "+err.Error(), ErrorInternalError))
 	}
-	return ApiResponseObject(res)
+	return c.auditResponse(ctx, request, walletID, AuditRead, refID, "", ApiResponseObject(res))
 }
 
 func (c *WalletAPI) ListData(ctx context.Context, request *ApiRequest) *ApiResponse {
-	walletID, authErr := c.authorizeWallet(ctx, request)
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
 	if authErr != nil {
 		return authErr
 	}
 
 	walletList, err := c.walletStore.ListData(ctx, request.TenantID, walletID)
 	if err != nil {
-		return NewApiError("error getting list: "+err.Error(), ErrorValidation)
+		return c.auditResponse(ctx, request, walletID, AuditRead, "", "", NewApiError("error getting list: "+err.Error(), ErrorValidation))
 	}
 
-	return ApiResponseObject(walletList)
+	return c.auditResponse(ctx, request, walletID, AuditRead, "", "", ApiResponseObject(walletList))
 }
 
 func (c *WalletAPI) CreateWallet(ctx context.Context, request *ApiRequest) *ApiResponse {
@@ -147,6 +350,22 @@ func (c *WalletAPI) CreateWallet(ctx context.Context, request *ApiRequest) *ApiR
 
 	wallet.TenantID = request.TenantID
 
+	if wallet.RecoveryPublicKeyBase64 != "" {
+		_, err = security.PemBase64ToPublicKey(wallet.RecoveryPublicKeyBase64)
+		if err != nil {
+			return NewApiError("invalid recoveryPublicKeyBase64: "+err.Error(), ErrorValidation)
+		}
+	}
+	wallet.Version = 0
+	wallet.Devices = nil
+	wallet.Custodians = nil
+	wallet.Members = nil
+	wallet.KeyHistory = []*wallets.WalletKey{{
+		PublicKeyBase64:         wallet.PublicKeyBase64,
+		ValidFrom:               request.RequestTimeUTC,
+		RecoveryPublicKeyBase64: wallet.RecoveryPublicKeyBase64,
+	}}
+
 	walletID, err := wallet.CalculateWalletId()
 	if err != nil {
 		log.Print(err.Error())
@@ -154,31 +373,60 @@ func (c *WalletAPI) CreateWallet(ctx context.Context, request *ApiRequest) *ApiR
 	}
 	wallet.WalletID = walletID
 
+	if request.HasMessageSignature() {
+		keyID, err := request.SignatureKeyID()
+		if err != nil || keyID != walletID {
+			return NewApiError("invalid signature: keyid must be the wallet ID "+walletID, ErrorUnauthorized)
+		}
+	}
+
 	err = c.walletStore.CreateWallet(ctx, &wallet)
+	if err == wallets.ErrWalletExists {
+		return NewApiError("wallet "+walletID+" already exists", ErrorConflict)
+	}
 	if err != nil {
 		log.Print(err.Error())
 		return NewApiError("could not store wallet", ErrorInternalError)
 	}
 
-	return ApiResponseObject(wallet)
+	request.Principal = &Principal{
+		WalletID: walletID,
+		DeviceID: wallets.PrimaryDeviceID,
+	}
+	return c.auditResponse(ctx, request, walletID, AuditCreate, walletID, "", ApiResponseObject(wallet))
 }
 
 func (c *WalletAPI) ListMySharedItems(ctx context.Context, request *ApiRequest) *ApiResponse {
-	walletID, authErr := c.authorizeWallet(ctx, request)
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
 	if authErr != nil {
 		return authErr
 	}
 
-	walletList, err := c.walletStore.ListSharedItems(ctx, request.TenantID, walletID)
+	fromWalletID := request.QueryParams["fromWallet"]
+	shareList, err := c.walletStore.ListSharedItems(ctx, request.TenantID, walletID, fromWalletID)
+	if err != nil {
+		return c.auditResponse(ctx, request, walletID, AuditReadShared, fromWalletID, "", NewApiError("error getting list: "+err.Error(), ErrorValidation))
+	}
+
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
 	if err != nil {
-		return NewApiError("error getting list: "+err.Error(), ErrorValidation)
+		return c.auditResponse(ctx, request, walletID, AuditReadShared, fromWalletID, "", NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation))
+	}
+
+	// rejected shares have no payload left, blocked senders are hidden
+	items := shareList.Items[:0]
+	for _, item := range shareList.Items {
+		if item.Status != wallets.ShareRejected && !wallet.Blocks(item.FromWalletID) {
+			items = append(items, item)
+		}
 	}
+	shareList.Items = items
 
-	return ApiResponseObject(walletList)
+	return c.auditResponse(ctx, request, walletID, AuditReadShared, fromWalletID, "", ApiResponseObject(shareList))
 }
 
 func (c *WalletAPI) GetSharedDataItem(ctx context.Context, request *ApiRequest) *ApiResponse {
-	walletID, authErr := c.authorizeWallet(ctx, request)
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightRead)
 	if authErr != nil {
 		return authErr
 	}
@@ -198,19 +446,49 @@ func (c *WalletAPI) GetSharedDataItem(ctx context.Context, request *ApiRequest)
 		return NewApiError("invalid version in path", ErrorValidation)
 	}
 
+	target := fromWalletID + "/" + refID
+	share, err := c.walletStore.GetShare(ctx, request.TenantID, fromWalletID, walletID, refID, version)
+	if errors.Is(err, wallets.ErrShareNotFound) {
+		return c.auditResponse(ctx, request, walletID, AuditReadShared, target, version, NewApiError("share not found", ErrorValidation))
+	}
+	if err != nil {
+		return c.auditResponse(ctx, request, walletID, AuditReadShared, target, version, NewApiError("error getting share: "+err.Error(), ErrorInternalError))
+	}
+	if !share.Accepted() {
+		return c.auditResponse(ctx, request, walletID, AuditReadShared, target, version, NewApiError("share is "+share.Status, ErrorForbidden))
+	}
+
 	res, err := c.walletStore.GetSharedDataItem(ctx, request.TenantID, fromWalletID, walletID, refID, version)
 	if err != nil {
-		return NewApiError("error getting data: "+err.Error(), ErrorInternalError)
+		return c.auditResponse(ctx, request, walletID, AuditReadShared, target, version, NewApiError("error getting data: "+err.Error(), ErrorInternalError))
 	}
-	return ApiResponseObject(res)
+	c.recordAccess(ctx, request, fromWalletID, walletID, refID, res.VersionHash)
+	return c.auditResponse(ctx, request, walletID, AuditReadShared, target, res.VersionHash, ApiResponseObject(res))
 }
 
 func (c *WalletAPI) ShareDataItem(ctx context.Context, request *ApiRequest) *ApiResponse {
-	walletID, authErr := c.authorizeWallet(ctx, request)
+	if limited := c.rateLimitShare(ctx, request, request.PathParams["toWallet"]); limited != nil {
+		return limited
+	}
+
+	walletID, authErr := c.authorizeRight(ctx, request, wallets.RightShare)
 	if authErr != nil {
 		return authErr
 	}
 
+	wallet, err := c.walletStore.GetWallet(ctx, request.TenantID, walletID)
+	if err != nil {
+		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
+	}
+	if queued := c.guardOperation(ctx, request, wallet, OperationShareData); queued != nil {
+		return queued
+	}
+
+	return c.shareDataItem(ctx, request, walletID, "")
+}
+
+// shareDataItem shares the item in the body with the path's toWallet, as the fulfilment of dataRequestID if not blank
+func (c *WalletAPI) shareDataItem(ctx context.Context, request *ApiRequest, walletID, dataRequestID string) *ApiResponse {
 	toWalletID, ok := request.PathParams["toWallet"]
 	if !ok {
 		return NewApiError("invalid toWalletID in path", ErrorValidation)
@@ -219,26 +497,57 @@ func (c *WalletAPI) ShareDataItem(ctx context.Context, request *ApiRequest) *Api
 	var dataItem wallets.WalletDataItem
 	err := json.Unmarshal([]byte(request.Body), &dataItem)
 	if err != nil {
-		return NewApiError("could not unmarshal payload", ErrorValidation)
+		return c.auditResponse(ctx, request, walletID, AuditShare, toWalletID, "", NewApiError("could not unmarshal payload", ErrorValidation))
 	}
 
 	if dataItem.ReferenceID == "" {
-		return NewApiError("ReferenceID is required", ErrorValidation)
+		return c.auditResponse(ctx, request, walletID, AuditShare, toWalletID, "", NewApiError("ReferenceID is required", ErrorValidation))
+	}
+
+	details, authErr := c.shareDetails(ctx, request, walletID, toWalletID, dataRequestID)
+	if authErr != nil {
+		return c.auditResponse(ctx, request, walletID, AuditShare, toWalletID, "", authErr)
+	}
+	if details.RequestID != "" {
+		dataRequest, authErr := c.openDataRequest(ctx, request, walletID, details.RequestID)
+		if authErr != nil {
+			return c.auditResponse(ctx, request, walletID, AuditShare, toWalletID, "", authErr)
+		}
+		if !dataRequest.Requests(dataItem.ReferenceID) {
+			return c.auditResponse(ctx, request, walletID, AuditShare, toWalletID, "", NewApiError("data request "+details.RequestID+" does not ask for "+dataItem.ReferenceID, ErrorValidation))
+		}
 	}
 
 	dataItem.CreatedAt = request.RequestTimeUTC
+	dataItem.DeviceID = request.Principal.DeviceID
+	if request.Principal.WalletID != walletID {
+		dataItem.ActorWalletID = request.Principal.WalletID
+	}
 
 	encrypted := strings.Join(dataItem.EncryptedChunks,"")
 	hash := sha256.Sum256([]byte(encrypted))
 	dataItem.VersionHash = base64.URLEncoding.EncodeToString(hash[:])
 
-	err = c.walletStore.ShareDataItem(ctx, request.TenantID, walletID, toWalletID, &dataItem)
+	itemKey := "share/" + toWalletID + "/" + dataItem.ReferenceID
+	target := toWalletID + "/" + dataItem.ReferenceID
+	reserved, authErr := c.reserveUsage(ctx, request, walletID, itemKey, dataItem.VersionHash)
+	if authErr != nil {
+		return c.auditResponse(ctx, request, walletID, AuditShare, target, dataItem.VersionHash, authErr)
+	}
+
+	err = c.walletStore.ShareDataItem(ctx, request.TenantID, walletID, toWalletID, &dataItem, details)
 
 	if err != nil {
-		return NewApiError("error saving data: "+err.Error(), ErrorValidation)
+		c.releaseUsage(ctx, request, walletID, itemKey, dataItem.VersionHash, reserved)
+		return c.auditResponse(ctx, request, walletID, AuditShare, target, dataItem.VersionHash, NewApiError("error saving data: "+err.Error(), ErrorValidation))
 	}
 
-	return ApiSuccessMessage("data saved successfully")
+	if details.RequestID != "" {
+		if authErr := c.recordFulfilment(ctx, request, walletID, details.RequestID, &dataItem); authErr != nil {
+			return c.auditResponse(ctx, request, walletID, AuditShare, target, dataItem.VersionHash, authErr)
+		}
+	}
+	return c.auditResponse(ctx, request, walletID, AuditShare, target, dataItem.VersionHash, ApiSuccessMessage("data saved successfully"))
 }
 
 func (c *WalletAPI) GetPublicKey(ctx context.Context, request *ApiRequest) *ApiResponse {
@@ -252,5 +561,5 @@ func (c *WalletAPI) GetPublicKey(ctx context.Context, request *ApiRequest) *ApiR
 		return NewApiError("error getting wallet "+walletID+": "+err.Error(), ErrorValidation)
 	}
 
-	return ApiResponseObject(wallet.PublicKeyBase64)
+	return c.auditResponse(ctx, request, walletID, AuditKeyLookup, "", "", ApiResponseObject(wallet.PublicKeyBase64))
 }
\ No newline at end of file
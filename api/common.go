@@ -6,23 +6,47 @@ import (
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/citizendata/datawallet/wallet-api/security"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	timestampLayout = "2006-01-02T15:04:05.000Z"
+
+	headerDevice = "x-api-device"
 )
 
 // ApiRequest is a generic structure for requests
 type ApiRequest struct {
 	RequestTimeUTC string
+	Method         string
 	Path           string
+	TargetPath     string
 	Body           string
 	PathParams     map[string]string
 	QueryParams    map[string]string
+	RawQuery       string
 	Headers        map[string]string
 	TenantID       string
 	Signature      string
+	SourceIP       string
+
+	// Principal is set once the request is authorized
+	Principal *Principal
+
+	// NoShare is set when the tenant's API key has the no-share scope, for routes that may end in a share
+	NoShare bool
+
+	// DataRequestID is set by FulfilDataRequest to the data request its share answers, and kept on queued operations
+	DataRequestID string
+
+	msgSig    *messageSignature
+	msgSigErr error
+
+	// rateLimited is set once the request was counted by the rate limiter
+	rateLimited bool
 }
 
 type ApiResponse struct {
@@ -50,7 +74,39 @@ func (a *ApiRequest) RequestTime() time.Time {
 	return t
 }
 
+// Header returns the value of the named header (case-insensitive)
+func (a *ApiRequest) Header(name string) string {
+	v, _ := a.headerValue(name)
+	return v
+}
+
+func (a *ApiRequest) headerValue(name string) (string, bool) {
+	if v, ok := a.Headers[name]; ok {
+		return v, true
+	}
+	for k, v := range a.Headers {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// BearerToken returns the session token from the Authorization header, if any
+func (a *ApiRequest) BearerToken() string {
+	auth := a.Header("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// ValidateSignature checks the RFC 9421 message signature if present, otherwise x-api-signature
 func (a *ApiRequest) ValidateSignature(publicKeyBase64 string) error {
+	if a.HasMessageSignature() {
+		return a.validateMessageSignature(publicKeyBase64)
+	}
+
 	now := time.Now().UTC()
 	reqTime := a.RequestTime()
 	if reqTime.IsZero() {
@@ -63,7 +119,7 @@ func (a *ApiRequest) ValidateSignature(publicKeyBase64 string) error {
 		return errors.New("bad signature (empty)")
 	}
 
-	pubKey, err := security.PemBase64ToPublicKey(publicKeyBase64)
+	pubKey, err := security.ParsePublicKey(publicKeyBase64)
 	if err != nil {
 		return err
 	}
@@ -75,16 +131,53 @@ func (a *ApiRequest) ValidateSignature(publicKeyBase64 string) error {
 
 func ApiRequestFromLambda(req *events.APIGatewayProxyRequest, tenantID string) *ApiRequest {
 	ts := req.Headers["x-api-timestamp"]
-	return &ApiRequest{
+
+	// path as seen by the client (including stage) for @path
+	targetPath := req.RequestContext.Path
+	if targetPath == "" {
+		targetPath = req.Path
+	}
+
+	apiReq := &ApiRequest{
 		RequestTimeUTC: ts,
+		Method:         req.HTTPMethod,
 		Path:           req.Path,
+		TargetPath:     targetPath,
 		Body:           req.Body,
 		Headers:        req.Headers,
 		PathParams:     req.PathParameters,
 		QueryParams:    req.QueryStringParameters,
+		RawQuery:       rawQuery(req),
 		TenantID:       tenantID,
 		Signature:      req.Headers["x-api-signature"],
+		SourceIP:       req.RequestContext.Identity.SourceIP,
+	}
+
+	if ts == "" && apiReq.HasMessageSignature() {
+		if created, err := apiReq.messageSignatureTime(); err == nil {
+			apiReq.RequestTimeUTC = created.Format(timestampLayout)
+		}
+	}
+
+	// session token requests are not signed, use the time received
+	if ts == "" && apiReq.BearerToken() != "" {
+		apiReq.RequestTimeUTC = time.Now().UTC().Format(timestampLayout)
+	}
+
+	return apiReq
+}
+
+// rawQuery rebuilds the query string for @query. API Gateway only passes the decoded parameters, so
+// every value of a repeated key is kept in the order sent, keys are sorted and values form-encoded.
+func rawQuery(req *events.APIGatewayProxyRequest) string {
+	params := req.MultiValueQueryStringParameters
+	if len(params) == 0 {
+		params = map[string][]string{}
+		for k, v := range req.QueryStringParameters {
+			params[k] = []string{v}
+		}
 	}
+	return url.Values(params).Encode()
 }
 
 func LambdaResponseFromApiResponse(resp *ApiResponse) *events.APIGatewayProxyResponse {
@@ -114,3 +207,17 @@ func ApiResponseObject(v interface{}) *ApiResponse {
 		Body:       string(j),
 	}
 }
+
+// pageLimit reads the limit query parameter of a paged list
+func pageLimit(request *ApiRequest, defaultLimit, maxLimit int) (int, *ApiResponse) {
+	v, ok := request.QueryParams["limit"]
+	if !ok {
+		return defaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return 0, NewApiError("limit must be between 1 and "+strconv.Itoa(maxLimit), ErrorValidation)
+	}
+	return limit, nil
+}
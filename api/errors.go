@@ -5,6 +5,10 @@ import "encoding/json"
 const (
 	ErrorValidation = "VALIDATION"
 	ErrorUnauthorized = "UNAUTHORIZED"
+	ErrorForbidden = "FORBIDDEN"
+	ErrorConflict = "CONFLICT"
+	ErrorTooManyRequests = "TOO_MANY_REQUESTS"
+	ErrorQuotaExceeded = "QUOTA_EXCEEDED"
 	ErrorInternalError = "INTERNAL"
 )
 
@@ -12,6 +16,10 @@ var (
 	statusCodeMap = map[string]int {
 		ErrorValidation: 400,
 		ErrorUnauthorized: 401,
+		ErrorForbidden: 403,
+		ErrorConflict: 409,
+		ErrorTooManyRequests: 429,
+		ErrorQuotaExceeded: 413,
 		ErrorInternalError: 500,
 	}
 )
@@ -0,0 +1,469 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Support for RFC 9421 HTTP Message Signatures (Signature-Input / Signature headers)
+// as an alternative to x-api-timestamp / x-api-signature.
+
+const (
+	headerSignatureInput = "signature-input"
+	headerSignature      = "signature"
+	headerContentDigest  = "content-digest"
+	headerHost           = "host"
+
+	algRSAv15SHA256 = "rsa-v1_5-sha256"
+	algRSAPSSSHA512 = "rsa-pss-sha512"
+
+	messageSignatureMaxAge = 10 * time.Second
+)
+
+type sfParams map[string]string
+
+// sfMember is a parsed structured field (RFC 8941) dictionary member
+type sfMember struct {
+	Value  string
+	Items  []*sfItem
+	Params sfParams
+	IsList bool
+
+	// Raw is the member value as received (used for @signature-params)
+	Raw string
+}
+
+type sfItem struct {
+	Value  string
+	Params sfParams
+	Raw    string
+}
+
+type messageSignature struct {
+	Label      string
+	Components []*sfItem
+	Params     sfParams
+	ParamsRaw  string
+	Signature  []byte
+}
+
+// HasMessageSignature is true if the request carries RFC 9421 signature headers
+func (a *ApiRequest) HasMessageSignature() bool {
+	return a.Header(headerSignatureInput) != ""
+}
+
+// SignatureKeyID returns the keyid parameter of the RFC 9421 signature (the wallet ID)
+func (a *ApiRequest) SignatureKeyID() (string, error) {
+	sig, err := a.messageSignature()
+	if err != nil {
+		return "", err
+	}
+	keyID := sig.Params["keyid"]
+	if keyID == "" {
+		return "", errors.New("signature-input is missing keyid")
+	}
+	return keyID, nil
+}
+
+func (a *ApiRequest) messageSignature() (*messageSignature, error) {
+	if a.msgSig == nil && a.msgSigErr == nil {
+		a.msgSig, a.msgSigErr = parseMessageSignature(a.Header(headerSignatureInput), a.Header(headerSignature))
+	}
+	return a.msgSig, a.msgSigErr
+}
+
+func (a *ApiRequest) messageSignatureTime() (time.Time, error) {
+	sig, err := a.messageSignature()
+	if err != nil {
+		return time.Time{}, err
+	}
+	created, err := strconv.ParseInt(sig.Params["created"], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("signature-input is missing created")
+	}
+	return time.Unix(created, 0).UTC(), nil
+}
+
+func (a *ApiRequest) validateMessageSignature(publicKeyBase64 string) error {
+	sig, err := a.messageSignature()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	created, err := a.messageSignatureTime()
+	if err != nil {
+		return err
+	}
+	if now.Sub(created) > messageSignatureMaxAge {
+		return errors.New(fmt.Sprintf("bad signature (request too late, created=%d, now=%d)", created.Unix(), now.Unix()))
+	}
+	if expires, ok := sig.Params["expires"]; ok {
+		exp, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || now.Unix() > exp {
+			return errors.New("bad signature (expired)")
+		}
+	}
+
+	covered := make(map[string]bool)
+	for _, c := range sig.Components {
+		covered[c.Value] = true
+	}
+	if !covered["@method"] {
+		return errors.New("signature must cover @method")
+	}
+	if !covered["@path"] && !covered["@target-uri"] && !covered["@request-target"] {
+		return errors.New("signature must cover @path or @target-uri")
+	}
+	if a.Body != "" {
+		if !covered[headerContentDigest] {
+			return errors.New("signature must cover content-digest when a body is sent")
+		}
+		err = a.validateContentDigest()
+		if err != nil {
+			return err
+		}
+	}
+
+	base, err := a.signatureBase(sig)
+	if err != nil {
+		return err
+	}
+
+	pubKey, err := security.ParsePublicKey(publicKeyBase64)
+	if err != nil {
+		return err
+	}
+
+	switch sig.Params["alg"] {
+	case "", algRSAv15SHA256:
+		return security.VerifySignaturePKCS1v15([]byte(base), sig.Signature, pubKey)
+	case algRSAPSSSHA512:
+		return security.VerifySignaturePSS([]byte(base), sig.Signature, pubKey)
+	default:
+		return errors.New("unsupported signature alg " + sig.Params["alg"])
+	}
+}
+
+func (a *ApiRequest) validateContentDigest() error {
+	digests, _, err := parseDictionary(a.Header(headerContentDigest))
+	if err != nil {
+		return errors.New("invalid content-digest: " + err.Error())
+	}
+
+	var expected []byte
+	var received string
+	if d, ok := digests["sha-256"]; ok {
+		h := sha256.Sum256([]byte(a.Body))
+		expected, received = h[:], d.Value
+	} else if d, ok := digests["sha-512"]; ok {
+		h := sha512.Sum512([]byte(a.Body))
+		expected, received = h[:], d.Value
+	} else {
+		return errors.New("content-digest must use sha-256 or sha-512")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(received)
+	if err != nil || subtle.ConstantTimeCompare(b, expected) != 1 {
+		return errors.New("content-digest does not match body")
+	}
+	return nil
+}
+
+// signatureBase builds the signature base (RFC 9421 section 2.5) for the covered components
+func (a *ApiRequest) signatureBase(sig *messageSignature) (string, error) {
+	var sb strings.Builder
+	for _, c := range sig.Components {
+		value, err := a.componentValue(c)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(c.Raw)
+		sb.WriteString(": ")
+		sb.WriteString(value)
+		sb.WriteString("\n")
+	}
+	sb.WriteString(`"@signature-params": `)
+	sb.WriteString(sig.ParamsRaw)
+	return sb.String(), nil
+}
+
+func (a *ApiRequest) componentValue(c *sfItem) (string, error) {
+	if len(c.Params) > 0 {
+		return "", errors.New("unsupported component parameters on " + c.Raw)
+	}
+
+	query := ""
+	if a.RawQuery != "" {
+		query = "?" + a.RawQuery
+	}
+
+	switch c.Value {
+	case "@method":
+		return strings.ToUpper(a.Method), nil
+	case "@authority":
+		return strings.ToLower(a.Header(headerHost)), nil
+	case "@scheme":
+		return "https", nil
+	case "@path":
+		return a.TargetPath, nil
+	case "@query":
+		if query == "" {
+			return "?", nil
+		}
+		return query, nil
+	case "@request-target":
+		return a.TargetPath + query, nil
+	case "@target-uri":
+		return "https://" + strings.ToLower(a.Header(headerHost)) + a.TargetPath + query, nil
+	}
+
+	if strings.HasPrefix(c.Value, "@") {
+		return "", errors.New("unsupported derived component " + c.Value)
+	}
+
+	value, ok := a.headerValue(c.Value)
+	if !ok {
+		return "", errors.New("covered header missing from request: " + c.Value)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+func parseMessageSignature(signatureInput, signature string) (*messageSignature, error) {
+	if signatureInput == "" || signature == "" {
+		return nil, errors.New("bad signature (missing signature-input or signature)")
+	}
+
+	inputs, labels, err := parseDictionary(signatureInput)
+	if err != nil {
+		return nil, errors.New("invalid signature-input: " + err.Error())
+	}
+	sigs, _, err := parseDictionary(signature)
+	if err != nil {
+		return nil, errors.New("invalid signature: " + err.Error())
+	}
+
+	for _, label := range labels {
+		input := inputs[label]
+		sig, ok := sigs[label]
+		if !ok {
+			continue
+		}
+		if !input.IsList {
+			return nil, errors.New("signature-input " + label + " is not an inner list")
+		}
+		sigBytes, err := base64.StdEncoding.DecodeString(sig.Value)
+		if err != nil {
+			return nil, errors.New("signature not base64: " + err.Error())
+		}
+		return &messageSignature{
+			Label:      label,
+			Components: input.Items,
+			Params:     input.Params,
+			ParamsRaw:  input.Raw,
+			Signature:  sigBytes,
+		}, nil
+	}
+
+	return nil, errors.New("no signature matches signature-input")
+}
+
+// parseDictionary parses the subset of RFC 8941 dictionaries used by message signatures
+func parseDictionary(s string) (map[string]*sfMember, []string, error) {
+	p := &sfParser{s: s}
+	members := make(map[string]*sfMember)
+	var keys []string
+
+	p.skipOWS()
+	for !p.done() {
+		key, err := p.key()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m := &sfMember{Value: "?1"}
+		start := p.i
+		if p.peek() == '=' {
+			p.i++
+			start = p.i
+			if p.peek() == '(' {
+				m.IsList = true
+				m.Items, err = p.innerList()
+			} else {
+				m.Value, err = p.bareItem()
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		m.Params, err = p.params()
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Raw = p.s[start:p.i]
+
+		if _, ok := members[key]; !ok {
+			keys = append(keys, key)
+		}
+		members[key] = m
+
+		p.skipOWS()
+		if p.done() {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, nil, errors.New("expected ',' in dictionary")
+		}
+		p.i++
+		p.skipOWS()
+		if p.done() {
+			return nil, nil, errors.New("trailing ',' in dictionary")
+		}
+	}
+
+	return members, keys, nil
+}
+
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *sfParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sfParser) skipOWS() {
+	for !p.done() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *sfParser) key() (string, error) {
+	start := p.i
+	c := p.peek()
+	if !(c >= 'a' && c <= 'z') && c != '*' {
+		return "", errors.New("invalid key")
+	}
+	for !p.done() {
+		c = p.peek()
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || strings.IndexByte("_-.*", c) >= 0 {
+			p.i++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.i], nil
+}
+
+func (p *sfParser) innerList() ([]*sfItem, error) {
+	p.i++ // (
+	var items []*sfItem
+	for {
+		for p.peek() == ' ' {
+			p.i++
+		}
+		if p.done() {
+			return nil, errors.New("unterminated inner list")
+		}
+		if p.peek() == ')' {
+			p.i++
+			return items, nil
+		}
+
+		start := p.i
+		value, err := p.bareItem()
+		if err != nil {
+			return nil, err
+		}
+		params, err := p.params()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, &sfItem{Value: value, Params: params, Raw: p.s[start:p.i]})
+
+		if c := p.peek(); c != ' ' && c != ')' {
+			return nil, errors.New("expected ' ' or ')' in inner list")
+		}
+	}
+}
+
+func (p *sfParser) params() (sfParams, error) {
+	params := make(sfParams)
+	for p.peek() == ';' {
+		p.i++
+		p.skipOWS()
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		value := "?1"
+		if p.peek() == '=' {
+			p.i++
+			value, err = p.bareItem()
+			if err != nil {
+				return nil, err
+			}
+		}
+		params[key] = value
+	}
+	return params, nil
+}
+
+// bareItem returns strings unquoted, byte sequences as their base64 content and everything else verbatim
+func (p *sfParser) bareItem() (string, error) {
+	c := p.peek()
+	switch {
+	case c == '"':
+		p.i++
+		var sb strings.Builder
+		for !p.done() {
+			c = p.s[p.i]
+			p.i++
+			switch c {
+			case '\\':
+				if p.done() {
+					return "", errors.New("unterminated string")
+				}
+				sb.WriteByte(p.s[p.i])
+				p.i++
+			case '"':
+				return sb.String(), nil
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return "", errors.New("unterminated string")
+	case c == ':':
+		end := strings.IndexByte(p.s[p.i+1:], ':')
+		if end < 0 {
+			return "", errors.New("unterminated byte sequence")
+		}
+		value := p.s[p.i+1 : p.i+1+end]
+		p.i += end + 2
+		return value, nil
+	case c == '?' || c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '*':
+		start := p.i
+		p.i++
+		for !p.done() && strings.IndexByte(" \t,;()=", p.s[p.i]) < 0 {
+			p.i++
+		}
+		return p.s[start:p.i], nil
+	}
+	return "", errors.New("invalid item")
+}
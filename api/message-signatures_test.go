@@ -0,0 +1,144 @@
+package api
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseDictionary(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		keys    []string
+		value   string
+		items   []string
+		params  sfParams
+		raw     string
+		wantErr bool
+	}{
+		{
+			name:   "signature input",
+			input:  `sig1=("@method" "@path" "content-digest");created=1618884473;keyid="wallet#device"`,
+			keys:   []string{"sig1"},
+			items:  []string{"@method", "@path", "content-digest"},
+			params: sfParams{"created": "1618884473", "keyid": "wallet#device"},
+			raw:    `("@method" "@path" "content-digest");created=1618884473;keyid="wallet#device"`,
+		},
+		{
+			name:   "byte sequence",
+			input:  `sig1=:YWJj:`,
+			keys:   []string{"sig1"},
+			value:  "YWJj",
+			params: sfParams{},
+			raw:    `:YWJj:`,
+		},
+		{
+			name:   "several members",
+			input:  `sig1=:YWJj:,  sig2=:ZGVm:`,
+			keys:   []string{"sig1", "sig2"},
+			value:  "YWJj",
+			params: sfParams{},
+			raw:    `:YWJj:`,
+		},
+		{
+			name:   "boolean member",
+			input:  `flag;a=1`,
+			keys:   []string{"flag"},
+			value:  "?1",
+			params: sfParams{"a": "1"},
+			raw:    `;a=1`,
+		},
+		{
+			name:   "repeated key keeps the last value",
+			input:  `a=1, a=2`,
+			keys:   []string{"a"},
+			value:  "2",
+			params: sfParams{},
+			raw:    `2`,
+		},
+		{
+			name:   "escaped string",
+			input:  `a="say \"hi\""`,
+			keys:   []string{"a"},
+			value:  `say "hi"`,
+			params: sfParams{},
+			raw:    `"say \"hi\""`,
+		},
+		{name: "trailing comma", input: `sig1=:YWJj:,`, wantErr: true},
+		{name: "missing comma", input: `a=1 b=2`, wantErr: true},
+		{name: "uppercase key", input: `Sig1=:YWJj:`, wantErr: true},
+		{name: "unterminated inner list", input: `sig1=("@method"`, wantErr: true},
+		{name: "unterminated string", input: `sig1=("@method)`, wantErr: true},
+		{name: "unterminated byte sequence", input: `sig1=:YWJj`, wantErr: true},
+		{name: "items not separated", input: `sig1=("@method""@path")`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, keys, err := parseDictionary(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.keys, keys)
+
+			m := members[tt.keys[0]]
+			if assert.NotNil(t, m) {
+				assert.Equal(t, tt.items != nil, m.IsList)
+				var items []string
+				for _, item := range m.Items {
+					items = append(items, item.Value)
+				}
+				assert.Equal(t, tt.items, items)
+				if !m.IsList {
+					assert.Equal(t, tt.value, m.Value)
+				}
+				assert.Equal(t, tt.params, m.Params)
+				assert.Equal(t, tt.raw, m.Raw)
+			}
+		})
+	}
+}
+
+func TestQueryComponents(t *testing.T) {
+	tests := []struct {
+		name   string
+		single map[string]string
+		multi  map[string][]string
+		query  string
+	}{
+		{"no query", nil, nil, "?"},
+		{"single values", map[string]string{"limit": "10", "next": "a/b"}, nil, "?limit=10&next=a%2Fb"},
+		{
+			name:   "repeated values kept in order",
+			single: map[string]string{"ref": "2", "a": "x y"},
+			multi:  map[string][]string{"ref": {"3", "1", "2"}, "a": {"x y"}},
+			query:  "?a=x+y&ref=3&ref=1&ref=2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := ApiRequestFromLambda(&events.APIGatewayProxyRequest{
+				HTTPMethod:                      "GET",
+				Path:                            "/wallet/w",
+				Headers:                         map[string]string{"Host": "api.example.com"},
+				QueryStringParameters:           tt.single,
+				MultiValueQueryStringParameters: tt.multi,
+			}, "tenant")
+
+			query, err := request.componentValue(&sfItem{Value: "@query"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.query, query)
+
+			if tt.query == "?" {
+				tt.query = ""
+			}
+			target, err := request.componentValue(&sfItem{Value: "@request-target"})
+			assert.NoError(t, err)
+			assert.Equal(t, "/wallet/w"+tt.query, target)
+		})
+	}
+}
@@ -14,10 +14,9 @@ type Response events.APIGatewayProxyResponse
 // Handler is our lambda handler invoked by the `lambda.Start` function call
 func Handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error){
 	ctx := context.Background()
-	walletAPI, req, err := lambdas.InitWalletAPI(ctx, request)
+	walletAPI, req, err := lambdas.InitWalletAPI(ctx, request, lambdas.AccessRead)
 	if err != nil {
-		resp := api.NewApiError(err.Error(), api.ErrorValidation)
-		return *api.LambdaResponseFromApiResponse(resp), nil
+		return *api.LambdaResponseFromApiResponse(lambdas.ErrorResponse(err)), nil
 	}
 
 	apiResp := walletAPI.GetDataHistory(ctx, req)
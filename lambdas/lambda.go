@@ -2,29 +2,238 @@ package lambdas
 
 import (
 	"context"
+	"errors"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/apigateway"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/citizendata/datawallet/wallet-api/alerts"
 	"github.com/citizendata/datawallet/wallet-api/api"
+	"github.com/citizendata/datawallet/wallet-api/ratelimit"
+	"github.com/citizendata/datawallet/wallet-api/recovery"
+	"github.com/citizendata/datawallet/wallet-api/store/accesses"
+	"github.com/citizendata/datawallet/wallet-api/store/audit"
+	"github.com/citizendata/datawallet/wallet-api/store/datarequests"
+	"github.com/citizendata/datawallet/wallet-api/store/lockouts"
+	"github.com/citizendata/datawallet/wallet-api/store/operations"
+	"github.com/citizendata/datawallet/wallet-api/store/recoveries"
+	"github.com/citizendata/datawallet/wallet-api/store/sessions"
 	"github.com/citizendata/datawallet/wallet-api/store/tenants"
+	"github.com/citizendata/datawallet/wallet-api/store/usage"
 	"github.com/citizendata/datawallet/wallet-api/store/wallets"
+	"log"
+	"os"
+	"time"
 )
 
-func InitWalletAPI(ctx context.Context, request events.APIGatewayProxyRequest) (*api.WalletAPI, *api.ApiRequest, error) {
+const (
+	// access a lambda needs from the tenant's API key
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessShare = "share"
+	AccessAdmin = "admin"
+)
+
+var (
+	ErrKeyScope = errors.New("api key scope does not allow this request")
+
+	// ErrNotConfigured is returned by the Init functions when a secret is missing from the environment
+	ErrNotConfigured = errors.New("lambda is not configured")
+)
+
+// caches kept across warm invocations, changes made by other functions are seen once an entry's TTL has passed
+var (
+	tenantCache = tenants.NewTenantCache(30 * time.Second)
+	walletCache = wallets.NewWalletCache(10 * time.Second)
+
+	memoryBuckets = ratelimit.NewMemoryBuckets()
+)
+
+var (
+	// apiKeyPepper keys the hashes of stored API keys, a blank pepper would make them plain SHA-256
+	apiKeyPepper = []byte(os.Getenv("API_KEY_PEPPER"))
+
+	// auditLogKey authenticates audit log events, without it they could be rewritten by anyone with table access
+	auditLogKey = []byte(os.Getenv("AUDIT_LOG_KEY"))
+
+	// allowLocalVerifier lets tenants use the local recovery verifier, which logs codes (development stages only)
+	allowLocalVerifier = os.Getenv("RECOVERY_LOCAL_VERIFIER") == "enabled"
+)
+
+// checkConfig returns ErrNotConfigured unless the secrets every lambda needs are set
+func checkConfig() error {
+	if len(apiKeyPepper) == 0 {
+		log.Print("API_KEY_PEPPER is not set")
+		return ErrNotConfigured
+	}
+	if len(auditLogKey) == 0 {
+		log.Print("AUDIT_LOG_KEY is not set")
+		return ErrNotConfigured
+	}
+	return nil
+}
+
+// rateLimitBuckets are the rate limit buckets set by RATE_LIMIT_STORE: "dynamo" (shared by all instances, the
+// default) or "memory" (per instance, for local runs)
+func rateLimitBuckets(svc *dynamodb.DynamoDB) ratelimit.BucketStore {
+	if os.Getenv("RATE_LIMIT_STORE") == "memory" {
+		return memoryBuckets
+	}
+	return ratelimit.NewDynamoBuckets(svc)
+}
+
+// ErrorResponse maps an error of the Init functions to an API error
+func ErrorResponse(err error) *api.ApiResponse {
+	switch err {
+	case tenants.ErrTenantNotFound, tenants.ErrKeyRevoked, tenants.ErrKeyExpired, tenants.ErrKeyTooShort:
+		return api.NewApiError("invalid api key: "+err.Error(), api.ErrorUnauthorized)
+	case tenants.ErrTenantSuspended, ErrKeyScope, recovery.ErrLocalVerifierDisabled, recovery.ErrUnknownVerifier:
+		return api.NewApiError(err.Error(), api.ErrorForbidden)
+	case ErrNotConfigured:
+		return api.NewApiError(err.Error(), api.ErrorInternalError)
+	}
+	log.Print(err.Error())
+	return api.NewApiError("could not initialize request", api.ErrorInternalError)
+}
+
+// tenantKey finds the request's API key and checks its tenant is active and its scopes allow the access
+func tenantKey(ctx context.Context, tenantStore tenants.TenantStore, apikey, access string) (*tenants.ApiKey, error) {
+	key, err := tenantStore.LookupApiKey(ctx, apikey)
+	if err == tenants.ErrKeyRevoked && key != nil {
+		disableGatewayKey(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := key.CheckTenant(); err != nil {
+		return nil, err
+	}
+	if access == AccessAdmin {
+		if !key.HasScope(tenants.ScopeAdmin) {
+			return nil, ErrKeyScope
+		}
+		return key, nil
+	}
+	if key.HasScope(tenants.ScopeReadOnly) && access != AccessRead {
+		return nil, ErrKeyScope
+	}
+	if key.HasScope(tenants.ScopeNoShare) && access == AccessShare {
+		return nil, ErrKeyScope
+	}
+	return key, nil
+}
+
+// disableGatewayKey disables a revoked key in the gateway: a key rotated with a grace period stays enabled
+// there until the first request after the grace period ended
+func disableGatewayKey(ctx context.Context, key *tenants.ApiKey) {
+	if key.GatewayKeyID == "" {
+		return
+	}
+	gatewayKeys := tenants.NewAWSGatewayKeys(apigateway.New(session.Must(session.NewSession())), os.Getenv("USAGE_PLAN_ID"))
+	err := gatewayKeys.Disable(ctx, key.GatewayKeyID)
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
+
+func InitWalletAPI(ctx context.Context, request events.APIGatewayProxyRequest, access string) (*api.WalletAPI, *api.ApiRequest, error) {
+	if err := checkConfig(); err != nil {
+		return nil, nil, err
+	}
+
 	sess := session.Must(session.NewSession())
 	svc := dynamodb.New(sess)
 	s3Svc := s3.New(sess)
 
-	walletStore := wallets.NewAWSWalletStore(svc, s3Svc)
-	tenantStore := tenants.NewDynamoTenantStore(svc)
+	walletStore := wallets.NewCachedWalletStore(wallets.NewAWSWalletStore(svc, s3Svc), walletCache)
+	tenantStore := tenants.NewCachedTenantStore(tenants.NewDynamoTenantStore(svc, apiKeyPepper), tenantCache)
+	sessionStore := sessions.NewDynamoSessionStore(svc)
+	operationStore := operations.NewDynamoOperationStore(svc)
+	auditStore := audit.NewDynamoAuditStore(svc, auditLogKey)
+	accessStore := accesses.NewDynamoAccessStore(svc)
+	dataRequestStore := datarequests.NewDynamoDataRequestStore(svc)
+	usageStore := usage.NewDynamoUsageStore(svc)
+	lockoutStore := lockouts.NewDynamoLockoutStore(svc)
+
+	key, err := tenantKey(ctx, tenantStore, request.RequestContext.Identity.APIKey, access)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := api.ApiRequestFromLambda(&request, key.TenantId)
+	req.NoShare = key.HasScope(tenants.ScopeNoShare)
+
+	tokenSecret := []byte(os.Getenv("SESSION_TOKEN_SECRET"))
 
-	tenantID, err := tenantStore.GetTenantId(ctx, request.RequestContext.Identity.APIKey)
-	req := api.ApiRequestFromLambda(&request, tenantID)
+	limiter := ratelimit.NewLimiter(rateLimitBuckets(svc), key.RateLimits())
+
+	return api.NewWalletAPI(walletStore, sessionStore, operationStore, auditStore, accessStore, dataRequestStore, usageStore, key.Quotas(), limiter, lockoutStore, alerts.NewLogAlerter(), tokenSecret), req, err
+}
+
+func InitRecoveryAPI(ctx context.Context, request events.APIGatewayProxyRequest, access string) (*api.RecoveryAPI, *api.ApiRequest, error) {
+	if err := checkConfig(); err != nil {
+		return nil, nil, err
+	}
+
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	s3Svc := s3.New(sess)
 
+	walletStore := wallets.NewCachedWalletStore(wallets.NewAWSWalletStore(svc, s3Svc), walletCache)
+	tenantStore := tenants.NewCachedTenantStore(tenants.NewDynamoTenantStore(svc, apiKeyPepper), tenantCache)
+	sessionStore := sessions.NewDynamoSessionStore(svc)
+	operationStore := operations.NewDynamoOperationStore(svc)
+	auditStore := audit.NewDynamoAuditStore(svc, auditLogKey)
+	accessStore := accesses.NewDynamoAccessStore(svc)
+	dataRequestStore := datarequests.NewDynamoDataRequestStore(svc)
+	usageStore := usage.NewDynamoUsageStore(svc)
+	lockoutStore := lockouts.NewDynamoLockoutStore(svc)
+	recoveryStore := recoveries.NewDynamoRecoveryStore(svc)
+
+	key, err := tenantKey(ctx, tenantStore, request.RequestContext.Identity.APIKey, access)
 	if err != nil {
 		return nil, nil, err
 	}
+	req := api.ApiRequestFromLambda(&request, key.TenantId)
+	req.NoShare = key.HasScope(tenants.ScopeNoShare)
+
+	var verifier recovery.Verifier
+	if key.RecoveryVerifier != "" {
+		verifier, err = recovery.NewVerifier(key.RecoveryVerifier, []byte(os.Getenv("RECOVERY_SECRET")), allowLocalVerifier)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tokenSecret := []byte(os.Getenv("SESSION_TOKEN_SECRET"))
+	limiter := ratelimit.NewLimiter(rateLimitBuckets(svc), key.RateLimits())
+	walletAPI := api.NewWalletAPI(walletStore, sessionStore, operationStore, auditStore, accessStore, dataRequestStore, usageStore, key.Quotas(), limiter, lockoutStore, alerts.NewLogAlerter(), tokenSecret)
+
+	return api.NewRecoveryAPI(walletAPI, walletStore, recoveryStore, key.RecoveryVerifier, verifier), req, nil
+}
+
+// InitAdminAPI prepares admin requests, signed with the admin key or sent with a tenant API key with the admin scope
+func InitAdminAPI(ctx context.Context, request events.APIGatewayProxyRequest) (*api.AdminAPI, *api.ApiRequest, error) {
+	if err := checkConfig(); err != nil {
+		return nil, nil, err
+	}
+
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+
+	tenantStore := tenants.NewCachedTenantStore(tenants.NewDynamoTenantStore(svc, apiKeyPepper), tenantCache)
+	gatewayKeys := tenants.NewAWSGatewayKeys(apigateway.New(sess), os.Getenv("USAGE_PLAN_ID"))
+
+	req := api.ApiRequestFromLambda(&request, "")
+
+	// admin routes are not behind the gateway's key check, the key is verified here
+	if apikey := req.Header("x-api-key"); apikey != "" {
+		key, err := tenantKey(ctx, tenantStore, apikey, AccessAdmin)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.TenantID = key.TenantId
+	}
 
-	return api.NewWalletAPI(walletStore), req, err
-}
\ No newline at end of file
+	return api.NewAdminAPI(tenantStore, gatewayKeys, usage.NewDynamoUsageStore(svc), os.Getenv("ADMIN_PUBLIC_KEY"), allowLocalVerifier), req, nil
+}
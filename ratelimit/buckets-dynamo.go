@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"time"
+)
+
+const (
+	bucketTable = "wallet-rate-limits"
+
+	// maxAttempts bounds the retries of a bucket changed concurrently by another request
+	maxAttempts = 5
+)
+
+var (
+	errConflict   = errors.New("rate limit bucket changed")
+	errContention = errors.New("rate limit bucket changed concurrently too many times")
+)
+
+// DynamoBuckets keeps buckets in DynamoDB, shared by every lambda instance. A bucket stores its tokens and when
+// they were last counted (updatedAt): it is read, refilled and taken from like MemoryBuckets, then written back on
+// the condition that updatedAt did not change, retrying otherwise. Idle buckets expire (TTL attribute expiresAt)
+// once they would be full again.
+type DynamoBuckets struct {
+	db *dynamodb.DynamoDB
+}
+
+// dynamoBucket is a bucket as stored
+type dynamoBucket struct {
+	BucketKey string `json:"bucketKey"`
+	bucket
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+func NewDynamoBuckets(db *dynamodb.DynamoDB) *DynamoBuckets {
+	return &DynamoBuckets{
+		db: db,
+	}
+}
+
+func (d *DynamoBuckets) Take(ctx context.Context, key string, limit *Limit, now time.Time) (time.Duration, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		b, err := d.getBucket(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		prev := b.UpdatedAt
+		wait := b.take(limit, countAt(prev, now))
+		if wait > 0 {
+			// nothing taken, the refill is counted again from the stored updatedAt next time
+			return wait, nil
+		}
+
+		err = d.putBucket(ctx, b, prev, now.Add(idleTime(limit)))
+		if err != errConflict {
+			return 0, err
+		}
+	}
+	return 0, errContention
+}
+
+func (d *DynamoBuckets) Refund(ctx context.Context, key string, limit *Limit, now time.Time) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		b, err := d.getBucket(ctx, key)
+		if err != nil {
+			return err
+		}
+		if b.UpdatedAt == 0 {
+			// the bucket expired, it is full
+			return nil
+		}
+
+		prev := b.UpdatedAt
+		b.refill(limit, countAt(prev, now))
+		b.refund(limit)
+		err = d.putBucket(ctx, b, prev, now.Add(idleTime(limit)))
+		if err != errConflict {
+			return err
+		}
+	}
+	return errContention
+}
+
+func (d *DynamoBuckets) getBucket(ctx context.Context, key string) (*dynamoBucket, error) {
+	res, err := d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(bucketTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"bucketKey": {
+				S: aws.String(key),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &dynamoBucket{BucketKey: key}
+	if res.Item == nil {
+		return b, nil
+	}
+	err = dynamodbattribute.UnmarshalMap(res.Item, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// putBucket stores the bucket if its updatedAt is still prev (or it does not exist when prev is 0), otherwise it
+// returns errConflict
+func (d *DynamoBuckets) putBucket(ctx context.Context, b *dynamoBucket, prev int64, idleAt time.Time) error {
+	b.ExpiresAt = idleAt.Unix() + 1
+	item, err := dynamodbattribute.MarshalMap(b)
+	if err != nil {
+		return err
+	}
+
+	cond := expression.Name("bucketKey").AttributeNotExists()
+	if prev != 0 {
+		cond = expression.Name("updatedAt").Equal(expression.Value(prev))
+	}
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(bucketTable),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errConflict
+	}
+	return err
+}
+
+// countAt is when a bucket last counted at prev is counted again: now, or just after prev if now is not later, so
+// that every write changes updatedAt and concurrent writes of the same read conflict
+func countAt(prev int64, now time.Time) time.Time {
+	if prev != 0 && now.UnixNano() <= prev {
+		return time.Unix(0, prev+1)
+	}
+	return now
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryBuckets keeps buckets in the process, each lambda instance then has its own so limits multiply with
+// concurrency. It is meant for tests and local runs. It is safe for concurrent use.
+type MemoryBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	bucket
+	idleAt time.Time
+}
+
+func NewMemoryBuckets() *MemoryBuckets {
+	return &MemoryBuckets{
+		buckets: map[string]*memoryBucket{},
+	}
+}
+
+func (m *MemoryBuckets) Take(ctx context.Context, key string, limit *Limit, now time.Time) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		// forget full buckets when adding one, so the map does not grow with every wallet seen
+		for k, idle := range m.buckets {
+			if now.After(idle.idleAt) {
+				delete(m.buckets, k)
+			}
+		}
+		b = &memoryBucket{}
+		m.buckets[key] = b
+	}
+
+	wait := b.take(limit, now)
+	b.idleAt = now.Add(idleTime(limit))
+	return wait, nil
+}
+
+func (m *MemoryBuckets) Refund(ctx context.Context, key string, limit *Limit, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if b, ok := m.buckets[key]; ok {
+		b.refund(limit)
+	}
+	return nil
+}
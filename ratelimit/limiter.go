@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit is a token bucket: Rate tokens per second are added, up to Burst
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// Limits are a tenant's request limits, a nil Limit is unlimited
+type Limits struct {
+	// Tenant limits all requests of the tenant
+	Tenant *Limit `json:"tenant"`
+	// Wallet limits the requests to each wallet
+	Wallet *Limit `json:"wallet"`
+	// Share limits the shares from one wallet to another
+	Share *Limit `json:"share"`
+}
+
+// DefaultLimits apply to tenants without limits
+var DefaultLimits = &Limits{
+	Tenant: &Limit{Rate: 100, Burst: 200},
+	Wallet: &Limit{Rate: 10, Burst: 20},
+	Share:  &Limit{Rate: 0.2, Burst: 10},
+}
+
+// BucketStore keeps token buckets
+type BucketStore interface {
+	// Take removes a token from the bucket if it has one, otherwise it returns how long until it has
+	Take(ctx context.Context, key string, limit *Limit, now time.Time) (time.Duration, error)
+	// Refund gives back a token taken at now, for a request rejected by another bucket
+	Refund(ctx context.Context, key string, limit *Limit, now time.Time) error
+}
+
+// Limiter applies a tenant's limits
+type Limiter struct {
+	buckets BucketStore
+	limits  *Limits
+}
+
+func NewLimiter(buckets BucketStore, limits *Limits) *Limiter {
+	return &Limiter{
+		buckets: buckets,
+		limits:  limits,
+	}
+}
+
+// Allow takes a token from the tenant's and the wallet's buckets, it returns how long to wait if one is empty.
+// The tenant's token is given back if the wallet's bucket is empty.
+func (l *Limiter) Allow(ctx context.Context, tenantID, walletID string) (time.Duration, error) {
+	now := time.Now()
+	tenantKey := "tenant/" + tenantID
+	wait, err := l.take(ctx, tenantKey, l.limits.Tenant, now)
+	if err != nil || wait > 0 || walletID == "" {
+		return wait, err
+	}
+
+	wait, err = l.take(ctx, "wallet/"+tenantID+"/"+walletID, l.limits.Wallet, now)
+	if (err != nil || wait > 0) && l.limits.Tenant != nil {
+		if err := l.buckets.Refund(ctx, tenantKey, l.limits.Tenant, now); err != nil {
+			return wait, err
+		}
+	}
+	return wait, err
+}
+
+// AllowShare takes a token from the bucket of shares from fromWalletID to toWalletID
+func (l *Limiter) AllowShare(ctx context.Context, tenantID, fromWalletID, toWalletID string) (time.Duration, error) {
+	return l.take(ctx, "share/"+tenantID+"/"+fromWalletID+"/"+toWalletID, l.limits.Share, time.Now())
+}
+
+func (l *Limiter) take(ctx context.Context, key string, limit *Limit, now time.Time) (time.Duration, error) {
+	if limit == nil {
+		return 0, nil
+	}
+	return l.buckets.Take(ctx, key, limit, now)
+}
+
+// bucket is the state of a token bucket
+type bucket struct {
+	Tokens    float64 `json:"tokens"`
+	UpdatedAt int64   `json:"updatedAt"`
+}
+
+// refill adds the tokens earned since the bucket was last counted, up to the burst (a new bucket is full). A time
+// before the last count (another instance's clock) earns nothing and leaves it as is.
+func (b *bucket) refill(limit *Limit, now time.Time) {
+	if b.UpdatedAt == 0 {
+		b.Tokens = limit.Burst
+	} else if elapsed := now.Sub(time.Unix(0, b.UpdatedAt)); elapsed > 0 {
+		b.Tokens += elapsed.Seconds() * limit.Rate
+		if b.Tokens > limit.Burst {
+			b.Tokens = limit.Burst
+		}
+	} else {
+		return
+	}
+	b.UpdatedAt = now.UnixNano()
+}
+
+// take refills the bucket up to now and removes a token, or returns how long until there is one
+func (b *bucket) take(limit *Limit, now time.Time) time.Duration {
+	b.refill(limit, now)
+
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return 0
+	}
+	if limit.Rate <= 0 {
+		return time.Hour
+	}
+	return time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+}
+
+// refund puts back a token taken, up to the burst
+func (b *bucket) refund(limit *Limit) {
+	b.Tokens++
+	if b.Tokens > limit.Burst {
+		b.Tokens = limit.Burst
+	}
+}
+
+// idleTime is how long until an unused bucket is full again and can be forgotten
+func idleTime(limit *Limit) time.Duration {
+	if limit.Rate <= 0 {
+		return time.Hour
+	}
+	return time.Duration(limit.Burst / limit.Rate * float64(time.Second))
+}
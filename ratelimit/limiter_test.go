@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	limit := &Limit{Rate: 2, Burst: 3}
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		wait    time.Duration
+	}{
+		{"full bucket", 0, 0},
+		{"second token", 0, 0},
+		{"last token", 0, 0},
+		{"empty bucket", 0, 500 * time.Millisecond},
+		{"half refilled", 250 * time.Millisecond, 250 * time.Millisecond},
+		{"refilled", 250 * time.Millisecond, 0},
+		{"refill capped at burst", time.Hour, 0},
+		{"burst left", 0, 0},
+		{"burst left again", 0, 0},
+		{"empty after burst", 0, 500 * time.Millisecond},
+	}
+
+	var b bucket
+	now := start
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.elapsed)
+			assert.Equal(t, tt.wait, b.take(limit, now))
+		})
+	}
+}
+
+func TestLimiterAllow(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		limits *Limits
+		// requests to wallets w1, w1, w2 in turn
+		waits []bool
+	}{
+		{"unlimited", &Limits{}, []bool{false, false, false}},
+		{"wallet limit", &Limits{Wallet: &Limit{Rate: 0.001, Burst: 1}}, []bool{false, true, false}},
+		{"tenant limit", &Limits{Tenant: &Limit{Rate: 0.001, Burst: 2}}, []bool{false, false, true}},
+		// the second request to w1 is rejected by its wallet bucket, so its tenant token is given back for w2
+		{"tenant token refunded", &Limits{Tenant: &Limit{Rate: 0.001, Burst: 2}, Wallet: &Limit{Rate: 0.001, Burst: 1}}, []bool{false, true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewLimiter(NewMemoryBuckets(), tt.limits)
+			for i, walletID := range []string{"w1", "w1", "w2"} {
+				wait, err := limiter.Allow(ctx, "t1", walletID)
+				assert.NoError(t, err)
+				assert.Equal(t, tt.waits[i], wait > 0, "request %d", i)
+			}
+		})
+	}
+}
+
+func TestBucketRefillEarlierTime(t *testing.T) {
+	limit := &Limit{Rate: 1, Burst: 2}
+	b := bucket{Tokens: 0, UpdatedAt: time.Unix(1000, 0).UnixNano()}
+
+	// a request counted with an earlier clock does not move the bucket back, which would refill it twice
+	wait := b.take(limit, time.Unix(999, 0))
+	assert.Equal(t, time.Second, wait)
+	assert.Equal(t, time.Unix(1000, 0).UnixNano(), b.UpdatedAt)
+}
+
+func TestCountAt(t *testing.T) {
+	prev := time.Unix(1000, 0).UnixNano()
+
+	tests := []struct {
+		name string
+		prev int64
+		now  time.Time
+		at   int64
+	}{
+		{"new bucket", 0, time.Unix(900, 0), time.Unix(900, 0).UnixNano()},
+		{"later", prev, time.Unix(1001, 0), time.Unix(1001, 0).UnixNano()},
+		{"same time", prev, time.Unix(1000, 0), prev + 1},
+		{"earlier", prev, time.Unix(999, 0), prev + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.at, countAt(tt.prev, tt.now).UnixNano())
+		})
+	}
+}
+
+func TestDynamoBucketAttributes(t *testing.T) {
+	b := &dynamoBucket{BucketKey: "k", bucket: bucket{Tokens: 1.5, UpdatedAt: 42}, ExpiresAt: 7}
+
+	item, err := dynamodbattribute.MarshalMap(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.5", *item["tokens"].N)
+	assert.Equal(t, "42", *item["updatedAt"].N)
+
+	var got dynamoBucket
+	assert.NoError(t, dynamodbattribute.UnmarshalMap(item, &got))
+	assert.Equal(t, *b, got)
+}
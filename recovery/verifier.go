@@ -0,0 +1,50 @@
+package recovery
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrVerificationFailed = errors.New("verification failed")
+	ErrUnknownVerifier    = errors.New("unknown recovery verifier")
+
+	// ErrLocalVerifierDisabled is returned for the local verifier unless RECOVERY_LOCAL_VERIFIER enables it (never in production)
+	ErrLocalVerifierDisabled = errors.New("the local recovery verifier is disabled")
+)
+
+// Verifier is a second factor proving the wallet owner's identity before recovery (e.g. email/OTP)
+type Verifier interface {
+	// Start sends a challenge to the owner's contact and returns state to keep until Verify
+	Start(ctx context.Context, tenantID, walletID, contact string) (string, error)
+
+	// Verify checks the owner's response to the challenge, returning ErrVerificationFailed if it does not match
+	Verify(ctx context.Context, state, response string) error
+}
+
+// NewVerifier returns the verifier a tenant has configured by name, the local verifier only if allowLocal
+func NewVerifier(name string, secret []byte, allowLocal bool) (Verifier, error) {
+	if name == "" {
+		return nil, errors.New("recovery is not enabled for tenant")
+	}
+	err := CheckVerifierName(name, allowLocal)
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalVerifier(secret), nil
+}
+
+// CheckVerifierName checks a tenant can be configured with the verifier (blank disables recovery)
+func CheckVerifierName(name string, allowLocal bool) error {
+	switch name {
+	case "":
+		return nil
+	case LocalVerifierName:
+		if !allowLocal {
+			return ErrLocalVerifierDisabled
+		}
+		return nil
+	default:
+		return ErrUnknownVerifier
+	}
+}
@@ -0,0 +1,213 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Capability is an owner-signed, attenuable token granting scoped access to a wallet.
+//
+// The first block is signed by the wallet owner's RSA key. Every block names an ed25519
+// key (NextKey) which signs the following block, and the private key of the last block
+// travels with the token as ProofKey. Any holder can attenuate the token by appending a
+// block with further caveats, but cannot remove or change earlier blocks.
+type Capability struct {
+	TenantID string             `json:"tenantId"`
+	WalletID string             `json:"walletId"`
+	Blocks   []*CapabilityBlock `json:"blocks"`
+	ProofKey string             `json:"proofKey"`
+}
+
+type CapabilityBlock struct {
+	// Caveats is the JSON encoded Caveats, signed as-is
+	Caveats   string `json:"caveats"`
+	NextKey   string `json:"nextKey"`
+	Signature string `json:"signature"`
+}
+
+// Caveats restrict a capability, every caveat of every block must hold
+type Caveats struct {
+	Operations   []string `json:"ops,omitempty"`
+	ReferenceIDs []string `json:"refs,omitempty"`
+	ExpiresAt    int64    `json:"exp,omitempty"`
+	Audience     string   `json:"aud,omitempty"`
+}
+
+// NewCapability creates a capability for the wallet, signed with the owner's private key
+func NewCapability(tenantID, walletID string, caveats *Caveats, ownerKey *rsa.PrivateKey) (*Capability, error) {
+	c := &Capability{
+		TenantID: tenantID,
+		WalletID: walletID,
+	}
+	return c, c.appendBlock(caveats, func(payload []byte) ([]byte, error) {
+		hashed := sha256.Sum256(payload)
+		return rsa.SignPKCS1v15(rand.Reader, ownerKey, crypto.SHA256, hashed[:])
+	})
+}
+
+// Attenuate returns a copy of the capability with an additional block of caveats
+func (c *Capability) Attenuate(caveats *Caveats) (*Capability, error) {
+	proofKey, err := c.proofKey()
+	if err != nil {
+		return nil, err
+	}
+
+	attenuated := &Capability{
+		TenantID: c.TenantID,
+		WalletID: c.WalletID,
+		Blocks:   append([]*CapabilityBlock{}, c.Blocks...),
+	}
+	return attenuated, attenuated.appendBlock(caveats, func(payload []byte) ([]byte, error) {
+		return ed25519.Sign(proofKey, payload), nil
+	})
+}
+
+func (c *Capability) appendBlock(caveats *Caveats, sign func([]byte) ([]byte, error)) error {
+	caveatsJson, err := json.Marshal(caveats)
+	if err != nil {
+		return err
+	}
+
+	nextPub, nextPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	block := &CapabilityBlock{
+		Caveats: string(caveatsJson),
+		NextKey: base64.StdEncoding.EncodeToString(nextPub),
+	}
+
+	sig, err := sign(c.blockPayload(len(c.Blocks), block))
+	if err != nil {
+		return err
+	}
+	block.Signature = base64.StdEncoding.EncodeToString(sig)
+
+	c.Blocks = append(c.Blocks, block)
+	c.ProofKey = base64.StdEncoding.EncodeToString(nextPriv.Seed())
+	return nil
+}
+
+// blockPayload binds a block to the wallet, its position and the previous block's signature
+func (c *Capability) blockPayload(index int, block *CapabilityBlock) []byte {
+	prevSignature := ""
+	if index > 0 {
+		prevSignature = c.Blocks[index-1].Signature
+	}
+	return []byte(fmt.Sprintf("%s|%s|%d|%s|%s|%s", c.TenantID, c.WalletID, index, block.Caveats, block.NextKey, prevSignature))
+}
+
+func (c *Capability) proofKey() (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(c.ProofKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid capability proof key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Verify checks the chain of signatures against the owner's public key and returns the caveats of every block
+func (c *Capability) Verify(ownerKey *rsa.PublicKey) ([]*Caveats, error) {
+	if len(c.Blocks) == 0 {
+		return nil, errors.New("capability has no blocks")
+	}
+
+	var caveats []*Caveats
+	var signingKey ed25519.PublicKey
+	for i, block := range c.Blocks {
+		sig, err := base64.StdEncoding.DecodeString(block.Signature)
+		if err != nil {
+			return nil, errors.New("capability signature not base64")
+		}
+
+		payload := c.blockPayload(i, block)
+		if i == 0 {
+			hashed := sha256.Sum256(payload)
+			err = rsa.VerifyPKCS1v15(ownerKey, crypto.SHA256, hashed[:], sig)
+			if err != nil {
+				return nil, errors.New("capability not signed by wallet owner")
+			}
+		} else if !ed25519.Verify(signingKey, payload, sig) {
+			return nil, errors.New(fmt.Sprintf("invalid signature on capability block %d", i))
+		}
+
+		nextKey, err := base64.StdEncoding.DecodeString(block.NextKey)
+		if err != nil || len(nextKey) != ed25519.PublicKeySize {
+			return nil, errors.New(fmt.Sprintf("invalid next key on capability block %d", i))
+		}
+		signingKey = nextKey
+
+		var cv Caveats
+		err = json.Unmarshal([]byte(block.Caveats), &cv)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid caveats on capability block %d", i))
+		}
+		caveats = append(caveats, &cv)
+	}
+
+	// the holder must present the private key of the last block
+	proofKey, err := c.proofKey()
+	if err != nil {
+		return nil, err
+	}
+	if !signingKey.Equal(proofKey.Public()) {
+		return nil, errors.New("capability proof key does not match")
+	}
+
+	return caveats, nil
+}
+
+// Allows checks a single caveat block for the operation on referenceID by audience at time now
+func (cv *Caveats) Allows(operation, referenceID, audience string, now time.Time) error {
+	if len(cv.Operations) > 0 && !contains(cv.Operations, operation) {
+		return errors.New("capability does not allow " + operation)
+	}
+	if len(cv.ReferenceIDs) > 0 && !contains(cv.ReferenceIDs, referenceID) {
+		return errors.New("capability does not allow reference ID " + referenceID)
+	}
+	if cv.ExpiresAt != 0 && now.Unix() > cv.ExpiresAt {
+		return errors.New("capability expired")
+	}
+	if cv.Audience != "" && cv.Audience != audience {
+		return errors.New("capability not issued to this audience")
+	}
+	return nil
+}
+
+func (c *Capability) Encode() (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func DecodeCapability(token string) (*Capability, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("capability not base64url")
+	}
+	var c Capability
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, errors.New("malformed capability")
+	}
+	return &c, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
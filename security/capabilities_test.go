@@ -0,0 +1,183 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCapabilityVerify(t *testing.T) {
+	ownerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	root := &Caveats{ReferenceIDs: []string{"ref-1", "ref-2"}, ExpiresAt: 1700000000}
+	narrowed := &Caveats{ReferenceIDs: []string{"ref-1"}, Audience: "bank"}
+
+	tests := []struct {
+		name    string
+		build   func(t *testing.T) *Capability
+		key     *rsa.PublicKey
+		caveats []*Caveats
+		wantErr bool
+	}{
+		{
+			name: "owner signed",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			caveats: []*Caveats{root},
+		},
+		{
+			name: "attenuated",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c, err = c.Attenuate(narrowed)
+				assert.NoError(t, err)
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			caveats: []*Caveats{root, narrowed},
+		},
+		{
+			name: "survives encoding",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c, err = c.Attenuate(narrowed)
+				assert.NoError(t, err)
+				token, err := c.Encode()
+				assert.NoError(t, err)
+				c, err = DecodeCapability(token)
+				assert.NoError(t, err)
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			caveats: []*Caveats{root, narrowed},
+		},
+		{
+			name: "wrong owner key",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				return c
+			},
+			key:     &otherKey.PublicKey,
+			wantErr: true,
+		},
+		{
+			name: "other wallet",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c.WalletID = "other"
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			wantErr: true,
+		},
+		{
+			name: "tampered first block",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c.Blocks[0].Caveats = `{"refs":["ref-3"]}`
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			wantErr: true,
+		},
+		{
+			name: "tampered attenuated block",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c, err = c.Attenuate(narrowed)
+				assert.NoError(t, err)
+				c.Blocks[1].Caveats = `{}`
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			wantErr: true,
+		},
+		{
+			name: "attenuated block removed",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c, err = c.Attenuate(narrowed)
+				assert.NoError(t, err)
+				c.Blocks = c.Blocks[:1]
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			wantErr: true,
+		},
+		{
+			name: "missing proof key",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c.ProofKey = ""
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			wantErr: true,
+		},
+		{
+			name: "wrong proof key",
+			build: func(t *testing.T) *Capability {
+				c, err := NewCapability("tenant", "wallet", root, ownerKey)
+				assert.NoError(t, err)
+				c.ProofKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+				return c
+			},
+			key:     &ownerKey.PublicKey,
+			wantErr: true,
+		},
+		{
+			name: "no blocks",
+			build: func(t *testing.T) *Capability {
+				return &Capability{TenantID: "tenant", WalletID: "wallet"}
+			},
+			key:     &ownerKey.PublicKey,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caveats, err := tt.build(t).Verify(tt.key)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.caveats, caveats)
+		})
+	}
+}
+
+func TestDecodeCapabilityErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64url", "not a token!"},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("blocks"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeCapability(tt.token)
+			assert.Error(t, err)
+		})
+	}
+}
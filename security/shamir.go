@@ -0,0 +1,112 @@
+package security
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// SplitSecret splits secret into n shares, any threshold of which recover it (Shamir's scheme over GF(256)).
+// Each share is its x coordinate (1..n) followed by one byte per byte of the secret.
+func SplitSecret(secret []byte, threshold, n int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+	if threshold < 1 || threshold > n || n > 255 {
+		return nil, errors.New("threshold must be between 1 and the number of shares (at most 255)")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, threshold)
+	for j, b := range secret {
+		coeffs[0] = b
+		_, err := rand.Read(coeffs[1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[j+1] = gfPolynomial(coeffs, share[0])
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineShares recovers the secret from threshold or more shares made by SplitSecret.
+// Fewer shares give a wrong secret rather than an error.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if len(share) < 2 || len(share) != len(shares[0]) {
+			return nil, errors.New("shares have different lengths")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, errors.New("invalid or duplicate share")
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, len(shares[0])-1)
+	for i, share := range shares {
+		// Lagrange basis polynomial at x=0 (subtraction is xor in GF(256))
+		num, den := byte(1), byte(1)
+		for m, other := range shares {
+			if m == i {
+				continue
+			}
+			num = gfMul(num, other[0])
+			den = gfMul(den, other[0]^share[0])
+		}
+		basis := gfMul(num, gfInverse(den))
+
+		for j := range secret {
+			secret[j] ^= gfMul(share[j+1], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+func gfPolynomial(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfInverse returns a^254, the multiplicative inverse of a (a != 0)
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for e := 254; e > 0; e >>= 1 {
+		if e&1 != 0 {
+			result = gfMul(result, a)
+		}
+		a = gfMul(a, a)
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package security
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSplitAndCombineShares(t *testing.T) {
+	secret := []byte("recovery key material")
+
+	tests := []struct {
+		name      string
+		threshold int
+		n         int
+		use       []int
+		recovered bool
+	}{
+		{"threshold of shares", 3, 5, []int{0, 2, 4}, true},
+		{"other shares in another order", 3, 5, []int{3, 1, 0}, true},
+		{"all shares", 3, 5, []int{0, 1, 2, 3, 4}, true},
+		{"below threshold", 3, 5, []int{0, 1}, false},
+		{"one of one", 1, 1, []int{0}, true},
+		{"any single share of threshold one", 1, 3, []int{2}, true},
+		{"every share needed", 4, 4, []int{3, 2, 1, 0}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares, err := SplitSecret(secret, tt.threshold, tt.n)
+			assert.NoError(t, err)
+			assert.Len(t, shares, tt.n)
+
+			var used [][]byte
+			for _, i := range tt.use {
+				used = append(used, shares[i])
+			}
+			combined, err := CombineShares(used)
+			assert.NoError(t, err)
+			if tt.recovered {
+				assert.Equal(t, secret, combined)
+			} else {
+				assert.NotEqual(t, secret, combined)
+			}
+		})
+	}
+}
+
+func TestSplitSecretErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    []byte
+		threshold int
+		n         int
+	}{
+		{"empty secret", nil, 2, 3},
+		{"zero threshold", []byte("s"), 0, 3},
+		{"threshold above shares", []byte("s"), 4, 3},
+		{"too many shares", []byte("s"), 2, 256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SplitSecret(tt.secret, tt.threshold, tt.n)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCombineSharesErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"no shares", nil},
+		{"different lengths", [][]byte{{1, 7, 7}, {2, 7}}},
+		{"no share bytes", [][]byte{{1}, {2}}},
+		{"duplicate x", [][]byte{{1, 7}, {1, 8}}},
+		{"zero x", [][]byte{{0, 7}, {1, 8}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CombineShares(tt.shares)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), gfMul(byte(a), gfInverse(byte(a))), "a=%d", a)
+	}
+}
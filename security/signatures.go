@@ -4,12 +4,24 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"sync"
 )
 
+// maxCachedPublicKeys bounds the parsed key cache, it is emptied when full
+const maxCachedPublicKeys = 1024
+
+var publicKeyCache = struct {
+	sync.Mutex
+	keys map[string]*rsa.PublicKey
+}{
+	keys: map[string]*rsa.PublicKey{},
+}
+
 func VerifySignature(paylod []byte, signatureBase64 string, pubKey *rsa.PublicKey) error {
 	hashed := sha256.Sum256(paylod)
 	sigBytes, err := base64.StdEncoding.DecodeString(signatureBase64)
@@ -19,6 +31,18 @@ func VerifySignature(paylod []byte, signatureBase64 string, pubKey *rsa.PublicKe
 	return rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hashed[:], sigBytes)
 }
 
+// VerifySignaturePSS verifies an RSASSA-PSS signature using SHA-512 (rsa-pss-sha512)
+func VerifySignaturePSS(payload []byte, sig []byte, pubKey *rsa.PublicKey) error {
+	hashed := sha512.Sum512(payload)
+	return rsa.VerifyPSS(pubKey, crypto.SHA512, hashed[:], sig, &rsa.PSSOptions{SaltLength: 64})
+}
+
+// VerifySignaturePKCS1v15 verifies a raw RSASSA-PKCS1-v1_5 signature using SHA-256 (rsa-v1_5-sha256)
+func VerifySignaturePKCS1v15(payload []byte, sig []byte, pubKey *rsa.PublicKey) error {
+	hashed := sha256.Sum256(payload)
+	return rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hashed[:], sig)
+}
+
 func PemBase64ToPublicKey(publicKeyBase64 string) (*rsa.PublicKey, error) {
 	pemStr, err := base64.StdEncoding.DecodeString(publicKeyBase64)
 	if err != nil {
@@ -36,4 +60,29 @@ func PemBase64ToPublicKey(publicKeyBase64 string) (*rsa.PublicKey, error) {
 	}
 
 	return pubKey, nil
-}
\ No newline at end of file
+}
+
+// ParsePublicKey is PemBase64ToPublicKey keeping parsed keys across warm invocations.
+// Keys are cached by their PEM, so a rotated key is parsed again.
+func ParsePublicKey(publicKeyBase64 string) (*rsa.PublicKey, error) {
+	publicKeyCache.Lock()
+	pubKey, ok := publicKeyCache.keys[publicKeyBase64]
+	publicKeyCache.Unlock()
+	if ok {
+		return pubKey, nil
+	}
+
+	pubKey, err := PemBase64ToPublicKey(publicKeyBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeyCache.Lock()
+	if len(publicKeyCache.keys) >= maxCachedPublicKeys {
+		publicKeyCache.keys = map[string]*rsa.PublicKey{}
+	}
+	publicKeyCache.keys[publicKeyBase64] = pubKey
+	publicKeyCache.Unlock()
+
+	return pubKey, nil
+}
@@ -0,0 +1,61 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+)
+
+// SignToken creates a compact HS256 JWT for the given claims
+func SignToken(claims interface{}, secret []byte) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("token secret not configured")
+	}
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(payload, secret)), nil
+}
+
+// ParseToken verifies an HS256 JWT and unmarshals its claims (expiry is checked by the caller)
+func ParseToken(token string, secret []byte, claims interface{}) error {
+	if len(secret) == 0 {
+		return errors.New("token secret not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	if parts[0] != tokenHeader {
+		return errors.New("unsupported token header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("malformed token signature")
+	}
+	if !hmac.Equal(sig, tokenMAC(parts[0]+"."+parts[1], secret)) {
+		return errors.New("invalid token signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("malformed token claims")
+	}
+	return json.Unmarshal(b, claims)
+}
+
+func tokenMAC(payload string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
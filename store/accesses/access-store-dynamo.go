@@ -0,0 +1,90 @@
+package accesses
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/google/uuid"
+	"log"
+)
+
+const (
+	accessTable = "wallet-share-accesses"
+)
+
+// DynamoAccessStore keeps accesses keyed by the sharing "tenant/wallet" and "toWallet/referenceId/accessedAt/id",
+// so the reads of one recipient or one share are a prefix of the sharer's
+type DynamoAccessStore struct {
+	db *dynamodb.DynamoDB
+}
+
+type DynamoAccess struct {
+	FromWallet string  `json:"fromWallet"`
+	AccessKey  string  `json:"accessKey"`
+	Access     *Access `json:"access"`
+}
+
+func NewDynamoAccessStore(db *dynamodb.DynamoDB) *DynamoAccessStore {
+	return &DynamoAccessStore{
+		db: db,
+	}
+}
+
+func (s *DynamoAccessStore) RecordAccess(ctx context.Context, access *Access) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoAccess{
+		FromWallet: fmt.Sprintf("%s/%s", access.TenantID, access.FromWalletID),
+		AccessKey:  fmt.Sprintf("%s/%s/%s/%s", access.ToWalletID, access.ReferenceID, access.AccessedAt, uuid.New().String()),
+		Access:     access,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(accessTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoAccessStore) ListAccesses(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID string) ([]*Access, error) {
+	key := expression.Key("fromWallet").Equal(expression.Value(fmt.Sprintf("%s/%s", tenantID, fromWalletID)))
+	if toWalletID != "" {
+		prefix := toWalletID + "/"
+		if referenceID != "" {
+			prefix += referenceID + "/"
+		}
+		key = key.And(expression.Key("accessKey").BeginsWith(prefix))
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	accesses := []*Access{}
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(accessTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				// a record that cannot be read is skipped so the rest of the report is still returned
+				var da DynamoAccess
+				if err := dynamodbattribute.UnmarshalMap(item, &da); err != nil || da.Access == nil {
+					log.Printf("skipping access record %s %s: %v", aws.StringValue(item["fromWallet"].S), aws.StringValue(item["accessKey"].S), err)
+					continue
+				}
+				accesses = append(accesses, da.Access)
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+	return accesses, nil
+}
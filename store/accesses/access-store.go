@@ -0,0 +1,27 @@
+package accesses
+
+import (
+	"context"
+)
+
+// Access records a recipient reading a version of an item shared with it
+type Access struct {
+	TenantID     string `json:"tenantId"`
+	FromWalletID string `json:"fromWalletId"`
+	ToWalletID   string `json:"toWalletId"`
+	ReferenceID  string `json:"referenceId"`
+	VersionHash  string `json:"versionHash"`
+	DeviceID     string `json:"deviceId,omitempty"`
+	AccessedAt   string `json:"accessedAt"`
+}
+
+type AccessList struct {
+	Accesses []*Access `json:"accesses"`
+}
+
+type AccessStore interface {
+	RecordAccess(ctx context.Context, access *Access) error
+	// ListAccesses returns the reads of items shared by the wallet grouped by recipient and reference ID, oldest first.
+	// toWalletID (and referenceID) narrow it to one recipient (and one share), blank for all.
+	ListAccesses(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID string) ([]*Access, error)
+}
@@ -0,0 +1,325 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+)
+
+const (
+	auditTable = "wallet-audit-log"
+
+	// legacyAuditTable holds the events recorded before the log, they are copied into it when it is opened
+	legacyAuditTable = "wallet-audit"
+
+	// headKey is the event key of the item counting a wallet's events, kept in its own partition "tenant/wallet#head"
+	headKey = "head"
+
+	// maxAttempts bounds the retries of an append racing with others on the same wallet
+	maxAttempts = 10
+)
+
+var errContention = errors.New("audit log head changed concurrently too many times")
+
+// DynamoAuditStore numbers each wallet's events from a head item, chains them and authenticates them with key
+type DynamoAuditStore struct {
+	db  *dynamodb.DynamoDB
+	key []byte
+}
+
+// DynamoEvent is keyed by "tenant/wallet" and the zero-padded sequence, so events sort in log order
+type DynamoEvent struct {
+	WalletID string `json:"walletId"`
+	EventKey string `json:"eventKey"`
+	Event    *Event `json:"event"`
+}
+
+// DynamoHead counts the events of a wallet and holds the hash of the latest, it is created when the log is opened
+type DynamoHead struct {
+	WalletID string `json:"walletId"`
+	EventKey string `json:"eventKey"`
+	Sequence int64  `json:"sequence"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+func NewDynamoAuditStore(db *dynamodb.DynamoDB, key []byte) *DynamoAuditStore {
+	return &DynamoAuditStore{
+		db:  db,
+		key: key,
+	}
+}
+
+func eventKey(sequence int64) string {
+	return fmt.Sprintf("%020d", sequence)
+}
+
+func logKey(tenantID, walletID string) string {
+	return fmt.Sprintf("%s/%s", tenantID, walletID)
+}
+
+func headItemKey(tenantID, walletID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"walletId": {
+			S: aws.String(logKey(tenantID, walletID) + "#" + headKey),
+		},
+		"eventKey": {
+			S: aws.String(headKey),
+		},
+	}
+}
+
+// RecordEvent appends the event after the wallet's head: the head is moved to the event (its sequence and hash) on the
+// condition that no other event was appended since it was read, retrying otherwise, then the event is written. An
+// event whose write fails after the head moved shows as missing.
+func (s *DynamoAuditStore) RecordEvent(ctx context.Context, event *Event) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		head, opened, err := s.readHead(ctx, event.TenantID, event.WalletID)
+		if err != nil {
+			return err
+		}
+		if !opened {
+			err = s.openLog(ctx, event.TenantID, event.WalletID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		event.Sequence = head.Sequence + 1
+		event.PrevHash = head.Hash
+		event.Hash = event.ComputeHash(s.key)
+		err = s.moveHead(ctx, event, head.Sequence)
+		if err != nil && isConditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return s.putEvent(ctx, event)
+	}
+	return errContention
+}
+
+// moveHead sets the wallet's head to the event, failing its condition unless the head is still at prevSequence
+func (s *DynamoAuditStore) moveHead(ctx context.Context, event *Event, prevSequence int64) error {
+	update := expression.Set(expression.Name("sequence"), expression.Value(event.Sequence)).
+		Set(expression.Name("hash"), expression.Value(event.Hash))
+	cond := expression.Name("sequence").Equal(expression.Value(prevSequence))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(auditTable),
+		Key:                       headItemKey(event.TenantID, event.WalletID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+// putEvent writes the event, the log is append-only: an event is never overwritten
+func (s *DynamoAuditStore) putEvent(ctx context.Context, event *Event) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoEvent{
+		WalletID: logKey(event.TenantID, event.WalletID),
+		EventKey: eventKey(event.Sequence),
+		Event:    event,
+	})
+	if err != nil {
+		return err
+	}
+
+	cond := expression.Name("eventKey").AttributeNotExists()
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(auditTable),
+		Item:                     item,
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	return err
+}
+
+// openLog copies the wallet's events recorded before the log into it, then creates its counter. Copies are written
+// at the same sequences by every attempt, so an interrupted or concurrent opening is picked up by the next one.
+func (s *DynamoAuditStore) openLog(ctx context.Context, tenantID, walletID string) error {
+	legacy, err := s.legacyEvents(ctx, tenantID, walletID)
+	if err != nil {
+		return err
+	}
+	prevHash := ""
+	for i, event := range legacy {
+		event.Sequence = int64(i + 1)
+		event.PrevHash = prevHash
+		event.Hash = event.ComputeHash(s.key)
+		err = s.putEvent(ctx, event)
+		if err != nil && !isConditionFailed(err) {
+			return err
+		}
+		prevHash = event.Hash
+	}
+
+	item, err := dynamodbattribute.MarshalMap(&DynamoHead{
+		WalletID: logKey(tenantID, walletID) + "#" + headKey,
+		EventKey: headKey,
+		Sequence: int64(len(legacy)),
+		Hash:     prevHash,
+	})
+	if err != nil {
+		return err
+	}
+
+	cond := expression.AttributeNotExists(expression.Name("walletId"))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(auditTable),
+		Item:                     item,
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	if err != nil && isConditionFailed(err) {
+		// opened concurrently
+		return nil
+	}
+	return err
+}
+
+// legacyEvents returns the wallet's events recorded before the log, oldest first
+func (s *DynamoAuditStore) legacyEvents(ctx context.Context, tenantID, walletID string) ([]*Event, error) {
+	key := expression.Key("walletId").Equal(expression.Value(logKey(tenantID, walletID)))
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(legacyAuditTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var de DynamoEvent
+				if dynamodbattribute.UnmarshalMap(item, &de) == nil && de.Event != nil {
+					events = append(events, de.Event)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ListEvents opens the log when listing an empty one from the start, so events recorded before it are listed
+func (s *DynamoAuditStore) ListEvents(ctx context.Context, tenantID, walletID string, from int64, limit int) ([]*Event, error) {
+	events, err := s.listEvents(ctx, tenantID, walletID, from, limit)
+	if err != nil || len(events) > 0 || from > 1 {
+		return events, err
+	}
+
+	_, opened, err := s.readHead(ctx, tenantID, walletID)
+	if err != nil || opened {
+		return events, err
+	}
+	err = s.openLog(ctx, tenantID, walletID)
+	if err != nil {
+		return nil, err
+	}
+	return s.listEvents(ctx, tenantID, walletID, from, limit)
+}
+
+func (s *DynamoAuditStore) listEvents(ctx context.Context, tenantID, walletID string, from int64, limit int) ([]*Event, error) {
+	key := expression.Key("walletId").Equal(expression.Value(logKey(tenantID, walletID))).
+		And(expression.Key("eventKey").GreaterThanEqual(expression.Value(eventKey(from))))
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(auditTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+		Limit:                     aws.Int64(int64(limit)),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var de DynamoEvent
+				if dynamodbattribute.UnmarshalMap(item, &de) == nil && de.Event != nil {
+					events = append(events, de.Event)
+				}
+			}
+			return !lastPage && len(events) < limit
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (s *DynamoAuditStore) Head(ctx context.Context, tenantID, walletID string) (int64, error) {
+	head, _, err := s.readHead(ctx, tenantID, walletID)
+	if err != nil {
+		return 0, err
+	}
+	return head.Sequence, nil
+}
+
+// readHead reads the wallet's head (empty if none), opened is false if the log has not been opened yet
+func (s *DynamoAuditStore) readHead(ctx context.Context, tenantID, walletID string) (*DynamoHead, bool, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(auditTable),
+		Key:            headItemKey(tenantID, walletID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if res.Item == nil {
+		return &DynamoHead{}, false, nil
+	}
+
+	var head DynamoHead
+	err = dynamodbattribute.UnmarshalMap(res.Item, &head)
+	if err != nil {
+		return nil, false, err
+	}
+	return &head, true, nil
+}
+
+func (s *DynamoAuditStore) VerifyEvents(prev *Event, events []*Event) (int64, error) {
+	return VerifyChain(s.key, prev, events)
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
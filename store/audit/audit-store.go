@@ -0,0 +1,87 @@
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailed  = "failed"
+)
+
+// Event records an action on a wallet and who performed it. Events of a wallet are numbered from 1 without gaps,
+// each one includes the hash of the previous one (blank for the first) and is authenticated with the log's key, so
+// events cannot be edited, reordered or made up without it.
+type Event struct {
+	TenantID    string `json:"tenantId"`
+	WalletID    string `json:"walletId"`
+	ActorID     string `json:"actorId"`
+	DeviceID    string `json:"deviceId,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Operation   string `json:"operation"`
+	Target      string `json:"target,omitempty"`
+	VersionHash string `json:"versionHash,omitempty"`
+	Outcome     string `json:"outcome,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+
+	// Sequence, PrevHash and Hash are set by the store when the event is appended
+	Sequence int64  `json:"sequence"`
+	PrevHash string `json:"prevHash"`
+	Hash     string `json:"hash"`
+}
+
+// ComputeHash is base64url(HMAC-SHA256(key)) of the event's JSON without its hash
+func (e *Event) ComputeHash(key []byte) string {
+	unhashed := *e
+	unhashed.Hash = ""
+	b, _ := json.Marshal(&unhashed)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyChain checks each event's hash with the log's key and its link to the one before, starting after prev
+// (nil from the first event). It returns the sequence of the first event that does not verify.
+func VerifyChain(key []byte, prev *Event, events []*Event) (int64, error) {
+	for _, e := range events {
+		prevHash, sequence := "", int64(1)
+		if prev != nil {
+			prevHash, sequence = prev.Hash, prev.Sequence+1
+		}
+		if e.Sequence != sequence {
+			return sequence, fmt.Errorf("event %d is missing", sequence)
+		}
+		if e.PrevHash != prevHash {
+			return e.Sequence, fmt.Errorf("event %d does not follow event %d", e.Sequence, sequence-1)
+		}
+		if !hmac.Equal([]byte(e.ComputeHash(key)), []byte(e.Hash)) {
+			return e.Sequence, fmt.Errorf("event %d does not match its hash", e.Sequence)
+		}
+		prev = e
+	}
+	return 0, nil
+}
+
+type EventList struct {
+	Events []*Event `json:"events"`
+
+	// Next is the sequence to list from for the next page, 0 at the end of the log
+	Next int64 `json:"next,omitempty"`
+}
+
+// AuditStore is an append-only log per wallet
+type AuditStore interface {
+	// RecordEvent appends the event to the wallet's log, setting its Sequence, PrevHash and Hash
+	RecordEvent(ctx context.Context, event *Event) error
+	// ListEvents returns up to limit events of the wallet from sequence from, oldest first
+	ListEvents(ctx context.Context, tenantID, walletID string, from int64, limit int) ([]*Event, error)
+	// Head returns the sequence of the wallet's latest event, 0 if its log is empty
+	Head(ctx context.Context, tenantID, walletID string) (int64, error)
+	// VerifyEvents checks events with the log's key, see VerifyChain
+	VerifyEvents(prev *Event, events []*Event) (int64, error)
+}
@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVerifyChain(t *testing.T) {
+	key := []byte("audit-key")
+	log := func() []*Event {
+		var events []*Event
+		prevHash := ""
+		for i, op := range []string{"create", "add", "share"} {
+			e := &Event{
+				TenantID:  "tenant",
+				WalletID:  "wallet",
+				Operation: op,
+				CreatedAt: "2024-03-01T10:00:00.000Z",
+				Sequence:  int64(i + 1),
+				PrevHash:  prevHash,
+			}
+			e.Hash = e.ComputeHash(key)
+			prevHash = e.Hash
+			events = append(events, e)
+		}
+		return events
+	}
+
+	tests := []struct {
+		name     string
+		key      []byte
+		prev     func(events []*Event) *Event
+		events   func(events []*Event) []*Event
+		brokenAt int64
+	}{
+		{"whole log", key, nil, func(e []*Event) []*Event { return e }, 0},
+		{"empty log", key, nil, func(e []*Event) []*Event { return nil }, 0},
+		{"from a page", key, func(e []*Event) *Event { return e[0] }, func(e []*Event) []*Event { return e[1:] }, 0},
+		{"other key", []byte("other-key"), nil, func(e []*Event) []*Event { return e }, 1},
+		{"edited", key, nil, func(e []*Event) []*Event { e[1].Target = "passport"; return e }, 2},
+		{"rehashed without the key", key, nil, func(e []*Event) []*Event {
+			e[1].Operation = "read"
+			e[1].Hash = e[1].ComputeHash(nil)
+			return e
+		}, 2},
+		{"removed", key, nil, func(e []*Event) []*Event { return []*Event{e[0], e[2]} }, 2},
+		{"reordered", key, nil, func(e []*Event) []*Event { return []*Event{e[1], e[0], e[2]} }, 1},
+		{"renumbered", key, nil, func(e []*Event) []*Event { e[2].Sequence = 2; return []*Event{e[0], e[2]} }, 2},
+		{"relinked with the key", key, nil, func(e []*Event) []*Event {
+			// an event rewritten by someone holding the key still breaks the link of the next one
+			e[1].Target = "passport"
+			e[1].Hash = e[1].ComputeHash(key)
+			return e
+		}, 3},
+		{"page from the wrong event", key, func(e []*Event) *Event {
+			other := *e[0]
+			other.Hash = "other"
+			return &other
+		}, func(e []*Event) []*Event { return e[1:] }, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := log()
+			var prev *Event
+			if tt.prev != nil {
+				prev = tt.prev(events)
+			}
+			brokenAt, err := VerifyChain(tt.key, prev, tt.events(events))
+			assert.Equal(t, tt.brokenAt, brokenAt)
+			assert.Equal(t, tt.brokenAt != 0, err != nil)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package datarequests
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"strings"
+)
+
+const (
+	dataRequestTable = "wallet-data-requests"
+	toWalletIndex    = "toWallet-createdAt-index"
+	fromWalletIndex  = "fromWallet-createdAt-index"
+)
+
+type DynamoDataRequestStore struct {
+	db *dynamodb.DynamoDB
+}
+
+// DynamoDataRequest is keyed by requestId and indexed by the "tenant/wallet" of both sides
+type DynamoDataRequest struct {
+	RequestID   string       `json:"requestId"`
+	FromWallet  string       `json:"fromWallet"`
+	ToWallet    string       `json:"toWallet"`
+	CreatedAt   string       `json:"createdAt"`
+	DataRequest *DataRequest `json:"dataRequest"`
+}
+
+func NewDynamoDataRequestStore(db *dynamodb.DynamoDB) *DynamoDataRequestStore {
+	return &DynamoDataRequestStore{
+		db: db,
+	}
+}
+
+func (s *DynamoDataRequestStore) CreateDataRequest(ctx context.Context, request *DataRequest) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoDataRequest{
+		RequestID:   request.RequestID,
+		FromWallet:  fmt.Sprintf("%s/%s", request.TenantID, request.FromWalletID),
+		ToWallet:    fmt.Sprintf("%s/%s", request.TenantID, request.ToWalletID),
+		CreatedAt:   request.CreatedAt,
+		DataRequest: request,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(dataRequestTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoDataRequestStore) GetDataRequest(ctx context.Context, requestID string) (*DataRequest, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(dataRequestTable),
+		Key:       dataRequestKey(requestID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalDataRequest(res.Item)
+}
+
+func (s *DynamoDataRequestStore) ListReceived(ctx context.Context, tenantID, walletID, next string, limit int) ([]*DataRequest, string, error) {
+	return s.list(ctx, toWalletIndex, "toWallet", fmt.Sprintf("%s/%s", tenantID, walletID), next, limit)
+}
+
+func (s *DynamoDataRequestStore) ListSent(ctx context.Context, tenantID, walletID, next string, limit int) ([]*DataRequest, string, error) {
+	return s.list(ctx, fromWalletIndex, "fromWallet", fmt.Sprintf("%s/%s", tenantID, walletID), next, limit)
+}
+
+// list reads a page of the index, next is "createdAt/requestId" of the last request of the page before
+func (s *DynamoDataRequestStore) list(ctx context.Context, index, attribute, wallet, next string, limit int) ([]*DataRequest, string, error) {
+	key := expression.Key(attribute).Equal(expression.Value(wallet))
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, "", err
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(dataRequestTable),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int64(int64(limit)),
+	}
+	if next != "" {
+		parts := strings.SplitN(next, "/", 2)
+		if len(parts) != 2 {
+			return nil, "", ErrInvalidNext
+		}
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			attribute:   {S: aws.String(wallet)},
+			"createdAt": {S: aws.String(parts[0])},
+			"requestId": {S: aws.String(parts[1])},
+		}
+	}
+
+	res, err := s.db.QueryWithContext(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	requests := []*DataRequest{}
+	for _, item := range res.Items {
+		if request, err := unmarshalDataRequest(item); err == nil {
+			requests = append(requests, request)
+		}
+	}
+
+	if res.LastEvaluatedKey == nil {
+		return requests, "", nil
+	}
+	var last DynamoDataRequest
+	err = dynamodbattribute.UnmarshalMap(res.LastEvaluatedKey, &last)
+	if err != nil {
+		return nil, "", err
+	}
+	return requests, last.CreatedAt + "/" + last.RequestID, nil
+}
+
+func (s *DynamoDataRequestStore) AddFulfilment(ctx context.Context, requestID string, fulfilment *Fulfilment) error {
+	fulfilments := expression.Name("dataRequest.fulfilments")
+	update := expression.Set(expression.Name("dataRequest.status"), expression.Value(StatusFulfilled)).
+		Set(fulfilments, expression.ListAppend(expression.IfNotExists(fulfilments, expression.Value([]*Fulfilment{})), expression.Value([]*Fulfilment{fulfilment})))
+	cond := expression.Name("dataRequest.status").In(expression.Value(StatusOpen), expression.Value(StatusFulfilled)).
+		And(expression.Name("dataRequest.deadline").GreaterThan(expression.Value(fulfilment.SharedAt)))
+	return s.update(ctx, requestID, update, cond)
+}
+
+func (s *DynamoDataRequestStore) Decline(ctx context.Context, requestID, reason, declinedAt string) error {
+	update := expression.Set(expression.Name("dataRequest.status"), expression.Value(StatusDeclined)).
+		Set(expression.Name("dataRequest.declineReason"), expression.Value(reason)).
+		Set(expression.Name("dataRequest.declinedAt"), expression.Value(declinedAt))
+	cond := expression.Name("dataRequest.status").Equal(expression.Value(StatusOpen))
+	return s.update(ctx, requestID, update, cond)
+}
+
+// update applies the update if the request matches cond
+func (s *DynamoDataRequestStore) update(ctx context.Context, requestID string, update expression.UpdateBuilder, cond expression.ConditionBuilder) error {
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(dataRequestTable),
+		Key:                       dataRequestKey(requestID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrNotOpen
+	}
+	return err
+}
+
+func dataRequestKey(requestID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"requestId": {
+			S: aws.String(requestID),
+		},
+	}
+}
+
+func unmarshalDataRequest(item map[string]*dynamodb.AttributeValue) (*DataRequest, error) {
+	var dr DynamoDataRequest
+	err := dynamodbattribute.UnmarshalMap(item, &dr)
+	if err != nil {
+		return nil, err
+	}
+	if dr.DataRequest == nil {
+		return nil, ErrNotFound
+	}
+	return dr.DataRequest, nil
+}
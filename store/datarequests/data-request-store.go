@@ -0,0 +1,94 @@
+package datarequests
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	StatusOpen      = "open"
+	StatusFulfilled = "fulfilled"
+	StatusDeclined  = "declined"
+
+	// StatusExpired is shown for open requests past their deadline, it is not stored
+	StatusExpired = "expired"
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrNotOpen     = errors.New("data request is not open")
+	ErrInvalidNext = errors.New("invalid next")
+)
+
+// DataRequest is a request from one wallet (a verifier) to another for some of its data
+type DataRequest struct {
+	RequestID    string `json:"requestId"`
+	TenantID     string `json:"tenantId"`
+	FromWalletID string `json:"fromWalletId"`
+	ToWalletID   string `json:"toWalletId"`
+
+	// ReferenceIDs and DataTypes name the data wanted, at least one of them is set. Items are not typed, so DataTypes
+	// only tell the owner what is wanted: any item can answer them.
+	ReferenceIDs []string `json:"referenceIds,omitempty"`
+	DataTypes    []string `json:"dataTypes,omitempty"`
+	Purpose      string   `json:"purpose"`
+	LegalBasis   string   `json:"legalBasis"`
+
+	// Deadline is when the request can no longer be fulfilled (format: 2006-01-02T15:04:05.000Z)
+	Deadline  string `json:"deadline"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"createdAt"`
+
+	// Fulfilments are the items shared in response, DeclinedAt and DeclineReason are set if the owner declined
+	Fulfilments   []*Fulfilment `json:"fulfilments,omitempty"`
+	DeclinedAt    string        `json:"declinedAt,omitempty"`
+	DeclineReason string        `json:"declineReason,omitempty"`
+}
+
+// Fulfilment is an item shared in response to a data request
+type Fulfilment struct {
+	ReferenceID string `json:"referenceId"`
+	VersionHash string `json:"versionHash"`
+	SharedAt    string `json:"sharedAt"`
+}
+
+// Expired is true once the deadline has passed
+func (r *DataRequest) Expired(at string) bool {
+	return r.Deadline != "" && at >= r.Deadline
+}
+
+// Requests is true if the request asks for referenceID, any item can answer a request naming data types only
+// (they are informational)
+func (r *DataRequest) Requests(referenceID string) bool {
+	if len(r.ReferenceIDs) == 0 {
+		return true
+	}
+	for _, id := range r.ReferenceIDs {
+		if id == referenceID {
+			return true
+		}
+	}
+	return false
+}
+
+type DataRequestList struct {
+	Received []*DataRequest `json:"received"`
+	Sent     []*DataRequest `json:"sent"`
+
+	// Next lists the following page of both lists, blank once both are at their end
+	Next string `json:"next,omitempty"`
+}
+
+type DataRequestStore interface {
+	CreateDataRequest(ctx context.Context, request *DataRequest) error
+	GetDataRequest(ctx context.Context, requestID string) (*DataRequest, error)
+	// ListReceived and ListSent return up to limit requests to and from the wallet after next, newest first, and the
+	// next of the following page (blank at the end). A malformed next returns ErrInvalidNext.
+	ListReceived(ctx context.Context, tenantID, walletID, next string, limit int) ([]*DataRequest, string, error)
+	ListSent(ctx context.Context, tenantID, walletID, next string, limit int) ([]*DataRequest, string, error)
+	// AddFulfilment records an item shared for an open or fulfilled request before its deadline and marks it
+	// fulfilled, or returns ErrNotOpen
+	AddFulfilment(ctx context.Context, requestID string, fulfilment *Fulfilment) error
+	// Decline marks an open request declined, or returns ErrNotOpen
+	Decline(ctx context.Context, requestID, reason, declinedAt string) error
+}
@@ -0,0 +1,49 @@
+package datarequests
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDataRequestRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     *DataRequest
+		referenceID string
+		requests    bool
+	}{
+		{"named reference ID", &DataRequest{ReferenceIDs: []string{"passport", "payslip"}}, "payslip", true},
+		{"other reference ID", &DataRequest{ReferenceIDs: []string{"passport"}}, "payslip", false},
+		{"reference IDs and data types", &DataRequest{ReferenceIDs: []string{"passport"}, DataTypes: []string{"identity"}}, "payslip", false},
+		{"data types only", &DataRequest{DataTypes: []string{"identity"}}, "payslip", true},
+		{"blank reference ID", &DataRequest{ReferenceIDs: []string{"passport"}}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.requests, tt.request.Requests(tt.referenceID))
+		})
+	}
+}
+
+func TestDataRequestExpired(t *testing.T) {
+	request := &DataRequest{Deadline: "2031-05-01T00:00:00.000Z"}
+
+	tests := []struct {
+		name    string
+		request *DataRequest
+		at      string
+		expired bool
+	}{
+		{"before the deadline", request, "2031-04-30T23:59:59.999Z", false},
+		{"at the deadline", request, "2031-05-01T00:00:00.000Z", true},
+		{"after the deadline", request, "2032-01-01T00:00:00.000Z", true},
+		{"no deadline", &DataRequest{}, "2032-01-01T00:00:00.000Z", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expired, tt.request.Expired(tt.at))
+		})
+	}
+}
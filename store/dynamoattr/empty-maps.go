@@ -0,0 +1,39 @@
+// Package dynamoattr has helpers for items marshalled with dynamodbattribute
+package dynamoattr
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"strings"
+)
+
+// MarshalMapWithEmptyMaps marshals in like dynamodbattribute.MarshalMap, but stores the nil or empty maps at
+// paths (e.g. "request.approvals") as empty maps. The marshaller stores them as NULL, and entries of a NULL
+// attribute cannot be set in place (SET request.approvals.<id>).
+func MarshalMapWithEmptyMaps(in interface{}, paths ...string) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(in)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		names := strings.Split(path, ".")
+		parent := item
+		for _, name := range names[:len(names)-1] {
+			av, ok := parent[name]
+			if !ok || av.M == nil {
+				return nil, errors.New("no map at " + name + " of " + path)
+			}
+			parent = av.M
+		}
+
+		last := names[len(names)-1]
+		if av, ok := parent[last]; !ok || av.M == nil {
+			parent[last] = &dynamodb.AttributeValue{
+				M: map[string]*dynamodb.AttributeValue{},
+			}
+		}
+	}
+	return item, nil
+}
@@ -0,0 +1,70 @@
+package dynamoattr
+
+import (
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+type approval struct {
+	Signer string `json:"signer"`
+}
+
+type request struct {
+	RequestID string               `json:"requestId"`
+	Approvals map[string]*approval `json:"approvals"`
+}
+
+type item struct {
+	RequestID string   `json:"requestId"`
+	Request   *request `json:"request"`
+}
+
+func TestMarshalMapWithEmptyMaps(t *testing.T) {
+	tests := []struct {
+		name      string
+		approvals map[string]*approval
+		path      string
+		entries   []string
+		wantErr   bool
+	}{
+		{"nil map", nil, "request.approvals", nil, false},
+		{"empty map", map[string]*approval{}, "request.approvals", nil, false},
+		{"one entry kept", map[string]*approval{"s1": {Signer: "s1"}}, "request.approvals", []string{"s1"}, false},
+		{"missing top level map", nil, "extra", nil, false},
+		{"no parent map", nil, "other.approvals", nil, true},
+		{"parent not a map", nil, "requestId.approvals", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalMapWithEmptyMaps(&item{
+				RequestID: "r1",
+				Request: &request{
+					RequestID: "r1",
+					Approvals: tt.approvals,
+				},
+			}, tt.path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			av := &dynamodb.AttributeValue{M: got}
+			for _, name := range strings.Split(tt.path, ".") {
+				av = av.M[name]
+			}
+
+			// entries can only be set in place on an M, not on NULL
+			assert.Nil(t, av.NULL)
+			assert.NotNil(t, av.M)
+			var entries []string
+			for k := range av.M {
+				entries = append(entries, k)
+			}
+			assert.ElementsMatch(t, tt.entries, entries)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package lockouts
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"strconv"
+)
+
+const (
+	lockoutTable = "wallet-lockouts"
+)
+
+// DynamoLockoutStore keeps lockouts keyed "tenant/wallet#source" and tenant failure counts keyed "tenant#failures#window",
+// both expiring with the table's TTL attribute
+type DynamoLockoutStore struct {
+	db *dynamodb.DynamoDB
+}
+
+// DynamoLockout keeps the lockout's attributes at the top level, so failures can be counted with ADD
+type DynamoLockout struct {
+	LockoutKey string `json:"lockoutKey"`
+	Lockout
+	TTL int64 `json:"ttl"`
+}
+
+func NewDynamoLockoutStore(db *dynamodb.DynamoDB) *DynamoLockoutStore {
+	return &DynamoLockoutStore{
+		db: db,
+	}
+}
+
+func lockoutKey(key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"lockoutKey": {
+			S: aws.String(key),
+		},
+	}
+}
+
+func walletLockoutKey(tenantID, walletID, source string) string {
+	return fmt.Sprintf("%s/%s#%s", tenantID, walletID, source)
+}
+
+func (s *DynamoLockoutStore) GetLockout(ctx context.Context, tenantID, walletID, source string) (*Lockout, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(lockoutTable),
+		Key:            lockoutKey(walletLockoutKey(tenantID, walletID, source)),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Item == nil {
+		return nil, nil
+	}
+
+	var item DynamoLockout
+	err = dynamodbattribute.UnmarshalMap(res.Item, &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item.Lockout, nil
+}
+
+// AddFailure adds one to the recent failures with a conditional ADD, or starts them over with a conditional put
+// when the last failure is before since (or there is none). Either may lose to a concurrent failure, then the other
+// one is tried again.
+func (s *DynamoLockoutStore) AddFailure(ctx context.Context, tenantID, walletID, source, at, since string, expiresAt int64) (*Lockout, error) {
+	key := walletLockoutKey(tenantID, walletID, source)
+	for attempt := 0; attempt < 3; attempt++ {
+		lockout, err := s.countFailure(ctx, key, at, since, expiresAt)
+		if err == nil || !isConditionFailed(err) {
+			return lockout, err
+		}
+
+		lockout = &Lockout{
+			TenantID:      tenantID,
+			WalletID:      walletID,
+			Source:        source,
+			Failures:      1,
+			LastFailureAt: at,
+		}
+		err = s.startFailures(ctx, key, lockout, since, expiresAt)
+		if err == nil || !isConditionFailed(err) {
+			return lockout, err
+		}
+	}
+	return nil, fmt.Errorf("failure of wallet %s/%s not counted: too many concurrent failures", tenantID, walletID)
+}
+
+func (s *DynamoLockoutStore) countFailure(ctx context.Context, key, at, since string, expiresAt int64) (*Lockout, error) {
+	update := expression.Add(expression.Name("failures"), expression.Value(1)).
+		Set(expression.Name("lastFailureAt"), expression.Value(at)).
+		Set(expression.Name("ttl"), expression.Value(expiresAt))
+	cond := expression.Name("lastFailureAt").GreaterThanEqual(expression.Value(since))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(lockoutTable),
+		Key:                       lockoutKey(key),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var item DynamoLockout
+	err = dynamodbattribute.UnmarshalMap(res.Attributes, &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item.Lockout, nil
+}
+
+func (s *DynamoLockoutStore) startFailures(ctx context.Context, key string, lockout *Lockout, since string, expiresAt int64) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoLockout{
+		LockoutKey: key,
+		Lockout:    *lockout,
+		TTL:        expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	cond := expression.AttributeNotExists(expression.Name("lockoutKey")).
+		Or(expression.Name("lastFailureAt").LessThan(expression.Value(since)))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(lockoutTable),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+func (s *DynamoLockoutStore) DeleteLockout(ctx context.Context, tenantID, walletID, source string) error {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(lockoutTable),
+		Key:       lockoutKey(walletLockoutKey(tenantID, walletID, source)),
+	})
+	return err
+}
+
+func (s *DynamoLockoutStore) CountTenantFailure(ctx context.Context, tenantID, window string, expiresAt int64) (int64, error) {
+	update := expression.Add(expression.Name("failures"), expression.Value(1)).
+		Set(expression.Name("ttl"), expression.Value(expiresAt))
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(lockoutTable),
+		Key:                       lockoutKey(fmt.Sprintf("%s#failures#%s", tenantID, window)),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	failures, ok := res.Attributes["failures"]
+	if !ok || failures.N == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(*failures.N, 10, 64)
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
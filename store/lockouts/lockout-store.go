@@ -0,0 +1,34 @@
+package lockouts
+
+import (
+	"context"
+)
+
+// Lockout counts the recent signature failures of a wallet from one source, and when it may be tried again
+type Lockout struct {
+	TenantID      string `json:"tenantId"`
+	WalletID      string `json:"walletId"`
+	Source        string `json:"source"`
+	Failures      int    `json:"failures"`
+	LastFailureAt string `json:"lastFailureAt"`
+
+	// LockedUntil is when signatures are checked again (format: 2006-01-02T15:04:05.000Z), blank if not locked
+	LockedUntil string `json:"lockedUntil,omitempty"`
+}
+
+// Locked is true while signatures of the wallet are refused
+func (l *Lockout) Locked(at string) bool {
+	return l.LockedUntil != "" && at < l.LockedUntil
+}
+
+type LockoutStore interface {
+	// GetLockout returns the wallet's lockout for the source, or nil if it has no recent failures from it
+	GetLockout(ctx context.Context, tenantID, walletID, source string) (*Lockout, error)
+	// AddFailure counts a failure at the time given and returns the lockout; failures before since are forgotten.
+	// The lockout is kept until expiresAt (unix time).
+	AddFailure(ctx context.Context, tenantID, walletID, source, at, since string, expiresAt int64) (*Lockout, error)
+	DeleteLockout(ctx context.Context, tenantID, walletID, source string) error
+
+	// CountTenantFailure adds a failure to the tenant's count for the window and returns the count
+	CountTenantFailure(ctx context.Context, tenantID, window string, expiresAt int64) (int64, error)
+}
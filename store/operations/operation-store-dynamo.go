@@ -0,0 +1,187 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/citizendata/datawallet/wallet-api/store/dynamoattr"
+)
+
+const (
+	operationTable       = "wallet-operations"
+	operationWalletIndex = "walletId-createdAt-index"
+)
+
+type DynamoOperationStore struct {
+	db *dynamodb.DynamoDB
+}
+
+type DynamoOperation struct {
+	OperationID string     `json:"operationId"`
+	WalletID    string     `json:"walletId"`
+	CreatedAt   string     `json:"createdAt"`
+	Operation   *Operation `json:"operation"`
+}
+
+func NewDynamoOperationStore(db *dynamodb.DynamoDB) *DynamoOperationStore {
+	return &DynamoOperationStore{
+		db: db,
+	}
+}
+
+func (s *DynamoOperationStore) CreateOperation(ctx context.Context, operation *Operation) error {
+	// approvals are set in place (operation.approvals.<signer>)
+	item, err := dynamoattr.MarshalMapWithEmptyMaps(&DynamoOperation{
+		OperationID: operation.OperationID,
+		WalletID:    fmt.Sprintf("%s/%s", operation.TenantID, operation.WalletID),
+		CreatedAt:   operation.CreatedAt,
+		Operation:   operation,
+	}, "operation.approvals")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(operationTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoOperationStore) GetOperation(ctx context.Context, operationID string) (*Operation, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(operationTable),
+		Key:       operationKey(operationID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalOperation(res.Item)
+}
+
+func (s *DynamoOperationStore) ListOperations(ctx context.Context, tenantID, walletID string) ([]*Operation, error) {
+	key := expression.Key("walletId").Equal(expression.Value(fmt.Sprintf("%s/%s", tenantID, walletID)))
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []*Operation
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(operationTable),
+		IndexName:                 aws.String(operationWalletIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				if op, err := unmarshalOperation(item); err == nil {
+					ops = append(ops, op)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return ops, nil
+}
+
+func (s *DynamoOperationStore) AddApproval(ctx context.Context, operationID string, approval *Approval) (*Operation, error) {
+	name := expression.Name("operation.approvals." + approval.Signer)
+	update := expression.Set(name, expression.Value(approval))
+	cond := expression.Name("operation.status").Equal(expression.Value(StatusPending)).And(name.AttributeNotExists())
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(operationTable),
+		Key:                       operationKey(operationID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if isConditionFailed(err) {
+		op, err := s.GetOperation(ctx, operationID)
+		if err != nil {
+			return nil, err
+		}
+		if op.Status != StatusPending {
+			return nil, ErrNotPending
+		}
+		return nil, ErrAlreadyApproved
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalOperation(res.Attributes)
+}
+
+func (s *DynamoOperationStore) ClaimOperation(ctx context.Context, operationID string) error {
+	return s.setStatus(ctx, operationID, StatusPending, expression.Set(expression.Name("operation.status"), expression.Value(StatusExecuting)))
+}
+
+func (s *DynamoOperationStore) FinishOperation(ctx context.Context, operationID, status string, statusCode int, body string) error {
+	update := expression.Set(expression.Name("operation.status"), expression.Value(status)).
+		Set(expression.Name("operation.resultStatusCode"), expression.Value(statusCode)).
+		Set(expression.Name("operation.resultBody"), expression.Value(body))
+	return s.setStatus(ctx, operationID, StatusExecuting, update)
+}
+
+// setStatus applies the update if the operation is in status from
+func (s *DynamoOperationStore) setStatus(ctx context.Context, operationID, from string, update expression.UpdateBuilder) error {
+	cond := expression.Name("operation.status").Equal(expression.Value(from))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(operationTable),
+		Key:                       operationKey(operationID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConditionFailed(err) {
+		return ErrNotPending
+	}
+	return err
+}
+
+func operationKey(operationID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"operationId": {
+			S: aws.String(operationID),
+		},
+	}
+}
+
+func unmarshalOperation(item map[string]*dynamodb.AttributeValue) (*Operation, error) {
+	var do DynamoOperation
+	err := dynamodbattribute.UnmarshalMap(item, &do)
+	if err != nil {
+		return nil, err
+	}
+	if do.Operation == nil {
+		return nil, ErrNotFound
+	}
+	return do.Operation, nil
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,80 @@
+package operations
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusExecuting = "executing"
+	StatusExecuted  = "executed"
+	StatusFailed    = "failed"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrAlreadyApproved = errors.New("already approved")
+	ErrNotPending      = errors.New("operation is not pending")
+)
+
+// Operation is a sensitive wallet operation held until enough co-signers approve it
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	TenantID    string               `json:"tenantId"`
+	WalletID    string               `json:"walletId"`
+	Type        string               `json:"type"`
+	Request     *Request             `json:"request"`
+	Threshold   int                  `json:"threshold"`
+	Signers     []string             `json:"signers"`
+	Approvals   map[string]*Approval `json:"approvals"`
+	Status      string               `json:"status"`
+	CreatedAt   string               `json:"createdAt"`
+	ExpiresAt   int64                `json:"expiresAt"`
+
+	// ResultStatusCode and ResultBody are the response of the execution
+	ResultStatusCode int    `json:"resultStatusCode,omitempty"`
+	ResultBody       string `json:"resultBody,omitempty"`
+}
+
+// Request is the original (already authorized) request, replayed on execution
+type Request struct {
+	Method         string            `json:"method"`
+	PathParams     map[string]string `json:"pathParams"`
+	QueryParams    map[string]string `json:"queryParams,omitempty"`
+	Body           string            `json:"body"`
+	RequestTimeUTC string            `json:"requestTimeUtc"`
+	WalletID       string            `json:"walletId"`
+	DeviceID       string            `json:"deviceId"`
+
+	// DataRequestID is the data request a share answers
+	DataRequestID string `json:"dataRequestId,omitempty"`
+}
+
+// Approval of a co-signer, keyed by the policy signer it matched
+type Approval struct {
+	Signer     string `json:"signer"`
+	WalletID   string `json:"walletId"`
+	DeviceID   string `json:"deviceId"`
+	ApprovedAt string `json:"approvedAt"`
+}
+
+func (o *Operation) Approved() bool {
+	return len(o.Approvals) >= o.Threshold
+}
+
+type OperationList struct {
+	Operations []*Operation `json:"operations"`
+}
+
+type OperationStore interface {
+	CreateOperation(ctx context.Context, operation *Operation) error
+	GetOperation(ctx context.Context, operationID string) (*Operation, error)
+	// ListOperations returns the wallet's operations, newest first
+	ListOperations(ctx context.Context, tenantID, walletID string) ([]*Operation, error)
+	// AddApproval adds the approval of a pending operation and returns the operation after the update
+	AddApproval(ctx context.Context, operationID string, approval *Approval) (*Operation, error)
+	// ClaimOperation moves a pending operation to executing so it only runs once, or returns ErrNotPending
+	ClaimOperation(ctx context.Context, operationID string) error
+	FinishOperation(ctx context.Context, operationID, status string, statusCode int, body string) error
+}
@@ -0,0 +1,268 @@
+package recoveries
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/citizendata/datawallet/wallet-api/store/dynamoattr"
+	"github.com/google/uuid"
+)
+
+const (
+	challengeTable = "wallet-recovery-challenges"
+	requestTable   = "wallet-recovery-requests"
+	eventTable     = "wallet-recovery-events"
+)
+
+type DynamoRecoveryStore struct {
+	db *dynamodb.DynamoDB
+}
+
+type DynamoChallenge struct {
+	ChallengeID string     `json:"challengeId"`
+	Challenge   *Challenge `json:"challenge"`
+	TTL         int64      `json:"ttl"`
+}
+
+type DynamoSocialRequest struct {
+	RequestID string         `json:"requestId"`
+	Request   *SocialRequest `json:"request"`
+	TTL       int64          `json:"ttl"`
+}
+
+type DynamoEvent struct {
+	WalletID string `json:"walletId"`
+	EventKey string `json:"eventKey"`
+	Event    *Event `json:"event"`
+}
+
+func NewDynamoRecoveryStore(db *dynamodb.DynamoDB) *DynamoRecoveryStore {
+	return &DynamoRecoveryStore{
+		db: db,
+	}
+}
+
+func (s *DynamoRecoveryStore) CreateChallenge(ctx context.Context, challenge *Challenge) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoChallenge{
+		ChallengeID: challenge.ChallengeID,
+		Challenge:   challenge,
+		TTL:         challenge.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(challengeTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoRecoveryStore) GetChallenge(ctx context.Context, challengeID string) (*Challenge, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(challengeTable),
+		Key:       challengeKey(challengeID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalChallenge(res.Item)
+}
+
+func (s *DynamoRecoveryStore) AddAttempt(ctx context.Context, challengeID string) (*Challenge, error) {
+	update := expression.Add(expression.Name("challenge.attempts"), expression.Value(1))
+	cond := expression.Name("challengeId").AttributeExists()
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(challengeTable),
+		Key:                       challengeKey(challengeID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if isConditionFailed(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalChallenge(res.Attributes)
+}
+
+func (s *DynamoRecoveryStore) CompleteChallenge(ctx context.Context, challengeID, completedAt string) error {
+	update := expression.Set(expression.Name("challenge.completedAt"), expression.Value(completedAt))
+	cond := expression.Name("challengeId").AttributeExists().And(expression.Name("challenge.completedAt").AttributeNotExists())
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(challengeTable),
+		Key:                       challengeKey(challengeID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConditionFailed(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *DynamoRecoveryStore) CreateSocialRequest(ctx context.Context, request *SocialRequest) error {
+	// approvals are set in place (request.approvals.<guardian>)
+	item, err := dynamoattr.MarshalMapWithEmptyMaps(&DynamoSocialRequest{
+		RequestID: request.RequestID,
+		Request:   request,
+		TTL:       request.ExpiresAt,
+	}, "request.approvals")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(requestTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoRecoveryStore) GetSocialRequest(ctx context.Context, requestID string) (*SocialRequest, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(requestTable),
+		Key:       requestKey(requestID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var dr DynamoSocialRequest
+	err = dynamodbattribute.UnmarshalMap(res.Item, &dr)
+	if err != nil {
+		return nil, err
+	}
+	if dr.Request == nil {
+		return nil, ErrNotFound
+	}
+	return dr.Request, nil
+}
+
+func (s *DynamoRecoveryStore) AddApproval(ctx context.Context, requestID string, approval *GuardianApproval) error {
+	name := expression.Name("request.approvals." + approval.GuardianID)
+	update := expression.Set(name, expression.Value(approval))
+	cond := expression.Name("requestId").AttributeExists().And(name.AttributeNotExists())
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(requestTable),
+		Key:                       requestKey(requestID),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if isConditionFailed(err) {
+		return ErrAlreadyApproved
+	}
+	return err
+}
+
+func (s *DynamoRecoveryStore) RecordEvent(ctx context.Context, event *Event) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoEvent{
+		WalletID: fmt.Sprintf("%s/%s", event.TenantID, event.WalletID),
+		EventKey: fmt.Sprintf("%s/%s", event.CreatedAt, uuid.New().String()),
+		Event:    event,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(eventTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoRecoveryStore) ListEvents(ctx context.Context, tenantID, walletID, since string) ([]*Event, error) {
+	key := expression.Key("walletId").Equal(expression.Value(fmt.Sprintf("%s/%s", tenantID, walletID)))
+	// key values cannot be blank, without since all events are listed
+	if since != "" {
+		key = key.And(expression.Key("eventKey").GreaterThanEqual(expression.Value(since)))
+	}
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*Event
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(eventTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var de DynamoEvent
+				if dynamodbattribute.UnmarshalMap(item, &de) == nil && de.Event != nil {
+					events = append(events, de.Event)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func challengeKey(challengeID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"challengeId": {
+			S: aws.String(challengeID),
+		},
+	}
+}
+
+func requestKey(requestID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"requestId": {
+			S: aws.String(requestID),
+		},
+	}
+}
+
+func unmarshalChallenge(item map[string]*dynamodb.AttributeValue) (*Challenge, error) {
+	var dc DynamoChallenge
+	err := dynamodbattribute.UnmarshalMap(item, &dc)
+	if err != nil {
+		return nil, err
+	}
+	if dc.Challenge == nil {
+		return nil, ErrNotFound
+	}
+	return dc.Challenge, nil
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,100 @@
+package recoveries
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	EventChallengeStarted = "challenge-started"
+	EventVerifyFailed     = "verify-failed"
+	EventRateLimited      = "rate-limited"
+	EventRecovered        = "recovered"
+
+	EventSocialStarted    = "social-started"
+	EventGuardianApproved = "guardian-approved"
+	EventSharesReleased   = "shares-released"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrAlreadyApproved = errors.New("already approved")
+)
+
+// Challenge is a pending recovery of a wallet, verified with the tenant's second factor
+type Challenge struct {
+	ChallengeID string `json:"challengeId"`
+	TenantID    string `json:"tenantId"`
+	WalletID    string `json:"walletId"`
+	Verifier    string `json:"verifier"`
+	State       string `json:"state"`
+	CreatedAt   string `json:"createdAt"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	Attempts    int    `json:"attempts"`
+	CompletedAt string `json:"completedAt,omitempty"`
+}
+
+// Event records every step of a recovery
+type Event struct {
+	TenantID    string `json:"tenantId"`
+	WalletID    string `json:"walletId"`
+	Type        string `json:"type"`
+	ChallengeID string `json:"challengeId,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+	SourceIP    string `json:"sourceIp,omitempty"`
+}
+
+// SocialRequest is a recovery approved by the wallet's guardians, each approval carries the guardian's
+// share encrypted to PublicKeyBase64 (a temporary key of the requester)
+type SocialRequest struct {
+	RequestID       string                       `json:"requestId"`
+	TenantID        string                       `json:"tenantId"`
+	WalletID        string                       `json:"walletId"`
+	PublicKeyBase64 string                       `json:"publicKeyBase64"`
+	Threshold       int                          `json:"threshold"`
+	Guardians       []string                     `json:"guardians"`
+	Approvals       map[string]*GuardianApproval `json:"approvals"`
+	CreatedAt       string                       `json:"createdAt"`
+	ExpiresAt       int64                        `json:"expiresAt"`
+}
+
+type GuardianApproval struct {
+	GuardianID     string `json:"guardianId"`
+	DeviceID       string `json:"deviceId"`
+	EncryptedShare string `json:"encryptedShare"`
+	ApprovedAt     string `json:"approvedAt"`
+}
+
+// Approved is true once enough guardians approved
+func (r *SocialRequest) Approved() bool {
+	return len(r.Approvals) >= r.Threshold
+}
+
+func (r *SocialRequest) IsGuardian(walletID string) bool {
+	for _, g := range r.Guardians {
+		if g == walletID {
+			return true
+		}
+	}
+	return false
+}
+
+type EventList struct {
+	Events []*Event `json:"events"`
+}
+
+type RecoveryStore interface {
+	CreateChallenge(ctx context.Context, challenge *Challenge) error
+	GetChallenge(ctx context.Context, challengeID string) (*Challenge, error)
+	// AddAttempt atomically counts a verification attempt and returns the challenge after the update
+	AddAttempt(ctx context.Context, challengeID string) (*Challenge, error)
+	// CompleteChallenge marks the challenge as used, or returns ErrNotFound if it already was
+	CompleteChallenge(ctx context.Context, challengeID, completedAt string) error
+	CreateSocialRequest(ctx context.Context, request *SocialRequest) error
+	GetSocialRequest(ctx context.Context, requestID string) (*SocialRequest, error)
+	// AddApproval adds a guardian's approval, or returns ErrAlreadyApproved if it already approved
+	AddApproval(ctx context.Context, requestID string, approval *GuardianApproval) error
+	RecordEvent(ctx context.Context, event *Event) error
+	// ListEvents returns the wallet's events created at or after since, oldest first
+	ListEvents(ctx context.Context, tenantID, walletID, since string) ([]*Event, error)
+}
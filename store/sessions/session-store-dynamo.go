@@ -0,0 +1,208 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"time"
+)
+
+const (
+	sessionTable       = "wallet-sessions"
+	challengeTable     = "wallet-challenges"
+	sessionWalletIndex = "walletId-createdAt-index"
+)
+
+type DynamoSessionStore struct {
+	db *dynamodb.DynamoDB
+}
+
+type DynamoChallenge struct {
+	ChallengeID string     `json:"challengeId"`
+	Challenge   *Challenge `json:"challenge"`
+	TTL         int64      `json:"ttl"`
+}
+
+type DynamoSession struct {
+	SessionID string   `json:"sessionId"`
+	WalletID  string   `json:"walletId"`
+	CreatedAt int64    `json:"createdAt"`
+	Session   *Session `json:"session"`
+	TTL       int64    `json:"ttl"`
+}
+
+func NewDynamoSessionStore(db *dynamodb.DynamoDB) *DynamoSessionStore {
+	return &DynamoSessionStore{
+		db: db,
+	}
+}
+
+func (s *DynamoSessionStore) CreateChallenge(ctx context.Context, challenge *Challenge) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoChallenge{
+		ChallengeID: challenge.ChallengeID,
+		Challenge:   challenge,
+		TTL:         challenge.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(challengeTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoSessionStore) ConsumeChallenge(ctx context.Context, tenantID, walletID, challengeID string) (*Challenge, error) {
+	// only the wallet the challenge was issued to can use it up
+	cond := expression.Name("challenge.tenantId").Equal(expression.Value(tenantID)).
+		And(expression.Name("challenge.walletId").Equal(expression.Value(walletID)))
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(challengeTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"challengeId": {
+				S: aws.String(challengeID),
+			},
+		},
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if aerr, ok := err.(interface{ Code() string }); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dc DynamoChallenge
+	err = dynamodbattribute.UnmarshalMap(res.Attributes, &dc)
+	if err != nil {
+		return nil, err
+	}
+	if dc.Challenge == nil {
+		return nil, ErrNotFound
+	}
+
+	return dc.Challenge, nil
+}
+
+func (s *DynamoSessionStore) CreateSession(ctx context.Context, session *Session) error {
+	item, err := dynamodbattribute.MarshalMap(&DynamoSession{
+		SessionID: session.SessionID,
+		WalletID:  fmt.Sprintf("%s/%s", session.TenantID, session.WalletID),
+		CreatedAt: session.CreatedAt,
+		Session:   session,
+		TTL:       session.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(sessionTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoSessionStore) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(sessionTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"sessionId": {
+				S: aws.String(sessionID),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ds DynamoSession
+	err = dynamodbattribute.UnmarshalMap(res.Item, &ds)
+	if err != nil {
+		return nil, err
+	}
+	if ds.Session == nil {
+		return nil, ErrNotFound
+	}
+
+	return ds.Session, nil
+}
+
+func (s *DynamoSessionStore) RevokeSession(ctx context.Context, tenantID, walletID, sessionID string) error {
+	update := expression.Set(expression.Name("session.revokedAt"), expression.Value(time.Now().UTC().Unix()))
+	cond := expression.Name("walletId").Equal(expression.Value(fmt.Sprintf("%s/%s", tenantID, walletID)))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(sessionTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"sessionId": {
+				S: aws.String(sessionID),
+			},
+		},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+
+	if aerr, ok := err.(interface{ Code() string }); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *DynamoSessionStore) RevokeAllSessions(ctx context.Context, tenantID, walletID string) error {
+	key := expression.Key("walletId").Equal(expression.Value(fmt.Sprintf("%s/%s", tenantID, walletID)))
+	proj := expression.NamesList(expression.Name("sessionId"))
+	expr, err := expression.NewBuilder().WithKeyCondition(key).WithProjection(proj).Build()
+	if err != nil {
+		return err
+	}
+
+	var sessionIDs []string
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(sessionTable),
+		IndexName:                 aws.String(sessionWalletIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ProjectionExpression:      expr.Projection(),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var ds DynamoSession
+				if dynamodbattribute.UnmarshalMap(item, &ds) == nil {
+					sessionIDs = append(sessionIDs, ds.SessionID)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		err = s.RevokeSession(ctx, tenantID, walletID, sessionID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
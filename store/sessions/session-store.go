@@ -0,0 +1,44 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+)
+
+// Challenge is a single-use nonce a wallet signs to start a session
+type Challenge struct {
+	ChallengeID string `json:"challengeId"`
+	TenantID    string `json:"tenantId"`
+	WalletID    string `json:"walletId"`
+	Challenge   string `json:"challenge"`
+	ExpiresAt   int64  `json:"expiresAt"`
+}
+
+// Session is a short-lived login backing a session token (the token ID is SessionID)
+type Session struct {
+	SessionID string `json:"sessionId"`
+	TenantID  string `json:"tenantId"`
+	WalletID  string `json:"walletId"`
+	DeviceID  string `json:"deviceId,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	RevokedAt int64  `json:"revokedAt,omitempty"`
+}
+
+func (s *Session) Revoked() bool {
+	return s.RevokedAt != 0
+}
+
+type SessionStore interface {
+	CreateChallenge(ctx context.Context, challenge *Challenge) error
+	// ConsumeChallenge returns and deletes the challenge so it can only be used once, by the wallet it was issued to
+	ConsumeChallenge(ctx context.Context, tenantID, walletID, challengeID string) (*Challenge, error)
+	CreateSession(ctx context.Context, session *Session) error
+	GetSession(ctx context.Context, sessionID string) (*Session, error)
+	RevokeSession(ctx context.Context, tenantID, walletID, sessionID string) error
+	RevokeAllSessions(ctx context.Context, tenantID, walletID string) error
+}
@@ -0,0 +1,61 @@
+package tenants
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/apigateway"
+)
+
+type AWSGatewayKeys struct {
+	svc         *apigateway.APIGateway
+	usagePlanID string
+}
+
+func NewAWSGatewayKeys(svc *apigateway.APIGateway, usagePlanID string) *AWSGatewayKeys {
+	return &AWSGatewayKeys{
+		svc:         svc,
+		usagePlanID: usagePlanID,
+	}
+}
+
+func (g *AWSGatewayKeys) Register(ctx context.Context, name, value string) (string, error) {
+	key, err := g.svc.CreateApiKeyWithContext(ctx, &apigateway.CreateApiKeyInput{
+		Name:    aws.String(name),
+		Value:   aws.String(value),
+		Enabled: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = g.svc.CreateUsagePlanKeyWithContext(ctx, &apigateway.CreateUsagePlanKeyInput{
+		KeyId:       key.Id,
+		KeyType:     aws.String("API_KEY"),
+		UsagePlanId: aws.String(g.usagePlanID),
+	})
+	if err != nil {
+		g.Deregister(ctx, aws.StringValue(key.Id))
+		return "", err
+	}
+
+	return aws.StringValue(key.Id), nil
+}
+
+func (g *AWSGatewayKeys) Disable(ctx context.Context, gatewayKeyID string) error {
+	_, err := g.svc.UpdateApiKeyWithContext(ctx, &apigateway.UpdateApiKeyInput{
+		ApiKey: aws.String(gatewayKeyID),
+		PatchOperations: []*apigateway.PatchOperation{{
+			Op:    aws.String(apigateway.OpReplace),
+			Path:  aws.String("/enabled"),
+			Value: aws.String("false"),
+		}},
+	})
+	return err
+}
+
+func (g *AWSGatewayKeys) Deregister(ctx context.Context, gatewayKeyID string) error {
+	_, err := g.svc.DeleteApiKeyWithContext(ctx, &apigateway.DeleteApiKeyInput{
+		ApiKey: aws.String(gatewayKeyID),
+	})
+	return err
+}
@@ -0,0 +1,179 @@
+package tenants
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/citizendata/datawallet/wallet-api/ratelimit"
+	"github.com/citizendata/datawallet/wallet-api/store/usage"
+	"sync"
+	"time"
+)
+
+// maxCachedKeys bounds the cache, a flood of distinct keys must not grow a warm instance's memory
+const maxCachedKeys = 1000
+
+// TenantCache holds looked up API keys across warm invocations, it is safe for concurrent use
+type TenantCache struct {
+	ttl  time.Duration
+	mu   sync.Mutex
+	keys map[string]*cachedKey
+}
+
+type cachedKey struct {
+	key     ApiKey
+	expires time.Time
+}
+
+func NewTenantCache(ttl time.Duration) *TenantCache {
+	return &TenantCache{
+		ttl:  ttl,
+		keys: map[string]*cachedKey{},
+	}
+}
+
+// CachedTenantStore caches key lookups of a TenantStore for the cache's TTL. Revocations and tenant changes made
+// through the store drop the affected keys, those made by another function are seen once the TTL has passed.
+// What is saved is the key's HMAC, the read and the last-used write.
+type CachedTenantStore struct {
+	TenantStore
+	cache *TenantCache
+}
+
+func NewCachedTenantStore(store TenantStore, cache *TenantCache) *CachedTenantStore {
+	return &CachedTenantStore{
+		TenantStore: store,
+		cache:       cache,
+	}
+}
+
+// cacheID identifies a key without keeping its value in memory
+func cacheID(apikey string) string {
+	sum := sha256.Sum256([]byte(apikey))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *CachedTenantStore) GetTenantId(ctx context.Context, apikey string) (string, error) {
+	tenant, err := t.GetTenant(ctx, apikey)
+	if err != nil {
+		return "", err
+	}
+	return tenant.TenantId, nil
+}
+
+func (t *CachedTenantStore) GetTenant(ctx context.Context, apikey string) (*Tenant, error) {
+	key, err := t.LookupApiKey(ctx, apikey)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.CheckTenant(); err != nil {
+		return nil, err
+	}
+
+	return &Tenant{
+		TenantId:         key.TenantId,
+		Name:             key.TenantName,
+		Status:           key.TenantStatus,
+		Quotas:           key.TenantQuotas,
+		RateLimits:       key.TenantRateLimits,
+		RecoveryVerifier: key.RecoveryVerifier,
+	}, nil
+}
+
+func (t *CachedTenantStore) LookupApiKey(ctx context.Context, apikey string) (*ApiKey, error) {
+	id := cacheID(apikey)
+	now := time.Now().UTC()
+
+	t.cache.mu.Lock()
+	cached, ok := t.cache.keys[id]
+	t.cache.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		key := cached.key
+		// the key may have expired, or reached the end of a rotation's grace period, since it was cached
+		if key.RevokedAt != "" && key.RevokedAt <= now.Format(timestampLayout) {
+			return &key, ErrKeyRevoked
+		}
+		if key.ExpiresAt != "" && key.ExpiresAt <= now.Format(timestampLayout) {
+			return nil, ErrKeyExpired
+		}
+		return &key, nil
+	}
+
+	key, err := t.TenantStore.LookupApiKey(ctx, apikey)
+	if err != nil {
+		return key, err
+	}
+
+	t.cache.mu.Lock()
+	if len(t.cache.keys) >= maxCachedKeys {
+		t.cache.evict(now)
+	}
+	t.cache.keys[id] = &cachedKey{
+		key:     *key,
+		expires: now.Add(t.cache.ttl),
+	}
+	t.cache.mu.Unlock()
+
+	return key, nil
+}
+
+func (t *CachedTenantStore) SetTenantStatus(ctx context.Context, tenantID, status string) error {
+	err := t.TenantStore.SetTenantStatus(ctx, tenantID, status)
+	t.invalidate(func(k *ApiKey) bool {
+		return k.TenantId == tenantID
+	})
+	return err
+}
+
+func (t *CachedTenantStore) SetTenantQuotas(ctx context.Context, tenantID string, quotas *usage.Quotas) error {
+	err := t.TenantStore.SetTenantQuotas(ctx, tenantID, quotas)
+	t.invalidate(func(k *ApiKey) bool {
+		return k.TenantId == tenantID
+	})
+	return err
+}
+
+func (t *CachedTenantStore) SetTenantRateLimits(ctx context.Context, tenantID string, limits *ratelimit.Limits) error {
+	err := t.TenantStore.SetTenantRateLimits(ctx, tenantID, limits)
+	t.invalidate(func(k *ApiKey) bool {
+		return k.TenantId == tenantID
+	})
+	return err
+}
+
+func (t *CachedTenantStore) RevokeApiKey(ctx context.Context, tenantID, keyID, revokedAt string) error {
+	err := t.TenantStore.RevokeApiKey(ctx, tenantID, keyID, revokedAt)
+	t.invalidate(func(k *ApiKey) bool {
+		return k.TenantId == tenantID && k.KeyID == keyID
+	})
+	return err
+}
+
+// invalidate drops the cached keys matching, and expired entries
+func (t *CachedTenantStore) invalidate(match func(k *ApiKey) bool) {
+	now := time.Now().UTC()
+
+	t.cache.mu.Lock()
+	defer t.cache.mu.Unlock()
+	for id, cached := range t.cache.keys {
+		if match(&cached.key) || now.After(cached.expires) {
+			delete(t.cache.keys, id)
+		}
+	}
+}
+
+// evict drops expired keys, or arbitrary ones if none has expired, to make room for one; mu must be held
+func (c *TenantCache) evict(now time.Time) {
+	for id, cached := range c.keys {
+		if now.After(cached.expires) {
+			delete(c.keys, id)
+		}
+	}
+	for id := range c.keys {
+		if len(c.keys) < maxCachedKeys {
+			break
+		}
+		delete(c.keys, id)
+	}
+}
@@ -2,50 +2,483 @@ package tenants
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"log"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"github.com/citizendata/datawallet/wallet-api/ratelimit"
+	"github.com/citizendata/datawallet/wallet-api/store/usage"
+	"github.com/google/uuid"
+	"time"
 )
 
+const (
+	apiKeyTable       = "tenant-api-keys"
+	apiKeyTenantIndex = "tenantId-index"
+	tenantTable       = "tenants"
+
+	// legacyApiKeyTable holds keys in plain text, they are moved to apiKeyTable on first use
+	legacyApiKeyTable = "apiKeys"
+
+	keyPrefixLength = 12
+
+	// lastUsedInterval limits how often a key's last-used time is written
+	lastUsedInterval = time.Minute
+
+	timestampLayout = "2006-01-02T15:04:05.000Z"
+)
+
+var errPrefixTaken = errors.New("key prefix taken")
+
 type DynamoTenantStore struct {
-	db *dynamodb.DynamoDB
+	db     *dynamodb.DynamoDB
+	pepper []byte
 }
 
-type Tenant struct {
-	Key string `json:"key"`
-	TenantId  string `json:"tenantId"`
-	Name string `json:"name"`
+// NewDynamoTenantStore creates a store hashing API keys with pepper (HMAC-SHA256)
+func NewDynamoTenantStore(db *dynamodb.DynamoDB, pepper []byte) *DynamoTenantStore {
+	return &DynamoTenantStore{
+		db:     db,
+		pepper: pepper,
+	}
 }
 
-func NewDynamoTenantStore(db *dynamodb.DynamoDB) *DynamoTenantStore {
-	return &DynamoTenantStore{
-		db: db,
+func keyPrefix(apikey string) string {
+	if len(apikey) > keyPrefixLength {
+		return apikey[:keyPrefixLength]
 	}
+	return apikey
+}
+
+// hasSecretSuffix is true if the key is longer than its prefix, a shorter key would be stored in plain text
+func hasSecretSuffix(apikey string) bool {
+	return len(apikey) > keyPrefixLength
+}
+
+// collisionPrefix stores a key whose prefix is already taken by another key (legacy keys were not random),
+// extended with the start of its hash
+func (t *DynamoTenantStore) collisionPrefix(apikey string) string {
+	return keyPrefix(apikey) + "~" + t.hashKey(apikey)[:16]
+}
+
+func (t *DynamoTenantStore) hashKey(apikey string) string {
+	mac := hmac.New(sha256.New, t.pepper)
+	mac.Write([]byte(apikey))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
 func (t *DynamoTenantStore) GetTenantId(ctx context.Context, apikey string) (string, error) {
-	res, err := t.db.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String("apiKeys"),
+	tenant, err := t.GetTenant(ctx, apikey)
+	if err != nil {
+		return "", err
+	}
+	return tenant.TenantId, nil
+}
+
+func (t *DynamoTenantStore) GetTenant(ctx context.Context, apikey string) (*Tenant, error) {
+	key, err := t.LookupApiKey(ctx, apikey)
+	if err != nil {
+		return nil, err
+	}
+	if err := key.CheckTenant(); err != nil {
+		return nil, err
+	}
+
+	return &Tenant{
+		TenantId:         key.TenantId,
+		Name:             key.TenantName,
+		Status:           key.TenantStatus,
+		Quotas:           key.TenantQuotas,
+		RateLimits:       key.TenantRateLimits,
+		RecoveryVerifier: key.RecoveryVerifier,
+	}, nil
+}
+
+func (t *DynamoTenantStore) LookupApiKey(ctx context.Context, apikey string) (*ApiKey, error) {
+	if apikey == "" {
+		return nil, ErrTenantNotFound
+	}
+
+	key, err := t.findApiKey(ctx, apikey)
+	if err == ErrNotFound {
+		key, err = t.migrateLegacyKey(ctx, apikey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if key.RevokedAt != "" && key.RevokedAt <= now.Format(timestampLayout) {
+		key.KeyHash = ""
+		return key, ErrKeyRevoked
+	}
+	if key.ExpiresAt != "" && key.ExpiresAt <= now.Format(timestampLayout) {
+		return nil, ErrKeyExpired
+	}
+
+	if key.LastUsedAt < now.Add(-lastUsedInterval).Format(timestampLayout) {
+		key.LastUsedAt = now.Format(timestampLayout)
+		err = t.updateApiKey(ctx, key.KeyPrefix, expression.Set(expression.Name("lastUsedAt"), expression.Value(key.LastUsedAt)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key.KeyHash = ""
+	return key, nil
+}
+
+// findApiKey returns the stored key matching apikey's hash, under its prefix or its collision prefix, or ErrNotFound
+func (t *DynamoTenantStore) findApiKey(ctx context.Context, apikey string) (*ApiKey, error) {
+	hash := t.hashKey(apikey)
+	for _, prefix := range []string{keyPrefix(apikey), t.collisionPrefix(apikey)} {
+		key, err := t.getApiKeyByPrefix(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if hmac.Equal([]byte(key.KeyHash), []byte(hash)) {
+			return key, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (t *DynamoTenantStore) getApiKeyByPrefix(ctx context.Context, prefix string) (*ApiKey, error) {
+	res, err := t.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(apiKeyTable),
 		Key: map[string]*dynamodb.AttributeValue{
-			"key": {
-				S: aws.String(apikey),
+			"keyPrefix": {
+				S: aws.String(prefix),
 			},
 		},
 	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Item == nil {
+		return nil, ErrNotFound
+	}
 
+	var key ApiKey
+	err = dynamodbattribute.UnmarshalMap(res.Item, &key)
 	if err != nil {
-		log.Fatal(err)
-		return "", err
+		return nil, err
 	}
+	return &key, nil
+}
 
-	var tenant Tenant
+// migrateLegacyKey moves a key stored in plain text to the hashed table. Legacy keys only have the tenant's ID and
+// name, the tenant is created if it has no row yet and the key takes its settings: its status, quotas and limits
+// are set on the tenant row while the key is still in the legacy table, setTenantAttribute only updates moved keys.
+func (t *DynamoTenantStore) migrateLegacyKey(ctx context.Context, apikey string) (*ApiKey, error) {
+	legacyKey := map[string]*dynamodb.AttributeValue{
+		"key": {
+			S: aws.String(apikey),
+		},
+	}
+	res, err := t.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(legacyApiKeyTable),
+		Key:       legacyKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Item == nil {
+		return nil, ErrTenantNotFound
+	}
+
+	var key ApiKey
+	err = dynamodbattribute.UnmarshalMap(res.Item, &key)
+	if err != nil {
+		return nil, err
+	}
+	if !hasSecretSuffix(apikey) {
+		return nil, ErrKeyTooShort
+	}
+	if key.KeyID == "" {
+		key.KeyID = uuid.New().String()
+	}
+
+	tenant, err := t.legacyTenant(ctx, key.TenantId, key.TenantName)
+	if err != nil {
+		return nil, err
+	}
+	key.TenantName = tenant.Name
+	key.TenantStatus = tenant.Status
+	key.TenantQuotas = tenant.Quotas
+	key.TenantRateLimits = tenant.RateLimits
+	key.RecoveryVerifier = tenant.RecoveryVerifier
+	key.Key = apikey
+
+	err = t.CreateApiKey(ctx, &key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(legacyApiKeyTable),
+		Key:       legacyKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key.Key = ""
+	return &key, nil
+}
+
+// legacyTenant returns the tenant of a legacy key, creating it (active) if it was never stored
+func (t *DynamoTenantStore) legacyTenant(ctx context.Context, tenantID, name string) (*Tenant, error) {
+	tenant, err := t.GetTenantByID(ctx, tenantID)
+	if err != ErrNotFound {
+		return tenant, err
+	}
+
+	tenant = &Tenant{
+		TenantId:  tenantID,
+		Name:      name,
+		Status:    TenantActive,
+		CreatedAt: time.Now().UTC().Format(timestampLayout),
+	}
+	err = t.CreateTenant(ctx, tenant)
+	if err == ErrTenantExists {
+		// created by a concurrent migration of another of its keys
+		return t.GetTenantByID(ctx, tenantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (t *DynamoTenantStore) CreateTenant(ctx context.Context, tenant *Tenant) error {
+	item, err := dynamodbattribute.MarshalMap(tenant)
+	if err != nil {
+		return err
+	}
+
+	cond := expression.Name("tenantId").AttributeNotExists()
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = t.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(tenantTable),
+		Item:                     item,
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrTenantExists
+	}
+	return err
+}
+
+func (t *DynamoTenantStore) GetTenantByID(ctx context.Context, tenantID string) (*Tenant, error) {
+	res, err := t.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tenantTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"tenantId": {
+				S: aws.String(tenantID),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Item == nil {
+		return nil, ErrNotFound
+	}
 
+	var tenant Tenant
 	err = dynamodbattribute.UnmarshalMap(res.Item, &tenant)
 	if err != nil {
-		log.Fatal(err)
-		return "", err
+		return nil, err
 	}
+	return &tenant, nil
+}
 
-	return tenant.TenantId, nil
-}
\ No newline at end of file
+func (t *DynamoTenantStore) SetTenantStatus(ctx context.Context, tenantID, status string) error {
+	return t.setTenantAttribute(ctx, tenantID, "status", "tenantStatus", status)
+}
+
+func (t *DynamoTenantStore) SetTenantQuotas(ctx context.Context, tenantID string, quotas *usage.Quotas) error {
+	return t.setTenantAttribute(ctx, tenantID, "quotas", "quotas", quotas)
+}
+
+func (t *DynamoTenantStore) SetTenantRateLimits(ctx context.Context, tenantID string, limits *ratelimit.Limits) error {
+	return t.setTenantAttribute(ctx, tenantID, "rateLimits", "rateLimits", limits)
+}
+
+// setTenantAttribute updates the tenant, and the copy of the attribute in the tenant's keys
+func (t *DynamoTenantStore) setTenantAttribute(ctx context.Context, tenantID, name, keyName string, value interface{}) error {
+	cond := expression.Name("tenantId").AttributeExists()
+	update := expression.Set(expression.Name(name), expression.Value(value))
+	expr, err := expression.NewBuilder().WithCondition(cond).WithUpdate(update).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = t.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tenantTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"tenantId": {
+				S: aws.String(tenantID),
+			},
+		},
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := t.queryApiKeys(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = t.updateApiKey(ctx, k.KeyPrefix, expression.Set(expression.Name(keyName), expression.Value(value)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateApiKey stores the key under its prefix, or its collision prefix if another key has the same prefix
+func (t *DynamoTenantStore) CreateApiKey(ctx context.Context, key *ApiKey) error {
+	err := t.putApiKey(ctx, key, keyPrefix(key.Key))
+	if err == errPrefixTaken {
+		err = t.putApiKey(ctx, key, t.collisionPrefix(key.Key))
+	}
+	return err
+}
+
+func (t *DynamoTenantStore) putApiKey(ctx context.Context, key *ApiKey, prefix string) error {
+	stored := *key
+	stored.Key = ""
+	stored.KeyPrefix = prefix
+	stored.KeyHash = t.hashKey(key.Key)
+
+	item, err := dynamodbattribute.MarshalMap(&stored)
+	if err != nil {
+		return err
+	}
+
+	cond := expression.Name("keyPrefix").AttributeNotExists()
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = t.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(apiKeyTable),
+		Item:                     item,
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errPrefixTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	key.KeyPrefix = stored.KeyPrefix
+	return nil
+}
+
+func (t *DynamoTenantStore) ListApiKeys(ctx context.Context, tenantID string) ([]*ApiKey, error) {
+	keys, err := t.queryApiKeys(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (t *DynamoTenantStore) GetApiKey(ctx context.Context, tenantID, keyID string) (*ApiKey, error) {
+	keys, err := t.queryApiKeys(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.KeyID == keyID {
+			return k, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (t *DynamoTenantStore) RevokeApiKey(ctx context.Context, tenantID, keyID, revokedAt string) error {
+	key, err := t.GetApiKey(ctx, tenantID, keyID)
+	if err != nil {
+		return err
+	}
+
+	return t.updateApiKey(ctx, key.KeyPrefix, expression.Set(expression.Name("revokedAt"), expression.Value(revokedAt)))
+}
+
+func (t *DynamoTenantStore) updateApiKey(ctx context.Context, prefix string, update expression.UpdateBuilder) error {
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = t.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(apiKeyTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"keyPrefix": {
+				S: aws.String(prefix),
+			},
+		},
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	return err
+}
+
+// queryApiKeys returns the tenant's keys, without their hashes
+func (t *DynamoTenantStore) queryApiKeys(ctx context.Context, tenantID string) ([]*ApiKey, error) {
+	key := expression.Key("tenantId").Equal(expression.Value(tenantID))
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*ApiKey
+	err = t.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(apiKeyTable),
+		IndexName:                 aws.String(apiKeyTenantIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var k ApiKey
+				if dynamodbattribute.UnmarshalMap(item, &k) == nil {
+					k.KeyHash = ""
+					keys = append(keys, &k)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -2,8 +2,156 @@ package tenants
 
 import (
 	"context"
+	"errors"
+	"github.com/citizendata/datawallet/wallet-api/ratelimit"
+	"github.com/citizendata/datawallet/wallet-api/store/usage"
 )
 
+const (
+	TenantActive    = "active"
+	TenantSuspended = "suspended"
+	TenantDeleted   = "deleted"
+
+	// ScopeReadOnly keys can only read
+	ScopeReadOnly = "read-only"
+	// ScopeNoShare keys cannot share data
+	ScopeNoShare = "no-share"
+	// ScopeAdmin keys can manage the tenant's own API keys
+	ScopeAdmin = "admin"
+)
+
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrTenantNotFound  = errors.New("tenant not found")
+	ErrTenantSuspended = errors.New("tenant suspended")
+	ErrTenantExists    = errors.New("tenant exists")
+	ErrKeyRevoked      = errors.New("api key revoked")
+	ErrKeyExpired      = errors.New("api key expired")
+	ErrKeyTooShort     = errors.New("api key too short, a new key must be issued")
+)
+
+// Tenant is a customer of the API, identified by its API keys
+type Tenant struct {
+	TenantId  string `json:"tenantId"`
+	Name      string `json:"name"`
+	CreatedAt string `json:"createdAt,omitempty"`
+
+	// Status is active (or blank), suspended or deleted
+	Status string `json:"status,omitempty"`
+
+	// Quotas limit the data stored, usage.DefaultQuotas if nil
+	Quotas *usage.Quotas `json:"quotas,omitempty"`
+
+	// RateLimits limit the requests, ratelimit.DefaultLimits if nil
+	RateLimits *ratelimit.Limits `json:"rateLimits,omitempty"`
+
+	// RecoveryVerifier is the second factor used for account recovery (blank disables recovery)
+	RecoveryVerifier string `json:"recoveryVerifier"`
+}
+
+// ValidTenantStatus is true for a known tenant status
+func ValidTenantStatus(status string) bool {
+	return status == TenantActive || status == TenantSuspended || status == TenantDeleted
+}
+
+// ApiKey is an API key of a tenant, it carries the tenant's settings so requests need a single read.
+// Only a keyed hash of the key is stored, found by the key's prefix.
+type ApiKey struct {
+	// Key is the API key itself, only returned when issued and never stored
+	Key              string            `json:"key,omitempty"`
+	KeyPrefix        string            `json:"keyPrefix"`
+	KeyHash          string            `json:"keyHash,omitempty"`
+	KeyID            string            `json:"keyId"`
+	Label            string            `json:"label,omitempty"`
+	Scopes           []string          `json:"scopes,omitempty"`
+	TenantId         string            `json:"tenantId"`
+	TenantName       string            `json:"name"`
+	TenantStatus     string            `json:"tenantStatus,omitempty"`
+	TenantQuotas     *usage.Quotas     `json:"quotas,omitempty"`
+	TenantRateLimits *ratelimit.Limits `json:"rateLimits,omitempty"`
+	RecoveryVerifier string            `json:"recoveryVerifier"`
+	GatewayKeyID     string            `json:"gatewayKeyId,omitempty"`
+	CreatedAt        string            `json:"createdAt,omitempty"`
+	ExpiresAt        string            `json:"expiresAt,omitempty"`
+	LastUsedAt       string            `json:"lastUsedAt,omitempty"`
+	RevokedAt        string            `json:"revokedAt,omitempty"`
+}
+
+// CheckTenant returns ErrTenantSuspended or ErrTenantNotFound unless the key's tenant is active
+func (k *ApiKey) CheckTenant() error {
+	switch k.TenantStatus {
+	case "", TenantActive:
+		return nil
+	case TenantSuspended:
+		return ErrTenantSuspended
+	}
+	return ErrTenantNotFound
+}
+
+// Quotas returns the tenant's quotas, or the defaults
+func (k *ApiKey) Quotas() *usage.Quotas {
+	if k.TenantQuotas == nil {
+		return usage.DefaultQuotas
+	}
+	return k.TenantQuotas
+}
+
+// RateLimits returns the tenant's request limits, or the defaults
+func (k *ApiKey) RateLimits() *ratelimit.Limits {
+	if k.TenantRateLimits == nil {
+		return ratelimit.DefaultLimits
+	}
+	return k.TenantRateLimits
+}
+
+func (k *ApiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope is true for a known scope
+func ValidScope(scope string) bool {
+	return scope == ScopeReadOnly || scope == ScopeNoShare || scope == ScopeAdmin
+}
+
+type ApiKeyList struct {
+	Keys []*ApiKey `json:"keys"`
+}
+
 type TenantStore interface {
 	GetTenantId(ctx context.Context, apikey string) (string, error)
+	// GetTenant returns the key's tenant, or ErrTenantNotFound, ErrTenantSuspended, ErrKeyRevoked or ErrKeyExpired
+	GetTenant(ctx context.Context, apikey string) (*Tenant, error)
+	// LookupApiKey finds the key by its value (or returns ErrTenantNotFound) and checks it is neither revoked nor expired.
+	// The tenant's status is not checked. With ErrKeyRevoked the key is returned too, so it can be disabled in the gateway.
+	LookupApiKey(ctx context.Context, apikey string) (*ApiKey, error)
+
+	// CreateTenant stores a new tenant, or returns ErrTenantExists
+	CreateTenant(ctx context.Context, tenant *Tenant) error
+	GetTenantByID(ctx context.Context, tenantID string) (*Tenant, error)
+	// SetTenantStatus changes the tenant's status and copies it to the tenant's keys
+	SetTenantStatus(ctx context.Context, tenantID, status string) error
+	// SetTenantQuotas changes the tenant's quotas and copies them to the tenant's keys
+	SetTenantQuotas(ctx context.Context, tenantID string, quotas *usage.Quotas) error
+	// SetTenantRateLimits changes the tenant's request limits and copies them to the tenant's keys
+	SetTenantRateLimits(ctx context.Context, tenantID string, limits *ratelimit.Limits) error
+	// CreateApiKey stores the key's hash (from key.Key) and prefix
+	CreateApiKey(ctx context.Context, key *ApiKey) error
+	// ListApiKeys returns the tenant's keys without their hashes
+	ListApiKeys(ctx context.Context, tenantID string) ([]*ApiKey, error)
+	GetApiKey(ctx context.Context, tenantID, keyID string) (*ApiKey, error)
+	RevokeApiKey(ctx context.Context, tenantID, keyID, revokedAt string) error
+}
+
+// GatewayKeys registers API keys with the API gateway, which only lets requests with a registered key through
+type GatewayKeys interface {
+	// Register adds an enabled key to the usage plan and returns its gateway ID
+	Register(ctx context.Context, name, value string) (string, error)
+	Disable(ctx context.Context, gatewayKeyID string) error
+	// Deregister deletes a key registered by mistake
+	Deregister(ctx context.Context, gatewayKeyID string) error
 }
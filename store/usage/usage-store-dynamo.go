@@ -0,0 +1,333 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
+	"strconv"
+)
+
+const (
+	usageTable = "wallet-usage"
+)
+
+var errNotCounted = errors.New("not counted")
+
+// DynamoUsageStore keeps counters keyed "tenant" and "tenant/wallet", a marker per item written ("tenant/wallet#item#key")
+// and a marker per version counted, with its bytes ("tenant/wallet#version#key#hash")
+type DynamoUsageStore struct {
+	db *dynamodb.DynamoDB
+}
+
+func NewDynamoUsageStore(db *dynamodb.DynamoDB) *DynamoUsageStore {
+	return &DynamoUsageStore{
+		db: db,
+	}
+}
+
+func usageKey(tenantID, walletID string) string {
+	if walletID == "" {
+		return tenantID
+	}
+	return fmt.Sprintf("%s/%s", tenantID, walletID)
+}
+
+func itemMarkerKey(tenantID, walletID, itemKey string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"usageKey": {
+			S: aws.String(fmt.Sprintf("%s/%s#item#%s", tenantID, walletID, itemKey)),
+		},
+	}
+}
+
+func versionMarkerKey(tenantID, walletID, itemKey, versionHash string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"usageKey": {
+			S: aws.String(fmt.Sprintf("%s/%s#version#%s#%s", tenantID, walletID, itemKey, versionHash)),
+		},
+	}
+}
+
+// versionMarker is the marker of a counted version
+type versionMarker struct {
+	UsageKey string `json:"usageKey"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func (s *DynamoUsageStore) Reserve(ctx context.Context, tenantID, walletID, itemKey, versionHash string, bytes int64, quotas *Quotas) (*Usage, error) {
+	newItem, err := s.markItem(ctx, tenantID, walletID, itemKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reserved := &Usage{
+		Versions: 1,
+		Bytes:    bytes,
+	}
+	if newItem {
+		reserved.Items = 1
+	}
+
+	// the version's marker is put with the counters, so a version already counted cancels the whole write
+	key := versionMarkerKey(tenantID, walletID, itemKey, versionHash)
+	marker := map[string]*dynamodb.AttributeValue{
+		"usageKey": key["usageKey"],
+		"bytes": {
+			N: aws.String(strconv.FormatInt(bytes, 10)),
+		},
+	}
+	markerPut := &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:           aws.String(usageTable),
+			Item:                marker,
+			ConditionExpression: aws.String("attribute_not_exists(usageKey)"),
+		},
+	}
+
+	tenantUpdate, err := counterUpdate(usageKey(tenantID, ""), reserved, quotas.Tenant)
+	if err == nil {
+		var walletUpdate *dynamodb.TransactWriteItem
+		walletUpdate, err = counterUpdate(usageKey(tenantID, walletID), reserved, quotas.Wallet)
+		if err == nil {
+			_, err = s.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+				TransactItems: []*dynamodb.TransactWriteItem{markerPut, tenantUpdate, walletUpdate},
+			})
+			if conditionFailedAt(err, 0) {
+				reserved, err = &Usage{}, nil
+			} else if isConditionFailed(err) {
+				err = ErrQuotaExceeded
+			}
+		}
+	}
+	if newItem && (err != nil || reserved.Versions == 0) {
+		s.unmarkItem(ctx, tenantID, walletID, itemKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return reserved, nil
+}
+
+func (s *DynamoUsageStore) Release(ctx context.Context, tenantID, walletID, itemKey, versionHash string, reserved *Usage) error {
+	if reserved.Versions == 0 {
+		return nil
+	}
+
+	released := &Usage{
+		Items:    -reserved.Items,
+		Versions: -reserved.Versions,
+		Bytes:    -reserved.Bytes,
+	}
+	err := s.releaseMarker(ctx, tenantID, walletID, versionMarkerKey(tenantID, walletID, itemKey, versionHash), released)
+	if err != nil && err != errNotCounted {
+		return err
+	}
+
+	if reserved.Items > 0 {
+		return s.unmarkItem(ctx, tenantID, walletID, itemKey)
+	}
+	return nil
+}
+
+func (s *DynamoUsageStore) ReleaseVersions(ctx context.Context, tenantID, walletID, itemKey string, versionHashes []string, allVersions bool) error {
+	for _, hash := range versionHashes {
+		key := versionMarkerKey(tenantID, walletID, itemKey, hash)
+		res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(usageTable),
+			Key:            key,
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		if res.Item == nil {
+			continue
+		}
+
+		var marker versionMarker
+		err = dynamodbattribute.UnmarshalMap(res.Item, &marker)
+		if err != nil {
+			return err
+		}
+		err = s.releaseMarker(ctx, tenantID, walletID, key, &Usage{
+			Versions: -1,
+			Bytes:    -marker.Bytes,
+		})
+		if err != nil && err != errNotCounted {
+			return err
+		}
+	}
+
+	if !allVersions {
+		return nil
+	}
+	err := s.releaseMarker(ctx, tenantID, walletID, itemMarkerKey(tenantID, walletID, itemKey), &Usage{
+		Items: -1,
+	})
+	if err == errNotCounted {
+		return nil
+	}
+	return err
+}
+
+// releaseMarker deletes a marker and applies released to the counters, or returns errNotCounted if it is gone
+func (s *DynamoUsageStore) releaseMarker(ctx context.Context, tenantID, walletID string, key map[string]*dynamodb.AttributeValue, released *Usage) error {
+	tenantUpdate, err := counterUpdate(usageKey(tenantID, ""), released, nil)
+	if err != nil {
+		return err
+	}
+	walletUpdate, err := counterUpdate(usageKey(tenantID, walletID), released, nil)
+	if err != nil {
+		return err
+	}
+
+	markerDelete := &dynamodb.TransactWriteItem{
+		Delete: &dynamodb.Delete{
+			TableName:           aws.String(usageTable),
+			Key:                 key,
+			ConditionExpression: aws.String("attribute_exists(usageKey)"),
+		},
+	}
+	_, err = s.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{markerDelete, tenantUpdate, walletUpdate},
+	})
+	if conditionFailedAt(err, 0) {
+		return errNotCounted
+	}
+	return err
+}
+
+func (s *DynamoUsageStore) GetUsage(ctx context.Context, tenantID, walletID string) (*Usage, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(usageTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"usageKey": {
+				S: aws.String(usageKey(tenantID, walletID)),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var u Usage
+	if res.Item != nil {
+		err = dynamodbattribute.UnmarshalMap(res.Item, &u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &u, nil
+}
+
+// markItem records the item, and returns true if it was not written before
+func (s *DynamoUsageStore) markItem(ctx context.Context, tenantID, walletID, itemKey string) (bool, error) {
+	cond := expression.Name("usageKey").AttributeNotExists()
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(usageTable),
+		Item:                     itemMarkerKey(tenantID, walletID, itemKey),
+		ConditionExpression:      expr.Condition(),
+		ExpressionAttributeNames: expr.Names(),
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DynamoUsageStore) unmarkItem(ctx context.Context, tenantID, walletID, itemKey string) error {
+	_, err := s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(usageTable),
+		Key:       itemMarkerKey(tenantID, walletID, itemKey),
+	})
+	return err
+}
+
+// counterUpdate adds delta to a counter, on the condition the result stays within limits (nil for none)
+func counterUpdate(key string, delta *Usage, limits *Limits) (*dynamodb.TransactWriteItem, error) {
+	update := expression.Add(expression.Name("items"), expression.Value(delta.Items)).
+		Add(expression.Name("versions"), expression.Value(delta.Versions)).
+		Add(expression.Name("bytes"), expression.Value(delta.Bytes))
+	builder := expression.NewBuilder().WithUpdate(update)
+
+	if limits != nil {
+		var conds []expression.ConditionBuilder
+		for _, c := range []struct {
+			name       string
+			delta, max int64
+		}{
+			{"items", delta.Items, limits.MaxItems},
+			{"versions", delta.Versions, limits.MaxVersions},
+			{"bytes", delta.Bytes, limits.MaxBytes},
+		} {
+			if c.max == 0 {
+				continue
+			}
+			if c.delta > c.max {
+				return nil, ErrQuotaExceeded
+			}
+			name := expression.Name(c.name)
+			conds = append(conds, expression.Or(name.AttributeNotExists(), name.LessThanEqual(expression.Value(c.max-c.delta))))
+		}
+		if len(conds) == 1 {
+			builder = builder.WithCondition(conds[0])
+		} else if len(conds) > 1 {
+			builder = builder.WithCondition(expression.And(conds[0], conds[1], conds[2:]...))
+		}
+	}
+
+	expr, err := builder.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName: aws.String(usageTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"usageKey": {
+					S: aws.String(key),
+				},
+			},
+			UpdateExpression:          expr.Update(),
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		},
+	}, nil
+}
+
+// conditionFailedAt is true if the condition of the i-th item of a transaction failed
+func conditionFailedAt(err error, i int) bool {
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok || i >= len(canceled.CancellationReasons) {
+		return false
+	}
+	r := canceled.CancellationReasons[i]
+	return r != nil && aws.StringValue(r.Code) == "ConditionalCheckFailed"
+}
+
+// isConditionFailed is true for a failed condition, including one cancelling a transaction
+func isConditionFailed(err error) bool {
+	if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, r := range canceled.CancellationReasons {
+			if r != nil && aws.StringValue(r.Code) == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+		return false
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
@@ -0,0 +1,63 @@
+package usage
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Usage counts what is stored, items are distinct reference IDs (or shared references) and versions every write
+type Usage struct {
+	Items    int64 `json:"items"`
+	Versions int64 `json:"versions"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// Limits caps a Usage, zero means unlimited
+type Limits struct {
+	MaxItems    int64 `json:"maxItems"`
+	MaxVersions int64 `json:"maxVersions"`
+	MaxBytes    int64 `json:"maxBytes"`
+}
+
+// Quotas are the limits of a tenant as a whole and of each of its wallets
+type Quotas struct {
+	Tenant *Limits `json:"tenant"`
+	Wallet *Limits `json:"wallet"`
+}
+
+// DefaultQuotas apply to tenants without quotas
+var DefaultQuotas = &Quotas{
+	Tenant: &Limits{
+		MaxItems:    1000000,
+		MaxVersions: 10000000,
+		MaxBytes:    100 << 30,
+	},
+	Wallet: &Limits{
+		MaxItems:    10000,
+		MaxVersions: 100000,
+		MaxBytes:    1 << 30,
+	},
+}
+
+// Report is a usage against its limits
+type Report struct {
+	Usage  *Usage  `json:"usage"`
+	Limits *Limits `json:"limits"`
+}
+
+type UsageStore interface {
+	// Reserve counts a write of a version of the item (a new item if itemKey was never written) against the tenant's
+	// and the wallet's limits, or returns ErrQuotaExceeded. A version already counted is not counted again (nothing
+	// is reserved). The reserved usage is returned to Release it if the write fails.
+	Reserve(ctx context.Context, tenantID, walletID, itemKey, versionHash string, bytes int64, quotas *Quotas) (*Usage, error)
+	Release(ctx context.Context, tenantID, walletID, itemKey, versionHash string, reserved *Usage) error
+	// ReleaseVersions gives back the usage of stored versions of the item once deleted, and the item itself once all
+	// its versions are. Versions not counted (or already released) are skipped.
+	ReleaseVersions(ctx context.Context, tenantID, walletID, itemKey string, versionHashes []string, allVersions bool) error
+	// GetUsage returns the wallet's usage, or the tenant's for a blank walletID
+	GetUsage(ctx context.Context, tenantID, walletID string) (*Usage, error)
+}
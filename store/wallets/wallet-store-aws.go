@@ -7,21 +7,30 @@ import (
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/expression"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"golang.org/x/sync/errgroup"
 	"io/ioutil"
+	"sort"
+	"strings"
 )
 
 const (
-	walletTable    = "wallets"
-	dataTable      = "wallet-data"
-	shareTable     = "wallet-shares"
-	shareToIndex   = "toWallet-objectKey-index"
-	dataRefIndex   = "referenceId-createdAt-index"
-	bucket         = "data-wallet-storage"
+	walletTable        = "wallets"
+	walletVersionTable = "wallet-versions"
+	dataTable          = "wallet-data"
+	shareTable         = "wallet-shares"
+	shareToIndex       = "toWallet-objectKey-index"
+	shareFromIndex     = "fromWallet-objectKey-index"
+	dataRefIndex       = "referenceId-createdAt-index"
+	bucket             = "data-wallet-storage"
+)
+
+var (
+	errConditionFailed = errors.New("condition failed")
 )
 
 type AWSWalletStore struct {
@@ -35,6 +44,13 @@ type DynamoWallet struct {
 	TenantID string  `json:"tenantId"`
 }
 
+// DynamoWalletVersion is a copy of every version of a wallet record
+type DynamoWalletVersion struct {
+	WalletID string  `json:"walletId"`
+	Version  int64   `json:"version"`
+	Wallet   *Wallet `json:"wallet"`
+}
+
 type DynamoWalletData struct {
 	WalletID    string                 `json:"walletId"`
 	ObjectKey   string                 `json:"objectKey"`
@@ -52,6 +68,7 @@ type DynamoWalletShare struct {
 	ToWallet    string                 `json:"toWallet"`
 	CreatedAt   string                 `json:"createdAt"`
 	VersionHash string                 `json:"versionHash"`
+	Details     *ShareDetails          `json:"details,omitempty"`
 }
 
 func NewAWSWalletStore(db *dynamodb.DynamoDB, s3 *s3.S3) *AWSWalletStore {
@@ -62,21 +79,12 @@ func NewAWSWalletStore(db *dynamodb.DynamoDB, s3 *s3.S3) *AWSWalletStore {
 }
 
 func (s *AWSWalletStore) CreateWallet(ctx context.Context, wallet *Wallet) error {
-	item, err := dynamodbattribute.MarshalMap(&DynamoWallet{
-		WalletID: fmt.Sprintf("%s/%s", wallet.TenantID, wallet.WalletID),
-		Wallet:   wallet,
-		TenantID: wallet.TenantID,
-	})
-
-	if err != nil {
-		return err
+	wallet.Version = 0
+	cond := expression.Name("walletId").AttributeNotExists()
+	err := s.putWallet(ctx, wallet, cond, nil)
+	if err == errConditionFailed {
+		return ErrWalletExists
 	}
-
-	_, err = s.db.PutItem(&dynamodb.PutItemInput{
-		TableName: aws.String(walletTable),
-		Item:      item,
-	})
-
 	return err
 }
 
@@ -100,9 +108,146 @@ func (s *AWSWalletStore) GetWallet(ctx context.Context, tenantID, walletID strin
 		return nil, err
 	}
 
+	if wallet.Wallet == nil {
+		return nil, ErrNotFound
+	}
+
 	return wallet.Wallet, nil
 }
 
+func (s *AWSWalletStore) UpdateWallet(ctx context.Context, wallet *Wallet) error {
+	expected := wallet.Version
+	wallet.Version++
+
+	version := expression.Name("wallet.version")
+	cond := expression.Name("walletId").AttributeExists().And(version.Equal(expression.Value(expected)))
+
+	var original *Wallet
+	if expected == 0 {
+		// wallets stored before versioning have no version, and no copy in the history yet
+		cond = expression.Name("walletId").AttributeExists().And(expression.Or(version.AttributeNotExists(), version.Equal(expression.Value(expected))))
+
+		var err error
+		original, err = s.getStoredWallet(ctx, wallet.TenantID, wallet.WalletID)
+		if err != nil {
+			wallet.Version = expected
+			return err
+		}
+	}
+
+	err := s.putWallet(ctx, wallet, cond, original)
+	if err != nil {
+		wallet.Version = expected
+	}
+	if err == errConditionFailed {
+		return ErrVersionConflict
+	}
+	return err
+}
+
+// getStoredWallet reads the wallet record consistently, as the condition of the next write will see it
+func (s *AWSWalletStore) getStoredWallet(ctx context.Context, tenantID, walletID string) (*Wallet, error) {
+	res, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(walletTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"walletId": {
+				S: aws.String(calcWalletID(tenantID, walletID)),
+			},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var wallet DynamoWallet
+	err = dynamodbattribute.UnmarshalMap(res.Item, &wallet)
+	if err != nil {
+		return nil, err
+	}
+	if wallet.Wallet == nil {
+		return nil, ErrNotFound
+	}
+	return wallet.Wallet, nil
+}
+
+// putWallet stores the wallet if cond holds, together with a copy in the version history.
+// original is the unversioned record being replaced, copied to the history as version 0.
+func (s *AWSWalletStore) putWallet(ctx context.Context, wallet *Wallet, cond expression.ConditionBuilder, original *Wallet) error {
+	walletKey := calcWalletID(wallet.TenantID, wallet.WalletID)
+
+	item, err := dynamodbattribute.MarshalMap(&DynamoWallet{
+		WalletID: walletKey,
+		Wallet:   wallet,
+		TenantID: wallet.TenantID,
+	})
+	if err != nil {
+		return err
+	}
+
+	versionItem, err := dynamodbattribute.MarshalMap(&DynamoWalletVersion{
+		WalletID: walletKey,
+		Version:  wallet.Version,
+		Wallet:   wallet,
+	})
+	if err != nil {
+		return err
+	}
+
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName:                 aws.String(walletTable),
+				Item:                      item,
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			},
+		},
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(walletVersionTable),
+				Item:      versionItem,
+			},
+		},
+	}
+
+	if original != nil {
+		originalItem, err := dynamodbattribute.MarshalMap(&DynamoWalletVersion{
+			WalletID: walletKey,
+			Version:  0,
+			Wallet:   original,
+		})
+		if err != nil {
+			return err
+		}
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(walletVersionTable),
+				Item:      originalItem,
+			},
+		})
+	}
+
+	_, err = s.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+
+	if aerr, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		for _, reason := range aerr.CancellationReasons {
+			if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+				return errConditionFailed
+			}
+		}
+	}
+	return err
+}
+
 func (s *AWSWalletStore) putS3Object(bucket, objectKey string, data *WalletDataItem) error {
 	b, err := json.Marshal(data)
 	if err != nil {
@@ -125,6 +270,8 @@ func (s *AWSWalletStore) addObjectkey(ctx context.Context, tenantID, walletID, o
 			ReferenceID:   data.ReferenceID,
 			CreatedAt:     data.CreatedAt,
 			VersionHash:   data.VersionHash,
+			DeviceID:      data.DeviceID,
+			ActorWalletID: data.ActorWalletID,
 		},
 		VersionHash: data.VersionHash,
 		CreatedAt:   data.CreatedAt,
@@ -360,43 +507,101 @@ func (s *AWSWalletStore) ListData(ctx context.Context, tenantID, walletID string
 	}, nil
 }
 
-func (s *AWSWalletStore) ListSharedItems(ctx context.Context, tenantID, toWalletID string) (*WalletList, error) {
-	itemMap := make(map[string][]*WalletDataItemSummary)
-
+func (s *AWSWalletStore) ListSharedItems(ctx context.Context, tenantID, toWalletID, fromWalletID string) (*ShareList, error) {
 	key := expression.Key("toWallet").Equal(expression.Value(calcWalletID(tenantID, toWalletID)))
+	if fromWalletID != "" {
+		key = key.And(expression.Key("objectKey").BeginsWith(fmt.Sprintf("%s/%s/", tenantID, fromWalletID)))
+	}
+
+	shares, err := s.queryShares(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*ShareSummary{}
+	for _, dws := range shares {
+		items = append(items, shareSummary(tenantID, dws))
+	}
+
+	// objectKeys sort a share's versions by hash
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].FromWalletID != items[j].FromWalletID {
+			return items[i].FromWalletID < items[j].FromWalletID
+		}
+		if items[i].ReferenceID != items[j].ReferenceID {
+			return items[i].ReferenceID < items[j].ReferenceID
+		}
+		return items[i].CreatedAt < items[j].CreatedAt
+	})
+
+	return &ShareList{
+		Items: items,
+	}, nil
+}
+
+// ListOutgoingShares reads the shares in objectKey order (recipient, reference ID, version hash), so a share's
+// versions are contiguous and a page ends after the last version of its last share
+func (s *AWSWalletStore) ListOutgoingShares(ctx context.Context, tenantID, fromWalletID, next string, limit int) (*OutgoingShareList, error) {
+	prefix := fmt.Sprintf("%s/%s/", tenantID, fromWalletID)
+	key := expression.Key("fromWallet").Equal(expression.Value(calcWalletID(tenantID, fromWalletID)))
+	if next != "" {
+		key = key.And(expression.Key("objectKey").GreaterThan(expression.Value(prefix + next)))
+	}
 
 	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
 	if err != nil {
 		return nil, err
 	}
 
+	list := &OutgoingShareList{
+		Shares: []*OutgoingShare{},
+	}
+	var share *OutgoingShare
+	lastKey, more := "", false
 	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
 		TableName:                 aws.String(shareTable),
-		IndexName:                 aws.String(shareToIndex),
+		IndexName:                 aws.String(shareFromIndex),
 		KeyConditionExpression:    expr.KeyCondition(),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 	},
 		func(page *dynamodb.QueryOutput, lastPage bool) bool {
 			for _, item := range page.Items {
-				var dwd DynamoWalletShare
-				err = dynamodbattribute.UnmarshalMap(item, &dwd)
-				if err != nil {
-					//TODO: handle this?
+				var dws DynamoWalletShare
+				if dynamodbattribute.UnmarshalMap(item, &dws) != nil || dws.Summary == nil {
 					continue
 				}
-				itemMap[dwd.Summary.ReferenceID] = append(itemMap[dwd.Summary.ReferenceID], dwd.Summary)
+
+				toWalletID := strings.TrimPrefix(dws.ToWallet, tenantID+"/")
+				if share == nil || share.ToWalletID != toWalletID || share.ReferenceID != dws.Summary.ReferenceID {
+					if len(list.Shares) == limit {
+						more = true
+						return false
+					}
+					share = &OutgoingShare{
+						ToWalletID:  toWalletID,
+						ReferenceID: dws.Summary.ReferenceID,
+					}
+					list.Shares = append(list.Shares, share)
+				}
+				share.Versions = append(share.Versions, dws.Summary)
+				lastKey = dws.ObjectKey
 			}
-			return lastPage
+			return !lastPage
 		})
-
 	if err != nil {
 		return nil, err
 	}
 
-	return &WalletList{
-		Items: itemMap,
-	}, nil
+	for _, share := range list.Shares {
+		sort.Slice(share.Versions, func(i, j int) bool {
+			return share.Versions[i].CreatedAt < share.Versions[j].CreatedAt
+		})
+	}
+	if more {
+		list.Next = strings.TrimPrefix(lastKey, prefix)
+	}
+	return list, nil
 }
 
 func (s *AWSWalletStore) GetSharedDataItem(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID, hash string) (*WalletDataItem, error) {
@@ -404,7 +609,148 @@ func (s *AWSWalletStore) GetSharedDataItem(ctx context.Context, tenantID, fromWa
 	return s.getObject(objectKey)
 }
 
-func (s *AWSWalletStore) ShareDataItem(ctx context.Context, tenantID, fromWalletID, toWalletID string, data *WalletDataItem) error {
+func (s *AWSWalletStore) GetShare(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID, hash string) (*ShareSummary, error) {
+	objectKey := fmt.Sprintf("%s/%s/%s/%s/%s", tenantID, fromWalletID, toWalletID, referenceID, hash)
+	key := expression.Key("toWallet").Equal(expression.Value(calcWalletID(tenantID, toWalletID))).
+		And(expression.Key("objectKey").Equal(expression.Value(objectKey)))
+
+	shares, err := s.queryShares(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(shares) == 0 {
+		return nil, ErrShareNotFound
+	}
+	return shareSummary(tenantID, shares[0]), nil
+}
+
+// SetShareStatus moves each version from the status read on the toWallet index to the new one with a conditional
+// update, so a version changed since (the index is eventually consistent) or concurrently is left as it is. The
+// payload of a rejected version is deleted once its status is stored.
+func (s *AWSWalletStore) SetShareStatus(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID, status string) ([]string, error) {
+	prefix := fmt.Sprintf("%s/%s/%s/%s/", tenantID, fromWalletID, toWalletID, referenceID)
+	key := expression.Key("toWallet").Equal(expression.Value(calcWalletID(tenantID, toWalletID))).
+		And(expression.Key("objectKey").BeginsWith(prefix))
+
+	shares, err := s.queryShares(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, share := range shares {
+		if share.Details != nil && (share.Details.Status == ShareRejected || share.Details.Status == status) {
+			continue
+		}
+
+		err = s.updateShareStatus(ctx, share, status)
+		if err == errConditionFailed {
+			continue
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed = append(changed, share.VersionHash)
+
+		if status == ShareRejected {
+			_, err = s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(share.ObjectKey),
+			})
+			if err != nil {
+				return changed, err
+			}
+		}
+	}
+	return changed, nil
+}
+
+// updateShareStatus sets the share's status if it still has the one read, or returns errConditionFailed
+func (s *AWSWalletStore) updateShareStatus(ctx context.Context, share *DynamoWalletShare, status string) error {
+	var update expression.UpdateBuilder
+	var cond expression.ConditionBuilder
+	if share.Details == nil {
+		// shares made before details were recorded
+		update = expression.Set(expression.Name("details"), expression.Value(&ShareDetails{Status: status}))
+		cond = expression.Name("details").AttributeNotExists()
+	} else {
+		current := expression.Name("details.status")
+		update = expression.Set(current, expression.Value(status))
+		cond = current.Equal(expression.Value(share.Details.Status))
+		if share.Details.Status == "" {
+			cond = current.AttributeNotExists()
+		}
+	}
+	cond = expression.Name("objectKey").AttributeExists().And(cond)
+
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(shareTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"referenceId": {
+				S: aws.String(share.ReferenceID),
+			},
+			"objectKey": {
+				S: aws.String(share.ObjectKey),
+			},
+		},
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errConditionFailed
+	}
+	return err
+}
+
+func (s *AWSWalletStore) queryShares(ctx context.Context, key expression.KeyConditionBuilder) ([]*DynamoWalletShare, error) {
+	expr, err := expression.NewBuilder().WithKeyCondition(key).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var shares []*DynamoWalletShare
+	err = s.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(shareTable),
+		IndexName:                 aws.String(shareToIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	},
+		func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				var dws DynamoWalletShare
+				if dynamodbattribute.UnmarshalMap(item, &dws) == nil && dws.Summary != nil {
+					shares = append(shares, &dws)
+				}
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+func shareSummary(tenantID string, dws *DynamoWalletShare) *ShareSummary {
+	summary := &ShareSummary{
+		FromWalletID:          strings.TrimPrefix(dws.FromWallet, tenantID+"/"),
+		SharedAt:              dws.CreatedAt,
+		WalletDataItemSummary: *dws.Summary,
+	}
+	if dws.Details != nil {
+		summary.ShareDetails = *dws.Details
+	}
+	return summary
+}
+
+func (s *AWSWalletStore) ShareDataItem(ctx context.Context, tenantID, fromWalletID, toWalletID string, data *WalletDataItem, details *ShareDetails) error {
 	refID := fmt.Sprintf("%s/%s/%s/%s", tenantID, fromWalletID, toWalletID, data.ReferenceID)
 	objectKey := fmt.Sprintf("%s/%s", refID, data.VersionHash)
 
@@ -422,10 +768,13 @@ func (s *AWSWalletStore) ShareDataItem(ctx context.Context, tenantID, fromWallet
 			ReferenceID:   data.ReferenceID,
 			CreatedAt:     data.CreatedAt,
 			VersionHash:   data.VersionHash,
+			DeviceID:      data.DeviceID,
+			ActorWalletID: data.ActorWalletID,
 		},
 		VersionHash: data.VersionHash,
 		CreatedAt:   data.CreatedAt,
 		ReferenceID: refID,
+		Details:     details,
 	})
 
 	if err != nil {
@@ -0,0 +1,118 @@
+package wallets
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// maxCachedWallets bounds the cache, reads of many distinct wallets must not grow a warm instance's memory
+const maxCachedWallets = 5000
+
+// WalletCache holds wallets across warm invocations, it is safe for concurrent use
+type WalletCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	wallets map[string]*cachedWallet
+}
+
+// cachedWallet is kept marshalled, callers get their own copy to modify
+type cachedWallet struct {
+	data    []byte
+	expires time.Time
+}
+
+func NewWalletCache(ttl time.Duration) *WalletCache {
+	return &WalletCache{
+		ttl:     ttl,
+		wallets: map[string]*cachedWallet{},
+	}
+}
+
+// CachedWalletStore caches GetWallet of a WalletStore for the cache's TTL. Updates made through the store drop the
+// wallet, those made by another function are seen once the TTL has passed. What is saved is the read and the
+// unmarshalling of the wallet and its keys.
+type CachedWalletStore struct {
+	WalletStore
+	cache *WalletCache
+}
+
+func NewCachedWalletStore(store WalletStore, cache *WalletCache) *CachedWalletStore {
+	return &CachedWalletStore{
+		WalletStore: store,
+		cache:       cache,
+	}
+}
+
+func (s *CachedWalletStore) GetWallet(ctx context.Context, tenantID, walletId string) (*Wallet, error) {
+	id := tenantID + "/" + walletId
+	now := time.Now().UTC()
+
+	s.cache.mu.Lock()
+	cached, ok := s.cache.wallets[id]
+	s.cache.mu.Unlock()
+
+	if ok && now.Before(cached.expires) {
+		var wallet Wallet
+		if json.Unmarshal(cached.data, &wallet) == nil {
+			return &wallet, nil
+		}
+	}
+
+	wallet, err := s.WalletStore.GetWallet(ctx, tenantID, walletId)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(wallet)
+	if err == nil {
+		s.cache.mu.Lock()
+		if len(s.cache.wallets) >= maxCachedWallets {
+			s.cache.evict(now)
+		}
+		s.cache.wallets[id] = &cachedWallet{
+			data:    data,
+			expires: now.Add(s.cache.ttl),
+		}
+		s.cache.mu.Unlock()
+	}
+
+	return wallet, nil
+}
+
+// UpdateWallet invalidates the cached wallet, also on a version conflict since the cached copy is then stale
+func (s *CachedWalletStore) UpdateWallet(ctx context.Context, wallet *Wallet) error {
+	err := s.WalletStore.UpdateWallet(ctx, wallet)
+	s.Invalidate(wallet.TenantID, wallet.WalletID)
+	return err
+}
+
+// Invalidate drops the cached wallet, and expired entries
+func (s *CachedWalletStore) Invalidate(tenantID, walletID string) {
+	id := tenantID + "/" + walletID
+	now := time.Now().UTC()
+
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	for k, cached := range s.cache.wallets {
+		if k == id || now.After(cached.expires) {
+			delete(s.cache.wallets, k)
+		}
+	}
+}
+
+// evict drops expired wallets, or arbitrary ones if none has expired, to make room for one; mu must be held
+func (c *WalletCache) evict(now time.Time) {
+	for id, cached := range c.wallets {
+		if now.After(cached.expires) {
+			delete(c.wallets, id)
+		}
+	}
+	for id := range c.wallets {
+		if len(c.wallets) < maxCachedWallets {
+			break
+		}
+		delete(c.wallets, id)
+	}
+}
@@ -0,0 +1,58 @@
+package wallets
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// countingStore serves wallets from memory and counts the reads reaching it
+type countingStore struct {
+	WalletStore
+	reads int
+}
+
+func (s *countingStore) GetWallet(ctx context.Context, tenantID, walletID string) (*Wallet, error) {
+	s.reads++
+	return &Wallet{TenantID: tenantID, WalletID: walletID}, nil
+}
+
+func (s *countingStore) UpdateWallet(ctx context.Context, wallet *Wallet) error {
+	return nil
+}
+
+func TestCachedWalletStore(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{}
+	cached := NewCachedWalletStore(store, NewWalletCache(time.Minute))
+
+	for i := 0; i < 3; i++ {
+		wallet, err := cached.GetWallet(ctx, "tenant", "wallet")
+		assert.NoError(t, err)
+		assert.Equal(t, "wallet", wallet.WalletID)
+	}
+	assert.Equal(t, 1, store.reads, "hits are served from the cache")
+
+	assert.NoError(t, cached.UpdateWallet(ctx, &Wallet{TenantID: "tenant", WalletID: "wallet"}))
+	_, _ = cached.GetWallet(ctx, "tenant", "wallet")
+	assert.Equal(t, 2, store.reads, "an update drops the cached wallet")
+
+	expired := NewCachedWalletStore(store, NewWalletCache(0))
+	_, _ = expired.GetWallet(ctx, "tenant", "wallet")
+	_, _ = expired.GetWallet(ctx, "tenant", "wallet")
+	assert.Equal(t, 4, store.reads, "expired wallets are read again")
+}
+
+func TestWalletCacheBounded(t *testing.T) {
+	ctx := context.Background()
+	cache := NewWalletCache(time.Minute)
+	cached := NewCachedWalletStore(&countingStore{}, cache)
+
+	for i := 0; i < maxCachedWallets+10; i++ {
+		_, err := cached.GetWallet(ctx, "tenant", fmt.Sprintf("wallet-%d", i))
+		assert.NoError(t, err)
+	}
+	assert.LessOrEqual(t, len(cache.wallets), maxCachedWallets)
+}
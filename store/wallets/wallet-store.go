@@ -6,6 +6,44 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/citizendata/datawallet/wallet-api/security"
+)
+
+const (
+	// PrimaryDeviceID identifies the wallet key itself
+	PrimaryDeviceID = "primary"
+
+	// RecoveryDeviceID identifies the recovery key in policy signers
+	RecoveryDeviceID = "recovery"
+
+	// rights a custodian can hold on a dependent's wallet
+	RightRead  = "read"
+	RightAdd   = "add"
+	RightShare = "share"
+
+	// RightManage allows managing the members of an organization wallet
+	RightManage = "manage"
+
+	// roles of organization members
+	RoleAdmin  = "admin"
+	RoleReader = "reader"
+	RoleSharer = "sharer"
+
+	// GuardianShareReferenceID is the reference ID of recovery shares shared with guardians
+	GuardianShareReferenceID = "recovery-share"
+
+	// statuses of a share, shares without one were made before acceptance and are accepted
+	SharePending  = "pending"
+	ShareAccepted = "accepted"
+	ShareRejected = "rejected"
+)
+
+var (
+	ErrNotFound        = errors.New("wallet not found")
+	ErrWalletExists    = errors.New("wallet already exists")
+	ErrVersionConflict = errors.New("wallet was modified concurrently")
+	ErrShareNotFound   = errors.New("share not found")
 )
 
 type Wallet struct {
@@ -21,6 +59,220 @@ type Wallet struct {
 
 	//PrivateKeyEncrypted is opaque/encrypted private key for recovery
 	PrivateKeyEncrypted string `json:"privateKeyEncrypted"`
+
+	//RecoveryContact is where the tenant's recovery verifier sends challenges (e.g. email)
+	RecoveryContact string `json:"recoveryContact,omitempty"`
+
+	//RecoveryPublicKeyBase64 is an optional Base64 RSA pem that can authorize key rotation
+	RecoveryPublicKeyBase64 string `json:"recoveryPublicKeyBase64,omitempty"`
+
+	//KeyHistory of every public key of the wallet, oldest first (last is PublicKeyBase64)
+	KeyHistory []*WalletKey `json:"keyHistory,omitempty"`
+
+	//Devices are additional keys the wallet accepts signatures from (including removed ones)
+	Devices []*DeviceKey `json:"devices,omitempty"`
+
+	//SocialRecovery lets guardian wallets approve the release of the recovery key
+	SocialRecovery *SocialRecovery `json:"socialRecovery,omitempty"`
+
+	//Policies require co-signers to approve sensitive operations
+	Policies []*OperationPolicy `json:"policies,omitempty"`
+
+	//Custodians are wallets managing this (dependent's) wallet until their hand-over date
+	Custodians []*Custodian `json:"custodians,omitempty"`
+
+	//Organization wallets accept signatures from their members according to their role
+	Organization bool      `json:"organization,omitempty"`
+	Members      []*Member `json:"members,omitempty"`
+
+	//ShareAcceptance holds shares from other wallets until the wallet accepts them
+	ShareAcceptance *ShareAcceptance `json:"shareAcceptance,omitempty"`
+
+	//Blocked are the wallets whose shares the wallet refuses
+	Blocked []*BlockedSender `json:"blocked,omitempty"`
+
+	//Version is set by the store and incremented on every update
+	Version int64 `json:"version"`
+}
+
+// WalletKey is an entry in the key history of a wallet
+type WalletKey struct {
+	PublicKeyBase64 string `json:"publicKeyBase64"`
+	ValidFrom       string `json:"validFrom"`
+	ValidUntil      string `json:"validUntil,omitempty"`
+
+	//RotationSignature is base64(PKCS1v15(sha256(RotationStatement))) by the previous key or the recovery key
+	RotationSignature string `json:"rotationSignature,omitempty"`
+
+	//SignedBy is the public key that made RotationSignature
+	SignedBy string `json:"signedBy,omitempty"`
+
+	//RecoveryPublicKeyBase64 is the recovery key in effect while this key is current
+	RecoveryPublicKeyBase64 string `json:"recoveryPublicKeyBase64,omitempty"`
+}
+
+// DeviceKey is a named key of a wallet (PublicKeyBase64 is the PrimaryDeviceID)
+type DeviceKey struct {
+	DeviceID        string `json:"deviceId"`
+	Name            string `json:"name"`
+	PublicKeyBase64 string `json:"publicKeyBase64"`
+	AddedAt         string `json:"addedAt"`
+	AddedBy         string `json:"addedBy"`
+	RemovedAt       string `json:"removedAt,omitempty"`
+	RemovedBy       string `json:"removedBy,omitempty"`
+}
+
+// SocialRecovery is the k-of-n split of a secret among guardian wallets. The secret decrypts
+// RecoveryKeyEncrypted (the private key of RecoveryPublicKeyBase64), each guardian holds a share
+// shared with it under GuardianShareReferenceID.
+type SocialRecovery struct {
+	Threshold            int      `json:"threshold"`
+	Guardians            []string `json:"guardians"`
+	RecoveryKeyEncrypted string   `json:"recoveryKeyEncrypted"`
+	UpdatedAt            string   `json:"updatedAt"`
+}
+
+// OperationPolicy requires Threshold approvals from Signers before the operation is executed.
+// Signers are wallet IDs (any key of the wallet) or walletID#deviceID (a single key).
+type OperationPolicy struct {
+	Operation string   `json:"operation"`
+	Threshold int      `json:"threshold"`
+	Signers   []string `json:"signers"`
+}
+
+// Custodian is a wallet (e.g. a parent) acting on a dependent's wallet with Rights until HandOverAt,
+// after which only the dependent's own keys are accepted
+type Custodian struct {
+	WalletID   string   `json:"walletId"`
+	Rights     []string `json:"rights"`
+	HandOverAt string   `json:"handOverAt"`
+	AddedAt    string   `json:"addedAt"`
+	AddedBy    string   `json:"addedBy"`
+	RemovedAt  string   `json:"removedAt,omitempty"`
+	RemovedBy  string   `json:"removedBy,omitempty"`
+}
+
+// Active is true if the custodian was not removed and at (timestamp layout) is before the hand-over
+func (c *Custodian) Active(at string) bool {
+	return c.RemovedAt == "" && at < c.HandOverAt
+}
+
+func (c *Custodian) HasRight(right string) bool {
+	for _, r := range c.Rights {
+		if r == right {
+			return true
+		}
+	}
+	return false
+}
+
+// Covers is true if rights and handOverAt grant no more than the custodian holds: no other right and no later hand-over
+func (c *Custodian) Covers(rights []string, handOverAt string) bool {
+	for _, r := range rights {
+		if !c.HasRight(r) {
+			return false
+		}
+	}
+	return handOverAt <= c.HandOverAt
+}
+
+type CustodianList struct {
+	Custodians []*Custodian `json:"custodians"`
+}
+
+// Member is a wallet acting on an organization wallet according to its Role
+type Member struct {
+	WalletID  string `json:"walletId"`
+	Role      string `json:"role"`
+	AddedAt   string `json:"addedAt"`
+	AddedBy   string `json:"addedBy"`
+	RemovedAt string `json:"removedAt,omitempty"`
+	RemovedBy string `json:"removedBy,omitempty"`
+}
+
+var roleRights = map[string][]string{
+	RoleAdmin:  {RightRead, RightAdd, RightShare, RightManage},
+	RoleReader: {RightRead},
+	RoleSharer: {RightRead, RightShare},
+}
+
+// ValidRole is true for a known member role
+func ValidRole(role string) bool {
+	_, ok := roleRights[role]
+	return ok
+}
+
+func (m *Member) Active() bool {
+	return m.RemovedAt == ""
+}
+
+func (m *Member) HasRight(right string) bool {
+	for _, r := range roleRights[m.Role] {
+		if r == right {
+			return true
+		}
+	}
+	return false
+}
+
+type MemberList struct {
+	Members []*Member `json:"members"`
+}
+
+// ShareAcceptance makes new shares pending when Required, except those from AutoAccept senders (wallet IDs)
+type ShareAcceptance struct {
+	Required   bool     `json:"required"`
+	AutoAccept []string `json:"autoAccept,omitempty"`
+}
+
+// IncomingShareStatus is the status of a new share from fromWalletID to the wallet
+func (w *Wallet) IncomingShareStatus(fromWalletID string) string {
+	if w.ShareAcceptance == nil || !w.ShareAcceptance.Required || fromWalletID == w.WalletID {
+		return ShareAccepted
+	}
+	for _, sender := range w.ShareAcceptance.AutoAccept {
+		if sender == fromWalletID {
+			return ShareAccepted
+		}
+	}
+	return SharePending
+}
+
+// BlockedSender is a wallet that can no longer share with the blocking wallet
+type BlockedSender struct {
+	WalletID  string `json:"walletId"`
+	BlockedAt string `json:"blockedAt"`
+}
+
+type BlockList struct {
+	Blocked []*BlockedSender `json:"blocked"`
+}
+
+// Blocks is true if the wallet refuses shares from walletID
+func (w *Wallet) Blocks(walletID string) bool {
+	for _, b := range w.Blocked {
+		if b.WalletID == walletID {
+			return true
+		}
+	}
+	return false
+}
+
+type PolicyList struct {
+	Policies []*OperationPolicy `json:"policies"`
+}
+
+func (d *DeviceKey) Active() bool {
+	return d.RemovedAt == ""
+}
+
+type DeviceList struct {
+	Devices []*DeviceKey `json:"devices"`
+}
+
+type WalletKeyHistory struct {
+	WalletID string       `json:"walletId"`
+	Keys     []*WalletKey `json:"keys"`
 }
 
 func (w *Wallet) Json() string {
@@ -32,10 +284,15 @@ func (w *Wallet) Json() string {
 }
 
 func (w *Wallet) CalculateWalletId() (string, error) {
-	if w.PublicKeyBase64 == "" {
+	return KeyFingerprint(w.PublicKeyBase64)
+}
+
+// KeyFingerprint is the sha256 of a public key (the wallet ID is the fingerprint of its first key)
+func KeyFingerprint(publicKeyBase64 string) (string, error) {
+	if publicKeyBase64 == "" {
 		return "", errors.New("cannot calculate ID from blank public key")
 	}
-	publicKey, err := base64.StdEncoding.DecodeString(w.PublicKeyBase64)
+	publicKey, err := base64.StdEncoding.DecodeString(publicKeyBase64)
 	if err != nil {
 		return "", err
 	}
@@ -43,17 +300,202 @@ func (w *Wallet) CalculateWalletId() (string, error) {
 	return base64.URLEncoding.EncodeToString(b[:]), nil
 }
 
+// RotationStatement is the payload signed to rotate from one key (and recovery key) to another
+func RotationStatement(walletID, previousKeyBase64, newKeyBase64, newRecoveryKeyBase64, createdAt string) ([]byte, error) {
+	previous, err := KeyFingerprint(previousKeyBase64)
+	if err != nil {
+		return nil, err
+	}
+	next, err := KeyFingerprint(newKeyBase64)
+	if err != nil {
+		return nil, err
+	}
+	recovery := ""
+	if newRecoveryKeyBase64 != "" {
+		recovery, err = KeyFingerprint(newRecoveryKeyBase64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(fmt.Sprintf("rotate|%s|%s|%s|%s|%s", walletID, previous, next, recovery, createdAt)), nil
+}
+
+// ActiveDevices returns the primary key and every device that has not been removed
+func (w *Wallet) ActiveDevices() []*DeviceKey {
+	devices := []*DeviceKey{{
+		DeviceID:        PrimaryDeviceID,
+		Name:            PrimaryDeviceID,
+		PublicKeyBase64: w.PublicKeyBase64,
+	}}
+	for _, d := range w.Devices {
+		if d.Active() {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// Device returns the active device with the ID
+func (w *Wallet) Device(deviceID string) (*DeviceKey, bool) {
+	for _, d := range w.ActiveDevices() {
+		if d.DeviceID == deviceID {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// Custodian returns the active custodianship of walletID at the given time
+func (w *Wallet) Custodian(walletID, at string) (*Custodian, bool) {
+	for _, c := range w.Custodians {
+		if c.WalletID == walletID && c.Active(at) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Member returns the active membership of walletID in an organization wallet
+func (w *Wallet) Member(walletID string) (*Member, bool) {
+	if !w.Organization {
+		return nil, false
+	}
+	for _, m := range w.Members {
+		if m.WalletID == walletID && m.Active() {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+// InCustody is true while any custodian is active
+func (w *Wallet) InCustody(at string) bool {
+	for _, c := range w.Custodians {
+		if c.Active(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy returns the policy for the operation, nil if it needs no co-signers
+func (w *Wallet) Policy(operation string) *OperationPolicy {
+	for _, p := range w.Policies {
+		if p.Operation == operation {
+			return p
+		}
+	}
+	return nil
+}
+
+// CurrentKeyHistory returns the key history, including the current key for wallets created without one
+func (w *Wallet) CurrentKeyHistory() []*WalletKey {
+	if len(w.KeyHistory) == 0 {
+		return []*WalletKey{{
+			PublicKeyBase64:         w.PublicKeyBase64,
+			RecoveryPublicKeyBase64: w.RecoveryPublicKeyBase64,
+		}}
+	}
+	return w.KeyHistory
+}
+
+// VerifyKeyHistory checks that the first key matches the wallet ID and every rotation was signed
+func (w *Wallet) VerifyKeyHistory() error {
+	history := w.CurrentKeyHistory()
+
+	firstID, err := KeyFingerprint(history[0].PublicKeyBase64)
+	if err != nil {
+		return err
+	}
+	if firstID != w.WalletID {
+		return errors.New("first key does not match wallet ID")
+	}
+
+	for i := 1; i < len(history); i++ {
+		prev, key := history[i-1], history[i]
+		if key.SignedBy == "" || (key.SignedBy != prev.PublicKeyBase64 && key.SignedBy != prev.RecoveryPublicKeyBase64) {
+			return errors.New(fmt.Sprintf("key %d not signed by previous or recovery key", i))
+		}
+
+		statement, err := RotationStatement(w.WalletID, prev.PublicKeyBase64, key.PublicKeyBase64, key.RecoveryPublicKeyBase64, key.ValidFrom)
+		if err != nil {
+			return err
+		}
+		pubKey, err := security.PemBase64ToPublicKey(key.SignedBy)
+		if err != nil {
+			return err
+		}
+		err = security.VerifySignature(statement, key.RotationSignature, pubKey)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid rotation signature on key %d: %s", i, err.Error()))
+		}
+	}
+
+	if history[len(history)-1].PublicKeyBase64 != w.PublicKeyBase64 {
+		return errors.New("last key in history is not the current key")
+	}
+	return nil
+}
+
 type WalletList struct {
 	//map of reference IDs to versions, ordered from oldest to newest
 	Items map[string][]*WalletDataItemSummary `json:"items"`
 }
 
+// ShareDetails describe a share beyond the item shared
+type ShareDetails struct {
+	// FromKeyFingerprint is the KeyFingerprint of the sender's key when sharing
+	FromKeyFingerprint string `json:"fromKeyFingerprint,omitempty"`
+	Message            string `json:"message,omitempty"`
+	Status             string `json:"status,omitempty"`
+
+	// RequestID is the data request the share answers
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Accepted is true if the recipient can read the share
+func (d *ShareDetails) Accepted() bool {
+	return d.Status == "" || d.Status == ShareAccepted
+}
+
+// ShareSummary is a version of an item in a recipient's share inbox, with who shared it
+type ShareSummary struct {
+	FromWalletID string `json:"fromWalletId"`
+	SharedAt     string `json:"sharedAt"`
+	ShareDetails
+	WalletDataItemSummary
+}
+
+// ShareList is a recipient's share inbox ordered by sender, reference ID and from oldest to newest version
+type ShareList struct {
+	Items []*ShareSummary `json:"items"`
+}
+
+// OutgoingShare is an item shared with one recipient, with the versions shared ordered from oldest to newest
+type OutgoingShare struct {
+	ToWalletID  string                   `json:"toWalletId"`
+	ReferenceID string                   `json:"referenceId"`
+	Versions    []*WalletDataItemSummary `json:"versions"`
+}
+
+// OutgoingShareList is a page of the items a wallet shared, grouped by recipient and reference ID
+type OutgoingShareList struct {
+	Shares []*OutgoingShare `json:"shares"`
+
+	// Next is passed back to list the following page, blank on the last page
+	Next string `json:"next,omitempty"`
+}
+
 type WalletDataItem struct {
 	ReferenceID     string   `json:"referenceId"`
 	EncryptedChunks []string `json:"encryptedChunks"`
 	VersionHash     string   `json:"versionHash"`
 	DataSignature   string   `json:"dataSignature"`
 	CreatedAt       string   `json:"createdAt"`
+	DeviceID        string   `json:"deviceId,omitempty"`
+
+	// ActorWalletID is set when another wallet (a custodian) stored the item
+	ActorWalletID string `json:"actorWalletId,omitempty"`
 }
 
 type WalletDataItemList struct {
@@ -66,6 +508,8 @@ type WalletDataItemSummary struct {
 	DataSignature string `json:"dataSignature"`
 	CreatedAt     string `json:"createdAt"`
 	VersionHash   string `json:"versionHash"`
+	DeviceID      string `json:"deviceId,omitempty"`
+	ActorWalletID string `json:"actorWalletId,omitempty"`
 }
 
 func (w *WalletDataItem) Json() string {
@@ -78,14 +522,25 @@ func (w *WalletDataItem) Json() string {
 
 
 type WalletStore interface {
+	// CreateWallet stores a new wallet, or returns ErrWalletExists
 	CreateWallet(ctx context.Context, wallet *Wallet) error
 	GetWallet(ctx context.Context, tenantID, walletId string) (*Wallet, error)
+	// UpdateWallet replaces the wallet if its Version is unchanged in the store, and increments Version
+	UpdateWallet(ctx context.Context, wallet *Wallet) error
 	ListData(ctx context.Context, tenantID, walletID string) (*WalletList, error)
 	GetLatestDataItem(ctx context.Context, tenantID, walletID, referenceID string) (*WalletDataItem, error)
 	GetDataItem(ctx context.Context, tenantID, walletID, referenceID, hash string) (*WalletDataItem, error)
 	GetDataItemHistory(ctx context.Context, tenantID, walletID, referenceID string) (*WalletDataItemList, error)
 	AddDataItem(ctx context.Context, tenantID, walletID string, data *WalletDataItem) error
-	ListSharedItems(ctx context.Context, tenantID, toWalletID string) (*WalletList, error)
-	ShareDataItem(ctx context.Context, tenantID, fromWalletID, toWalletID string, data *WalletDataItem) error
+	// ListSharedItems returns the items shared with the wallet, by fromWalletID only unless it is blank
+	ListSharedItems(ctx context.Context, tenantID, toWalletID, fromWalletID string) (*ShareList, error)
+	// ListOutgoingShares returns up to limit shares of the wallet after next (blank for the first page)
+	ListOutgoingShares(ctx context.Context, tenantID, fromWalletID, next string, limit int) (*OutgoingShareList, error)
+	ShareDataItem(ctx context.Context, tenantID, fromWalletID, toWalletID string, data *WalletDataItem, details *ShareDetails) error
 	GetSharedDataItem(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID, hash string) (*WalletDataItem, error)
+	// GetShare returns the summary of a shared version, or ErrShareNotFound
+	GetShare(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID, hash string) (*ShareSummary, error)
+	// SetShareStatus sets the status of the versions of an item shared with the wallet that are not rejected, and returns
+	// the version hashes changed (also on error). Rejecting deletes their payloads.
+	SetShareStatus(ctx context.Context, tenantID, fromWalletID, toWalletID, referenceID, status string) ([]string, error)
 }
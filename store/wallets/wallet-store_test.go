@@ -0,0 +1,64 @@
+package wallets
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCustodianCovers(t *testing.T) {
+	custodian := &Custodian{
+		WalletID:   "parent",
+		Rights:     []string{RightRead, RightAdd},
+		HandOverAt: "2031-05-01T00:00:00.000Z",
+	}
+
+	tests := []struct {
+		name       string
+		rights     []string
+		handOverAt string
+		covers     bool
+	}{
+		{"same grant", []string{RightRead, RightAdd}, "2031-05-01T00:00:00.000Z", true},
+		{"fewer rights", []string{RightRead}, "2031-05-01T00:00:00.000Z", true},
+		{"earlier hand-over", []string{RightRead, RightAdd}, "2030-01-01T00:00:00.000Z", true},
+		{"no rights", nil, "2030-01-01T00:00:00.000Z", true},
+		{"wider rights", []string{RightRead, RightShare}, "2031-05-01T00:00:00.000Z", false},
+		{"later hand-over", []string{RightRead}, "2031-05-01T00:00:00.001Z", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.covers, custodian.Covers(tt.rights, tt.handOverAt))
+		})
+	}
+}
+
+func TestWalletBlocks(t *testing.T) {
+	wallet := &Wallet{
+		WalletID: "recipient",
+		Blocked: []*BlockedSender{
+			{WalletID: "spammer", BlockedAt: "2024-03-01T10:00:00.000Z"},
+			{WalletID: "ex-employer", BlockedAt: "2024-03-02T10:00:00.000Z"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		wallet   *Wallet
+		walletID string
+		blocks   bool
+	}{
+		{"blocked sender", wallet, "spammer", true},
+		{"other blocked sender", wallet, "ex-employer", true},
+		{"sender not blocked", wallet, "friend", false},
+		{"prefix of a blocked sender", wallet, "spam", false},
+		{"blank wallet ID", wallet, "", false},
+		{"empty block list", &Wallet{WalletID: "recipient"}, "spammer", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.blocks, tt.wallet.Blocks(tt.walletID))
+		})
+	}
+}
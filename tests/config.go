@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
@@ -11,11 +12,14 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"github.com/citizendata/datawallet/wallet-api/store/wallets"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"testing"
 	"time"
 )
 
@@ -26,8 +30,12 @@ const (
 var (
 	apiKey                 = os.Getenv("DATA_WALLET_API_KEY")
 	testUrl                = os.Getenv("DATA_WALLET_TEST_URL")
+	tenantID               = os.Getenv("DATA_WALLET_TENANT_ID")
 	superTopSecretPassword = "password"
 
+	// base64 PEM private key matching /datawallet/admin-public-key, admin tests are skipped without it
+	adminKey = os.Getenv("DATA_WALLET_ADMIN_KEY")
+
 	walletID = "zIfL2CPMg7pZ3pxxQKrmjLGZgqN6t9k1pU7lAHaRPEE="
 
 	// Only for Tests
@@ -92,20 +100,34 @@ func getPublicKey() *rsa.PublicKey {
 	return privKey
 }
 
-func signRequest(req *http.Request, body string) {
-	pk := getPrivateKey()
-
-	timestamp := time.Now().UTC().Format(timestampLayout)
-	payload := []byte(fmt.Sprintf("%s|%s|%s", strings.Replace(req.URL.Path, "/dev","", 1), body, timestamp))
+func sign(payload []byte) string {
+	return signWith(getPrivateKey(), payload)
+}
 
+func signWith(key *rsa.PrivateKey, payload []byte) string {
 	hashed := sha256.Sum256(payload)
 
-	sig, err := rsa.SignPKCS1v15(rand.Reader, pk, crypto.SHA256, hashed[:])
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
 	if err != nil {
 		panic(err)
 	}
 
-	signature := base64.StdEncoding.EncodeToString(sig)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func signRequest(req *http.Request, body string) {
+	signRequestWith(getPrivateKey(), req, body)
+}
+
+func signRequestWith(key *rsa.PrivateKey, req *http.Request, body string) {
+	signRequestAt(key, req, body, time.Now().UTC().Format(timestampLayout))
+}
+
+// signRequestAt signs with the timestamp given, for bodies that sign the request timestamp too (key rotations)
+func signRequestAt(key *rsa.PrivateKey, req *http.Request, body, timestamp string) {
+	payload := []byte(fmt.Sprintf("%s|%s|%s", strings.Replace(req.URL.Path, "/dev","", 1), body, timestamp))
+
+	signature := signWith(key, payload)
 
 	req.Header.Set("x-api-key", apiKey)
 	req.Header.Set("x-api-timestamp", timestamp)
@@ -113,6 +135,42 @@ func signRequest(req *http.Request, body string) {
 	req.Header.Set("Content-Type", "application/json")
 }
 
+// signMessageRequest signs using RFC 9421 Signature-Input / Signature headers
+func signMessageRequest(req *http.Request, body string) {
+	signMessageRequestWith(getPrivateKey(), walletID, req, body)
+	req.Header.Set("x-api-key", apiKey)
+}
+
+func signMessageRequestWith(pk *rsa.PrivateKey, keyID string, req *http.Request, body string) {
+	components := []string{`"@method"`, `"@authority"`, `"@path"`}
+	lines := []string{
+		fmt.Sprintf(`"@method": %s`, req.Method),
+		fmt.Sprintf(`"@authority": %s`, strings.ToLower(req.URL.Host)),
+		fmt.Sprintf(`"@path": %s`, req.URL.EscapedPath()),
+	}
+
+	if body != "" {
+		digest := sha256.Sum256([]byte(body))
+		contentDigest := fmt.Sprintf("sha-256=:%s:", base64.StdEncoding.EncodeToString(digest[:]))
+		req.Header.Set("Content-Digest", contentDigest)
+		components = append(components, `"content-digest"`)
+		lines = append(lines, fmt.Sprintf(`"content-digest": %s`, contentDigest))
+	}
+
+	params := fmt.Sprintf(`(%s);created=%d;keyid="%s";alg="rsa-v1_5-sha256"`, strings.Join(components, " "), time.Now().Unix(), keyID)
+	lines = append(lines, fmt.Sprintf(`"@signature-params": %s`, params))
+
+	hashed := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, pk, crypto.SHA256, hashed[:])
+	if err != nil {
+		panic(err)
+	}
+
+	req.Header.Set("Signature-Input", "sig1="+params)
+	req.Header.Set("Signature", fmt.Sprintf("sig1=:%s:", base64.StdEncoding.EncodeToString(sig)))
+	req.Header.Set("Content-Type", "application/json")
+}
+
 func urlEncode(str string) string {
 	return url.PathEscape(str)
 }
@@ -142,3 +200,130 @@ func encrypt(plaintext string) string {
 	ciphertext := aesgcm.Seal(nil, nonce, plaintextBytes, nil)
 	return base64.StdEncoding.EncodeToString(ciphertext)
 }
+
+// testWallet is a wallet with keys generated for the test run, for tests needing more than one wallet
+type testWallet struct {
+	key             *rsa.PrivateKey
+	publicKeyBase64 string
+	walletID        string
+
+	recoveryKey             *rsa.PrivateKey
+	recoveryPublicKeyBase64 string
+}
+
+// generateKey returns a new key and its public key as base64 PEM
+func generateKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	return key, base64.StdEncoding.EncodeToString(pemKey)
+}
+
+func newTestWallet(t *testing.T, organization bool) *testWallet {
+	w := &testWallet{}
+	w.key, w.publicKeyBase64 = generateKey(t)
+	w.recoveryKey, w.recoveryPublicKeyBase64 = generateKey(t)
+
+	var err error
+	w.walletID, err = wallets.KeyFingerprint(w.publicKeyBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallet := &wallets.Wallet{
+		PublicKeyBase64:         w.publicKeyBase64,
+		PrivateKeyEncrypted:     encrypt("test wallet"),
+		RecoveryPublicKeyBase64: w.recoveryPublicKeyBase64,
+		Organization:            organization,
+	}
+	status, body := w.send(t, "POST", fmt.Sprintf("%s/wallet", testUrl), wallet.Json())
+	if status != 200 {
+		t.Fatalf("could not create test wallet: %d %s", status, body)
+	}
+	return w
+}
+
+// send signs the request with the wallet's key, acting as the wallet on other wallets' routes (x-api-actor),
+// and returns the status and body
+func (w *testWallet) send(t *testing.T, method, url, body string) (int, []byte) {
+	return w.sendWith(t, w.key, time.Now().UTC().Format(timestampLayout), method, url, body)
+}
+
+// sendWith is send signing with key at timestamp
+func (w *testWallet) sendWith(t *testing.T, key *rsa.PrivateKey, timestamp, method, url, body string) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signRequestAt(key, req, body, timestamp)
+	if w.walletID != "" {
+		req.Header.Set("x-api-actor", w.walletID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(method, url, resp.StatusCode, string(b))
+	return resp.StatusCode, b
+}
+
+func (w *testWallet) url(format string, args ...interface{}) string {
+	return fmt.Sprintf("%s/wallet/%s", testUrl, urlEncode(w.walletID)) + fmt.Sprintf(format, args...)
+}
+
+func getAdminKey(t *testing.T) *rsa.PrivateKey {
+	if adminKey == "" {
+		t.Skip("DATA_WALLET_ADMIN_KEY is not set")
+	}
+	pemKey, err := base64.StdEncoding.DecodeString(adminKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := pem.Decode(pemKey)
+	if data == nil {
+		t.Fatal("DATA_WALLET_ADMIN_KEY is not a PEM key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(data.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// adminSend sends an admin request: signed with the admin key (RFC 9421) when key is set, authenticated with the
+// tenant API key when apikey is set
+func adminSend(t *testing.T, key *rsa.PrivateKey, apikey, method, url, body string) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		signMessageRequestWith(key, "admin", req, body)
+	}
+	if apikey != "" {
+		req.Header.Set("x-api-key", apikey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(method, url, resp.StatusCode, string(b))
+	return resp.StatusCode, b
+}
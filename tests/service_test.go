@@ -2,15 +2,21 @@ package tests
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/citizendata/datawallet/wallet-api/api"
+	"github.com/citizendata/datawallet/wallet-api/security"
+	"github.com/citizendata/datawallet/wallet-api/store/sessions"
 	"github.com/citizendata/datawallet/wallet-api/store/wallets"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 
@@ -42,7 +48,8 @@ func TestCreateWallet(t *testing.T) {
 		t.Log(string(b))
 	}
 
-	assert.Equal(t, 200, resp.StatusCode)
+	// the wallet may already exist from a previous run
+	assert.Contains(t, []int{200, 409}, resp.StatusCode)
 }
 
 func TestAddData(t *testing.T) {
@@ -83,6 +90,78 @@ func TestGetList(t *testing.T) {
 	get(t, url)
 }
 
+func TestGetListMessageSignature(t *testing.T) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/wallet/%s", testUrl, urlEncode(walletID)), nil)
+	assert.NoError(t, err)
+
+	signMessageRequest(req, "")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	if b, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Log(string(b))
+	}
+
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestSession(t *testing.T) {
+	client := &http.Client{}
+
+	// get challenge
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/wallet/%s/session/challenge", testUrl, urlEncode(walletID)), nil)
+	assert.NoError(t, err)
+	req.Header.Set("x-api-key", apiKey)
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var challenge sessions.Challenge
+	err = json.NewDecoder(resp.Body).Decode(&challenge)
+	assert.NoError(t, err)
+
+	// log in with signed challenge
+	login, _ := json.Marshal(&api.SessionLogin{
+		ChallengeID: challenge.ChallengeID,
+		Signature:   sign([]byte(challenge.Challenge)),
+	})
+	req, err = http.NewRequest("POST", fmt.Sprintf("%s/wallet/%s/session", testUrl, urlEncode(walletID)), bytes.NewBuffer(login))
+	assert.NoError(t, err)
+	req.Header.Set("x-api-key", apiKey)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var token api.SessionToken
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	assert.NoError(t, err)
+
+	// use token instead of signature
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s/wallet/%s", testUrl, urlEncode(walletID)), nil)
+	assert.NoError(t, err)
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// revoke
+	req, err = http.NewRequest("DELETE", fmt.Sprintf("%s/wallet/%s/session/%s", testUrl, urlEncode(walletID), token.SessionID), nil)
+	assert.NoError(t, err)
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
 func get(t *testing.T, url string) []byte {
 	req, err := http.NewRequest("GET", url, nil)
 	assert.NoError(t, err)
@@ -120,6 +199,40 @@ func TestGetItems(t *testing.T) {
 
 }
 
+func TestGetItemsWithCapability(t *testing.T) {
+	capability, err := security.NewCapability(tenantID, walletID, &security.Caveats{
+		Operations:   []string{api.CapabilityGetData},
+		ReferenceIDs: []string{"test123"},
+	}, getPrivateKey())
+	assert.NoError(t, err)
+
+	// holder narrows it down further
+	capability, err = capability.Attenuate(&security.Caveats{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	assert.NoError(t, err)
+
+	token, err := capability.Encode()
+	assert.NoError(t, err)
+
+	client := &http.Client{}
+	for url, status := range map[string]int{
+		fmt.Sprintf("%s/wallet/%s/data/%s/latest", testUrl, urlEncode(walletID), "test123"): 200,
+		fmt.Sprintf("%s/wallet/%s/data/%s/latest", testUrl, urlEncode(walletID), "other"):   403,
+		fmt.Sprintf("%s/wallet/%s/data/%s", testUrl, urlEncode(walletID), "test123"):        403,
+	} {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.NoError(t, err)
+		req.Header.Set("x-api-key", apiKey)
+		req.Header.Set("x-api-capability", token)
+
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, url)
+	}
+}
+
 func TestShareData(t *testing.T) {
 	url := fmt.Sprintf("%s/wallet/%s/share/%s/data", testUrl, urlEncode(walletID), urlEncode(walletID))
 
@@ -156,17 +269,15 @@ func TestShareData(t *testing.T) {
 func TestGetShareItems(t *testing.T) {
 	b := get(t, fmt.Sprintf("%s/wallet/%s/shares", testUrl, urlEncode(walletID)))
 
-	var data wallets.WalletList
+	var data wallets.ShareList
 	err := json.Unmarshal(b, &data)
 	assert.NoError(t, err)
 
-	for k, v := range data.Items {
-		t.Log(k)
-		for _, i := range v {
-			dataUrl := fmt.Sprintf("%s/wallet/%s/share/data/%s/%s/%s", testUrl, urlEncode(walletID), urlEncode(walletID), i.ReferenceID, i.VersionHash)
-			t.Logf(dataUrl)
-			get(t, dataUrl)
-		}
+	for _, i := range data.Items {
+		t.Log(i.FromWalletID, i.ReferenceID)
+		dataUrl := fmt.Sprintf("%s/wallet/%s/share/data/%s/%s/%s", testUrl, urlEncode(walletID), urlEncode(i.FromWalletID), i.ReferenceID, i.VersionHash)
+		t.Log(dataUrl)
+		get(t, dataUrl)
 	}
 }
 
@@ -174,3 +285,302 @@ func TestGetPublicKey(t *testing.T) {
 	get(t, fmt.Sprintf("%s/public/key/%s", testUrl, urlEncode(walletID)))
 }
 
+
+func TestCustody(t *testing.T) {
+	dependent := newTestWallet(t, false)
+	parent := newTestWallet(t, false)
+	stranger := newTestWallet(t, false)
+
+	handOverAt := time.Now().UTC().AddDate(1, 0, 0).Format(timestampLayout)
+	grant := func(rights []string, handOverAt string) string {
+		b, _ := json.Marshal(&api.CustodianGrant{Rights: rights, HandOverAt: handOverAt})
+		return string(b)
+	}
+	item := (&wallets.WalletDataItem{ReferenceID: "custody", DataSignature: "signature", EncryptedChunks: []string{uuid.New().String()}}).Json()
+
+	// only the dependent's key can add the first custodian
+	status, _ := stranger.send(t, "PUT", dependent.url("/custodians/%s", urlEncode(stranger.walletID)), grant([]string{wallets.RightRead}, handOverAt))
+	assert.Equal(t, 401, status)
+	status, _ = dependent.send(t, "PUT", dependent.url("/custodians/%s", urlEncode(parent.walletID)), grant([]string{wallets.RightRead, wallets.RightAdd}, handOverAt))
+	assert.Equal(t, 200, status)
+
+	// the custodian acts within its rights
+	status, _ = parent.send(t, "POST", dependent.url("/data"), item)
+	assert.Equal(t, 200, status)
+	status, _ = parent.send(t, "GET", dependent.url(""), "")
+	assert.Equal(t, 200, status)
+	status, _ = parent.send(t, "POST", dependent.url("/share/%s/data", urlEncode(parent.walletID)), item)
+	assert.Equal(t, 403, status)
+	status, _ = stranger.send(t, "GET", dependent.url(""), "")
+	assert.Equal(t, 403, status)
+
+	// a custodian cannot extend its hand-over date or hand out rights it does not hold
+	later := time.Now().UTC().AddDate(2, 0, 0).Format(timestampLayout)
+	status, _ = parent.send(t, "PUT", dependent.url("/custodians/%s", urlEncode(parent.walletID)), grant([]string{wallets.RightRead}, later))
+	assert.Equal(t, 403, status)
+	status, _ = parent.send(t, "PUT", dependent.url("/custodians/%s", urlEncode(stranger.walletID)), grant([]string{wallets.RightShare}, handOverAt))
+	assert.Equal(t, 403, status)
+
+	// a removed custodian loses access
+	status, _ = parent.send(t, "DELETE", dependent.url("/custodians/%s", urlEncode(parent.walletID)), "")
+	assert.Equal(t, 200, status)
+	status, _ = parent.send(t, "GET", dependent.url(""), "")
+	assert.Equal(t, 403, status)
+}
+
+func TestOrganizationMembers(t *testing.T) {
+	org := newTestWallet(t, true)
+	admin := newTestWallet(t, false)
+	sharer := newTestWallet(t, false)
+	reader := newTestWallet(t, false)
+
+	role := func(role string) string {
+		b, _ := json.Marshal(&api.MemberRole{Role: role})
+		return string(b)
+	}
+	item := (&wallets.WalletDataItem{ReferenceID: "members", DataSignature: "signature", EncryptedChunks: []string{uuid.New().String()}}).Json()
+
+	// the organization adds an admin, who manages the other members
+	status, _ := org.send(t, "PUT", org.url("/members/%s", urlEncode(admin.walletID)), role(wallets.RoleAdmin))
+	assert.Equal(t, 200, status)
+	status, _ = admin.send(t, "PUT", org.url("/members/%s", urlEncode(sharer.walletID)), role(wallets.RoleSharer))
+	assert.Equal(t, 200, status)
+	status, _ = admin.send(t, "PUT", org.url("/members/%s", urlEncode(reader.walletID)), role(wallets.RoleReader))
+	assert.Equal(t, 200, status)
+	status, _ = admin.send(t, "PUT", org.url("/members/%s", urlEncode(reader.walletID)), role("owner"))
+	assert.Equal(t, 400, status)
+
+	// members act according to their role
+	status, _ = admin.send(t, "POST", org.url("/data"), item)
+	assert.Equal(t, 200, status)
+	status, _ = reader.send(t, "GET", org.url(""), "")
+	assert.Equal(t, 200, status)
+	status, _ = reader.send(t, "POST", org.url("/data"), item)
+	assert.Equal(t, 403, status)
+	status, _ = reader.send(t, "PUT", org.url("/members/%s", urlEncode(reader.walletID)), role(wallets.RoleAdmin))
+	assert.Equal(t, 403, status)
+	status, _ = sharer.send(t, "POST", org.url("/share/%s/data", urlEncode(reader.walletID)), item)
+	assert.Equal(t, 200, status)
+	status, _ = sharer.send(t, "POST", org.url("/data"), item)
+	assert.Equal(t, 403, status)
+
+	// only organization wallets have members
+	status, _ = admin.send(t, "PUT", admin.url("/members/%s", urlEncode(reader.walletID)), role(wallets.RoleReader))
+	assert.Equal(t, 400, status)
+
+	// a removed member loses access
+	status, _ = admin.send(t, "DELETE", org.url("/members/%s", urlEncode(sharer.walletID)), "")
+	assert.Equal(t, 200, status)
+	status, _ = sharer.send(t, "GET", org.url(""), "")
+	assert.Equal(t, 403, status)
+}
+
+func TestAdminKeys(t *testing.T) {
+	key := getAdminKey(t)
+	admin := fmt.Sprintf("%s/admin/tenants", testUrl)
+
+	// x-api-signature does not cover the method, admin routes only take RFC 9421 signatures
+	body := fmt.Sprintf(`{"name":"admin keys test %s"}`, uuid.New().String())
+	req, _ := http.NewRequest("POST", admin, bytes.NewBufferString(body))
+	signRequestWith(key, req, body)
+	req.Header.Del("x-api-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 401, resp.StatusCode)
+
+	status, b := adminSend(t, key, "", "POST", admin, body)
+	if !assert.Equal(t, 200, status) {
+		return
+	}
+	var tenant struct {
+		TenantID string `json:"tenantId"`
+	}
+	_ = json.Unmarshal(b, &tenant)
+	keys := fmt.Sprintf("%s/%s/keys", admin, urlEncode(tenant.TenantID))
+
+	issued := func(b []byte) (string, string) {
+		var k struct {
+			Key   string `json:"key"`
+			KeyID string `json:"keyId"`
+		}
+		_ = json.Unmarshal(b, &k)
+		return k.Key, k.KeyID
+	}
+	status, b = adminSend(t, key, "", "POST", keys, `{"label":"admin","scopes":["admin"]}`)
+	if !assert.Equal(t, 200, status) {
+		return
+	}
+	tenantKey, tenantKeyID := issued(b)
+
+	// a key with the admin scope manages its own tenant's keys only
+	status, _ = adminSend(t, nil, tenantKey, "GET", keys, "")
+	assert.Equal(t, 200, status)
+	status, _ = adminSend(t, nil, tenantKey, "GET", fmt.Sprintf("%s/%s/keys", admin, urlEncode(tenantID)), "")
+	assert.Equal(t, 403, status)
+
+	// the rotated key is rejected once the grace period has passed
+	status, b = adminSend(t, nil, tenantKey, "POST", fmt.Sprintf("%s/%s/rotate", keys, urlEncode(tenantKeyID)), `{"gracePeriod":1}`)
+	if !assert.Equal(t, 200, status) {
+		return
+	}
+	rotatedKey, rotatedKeyID := issued(b)
+	time.Sleep(2 * time.Second)
+	status, _ = adminSend(t, nil, tenantKey, "GET", keys, "")
+	assert.Contains(t, []int{401, 403}, status)
+	status, _ = adminSend(t, nil, rotatedKey, "GET", keys, "")
+	assert.Equal(t, 200, status)
+
+	status, _ = adminSend(t, key, "", "DELETE", fmt.Sprintf("%s/%s", keys, urlEncode(rotatedKeyID)), "")
+	assert.Equal(t, 200, status)
+	status, _ = adminSend(t, nil, rotatedKey, "GET", keys, "")
+	assert.Contains(t, []int{401, 403}, status)
+}
+
+func TestLockout(t *testing.T) {
+	w := newTestWallet(t, false)
+	wrongKey, _ := generateKey(t)
+	now := func() string {
+		return time.Now().UTC().Format(timestampLayout)
+	}
+
+	// bad signatures from this source lock the wallet out once past the free failures
+	for i := 0; i < 4; i++ {
+		status, _ := w.sendWith(t, wrongKey, now(), "GET", w.url(""), "")
+		assert.Equal(t, 401, status, "failure %d", i+1)
+	}
+
+	// while locked, valid signatures are refused, including reading the lockout
+	status, _ := w.send(t, "GET", w.url(""), "")
+	assert.Equal(t, 429, status)
+	status, _ = w.send(t, "GET", w.url("/lockout"), "")
+	assert.Equal(t, 429, status)
+
+	rotate := func(signer *rsa.PrivateKey) (int, *rsa.PrivateKey) {
+		newKey, newPublicKey := generateKey(t)
+		timestamp := now()
+		statement, err := wallets.RotationStatement(w.walletID, w.publicKeyBase64, newPublicKey, w.recoveryPublicKeyBase64, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(&api.KeyRotation{
+			PublicKeyBase64:     newPublicKey,
+			PrivateKeyEncrypted: encrypt("rotated"),
+			RotationSignature:   signWith(signer, statement),
+		})
+		status, _ := w.sendWith(t, newKey, timestamp, "POST", w.url("/key"), string(body))
+		return status, newKey
+	}
+
+	// only the recovery key lifts the lockout
+	status, _ = rotate(w.key)
+	assert.Equal(t, 429, status)
+	status, newKey := rotate(w.recoveryKey)
+	if !assert.Equal(t, 200, status) {
+		return
+	}
+	status, _ = w.sendWith(t, newKey, now(), "GET", w.url(""), "")
+	assert.Equal(t, 200, status)
+}
+
+func TestShareAcceptance(t *testing.T) {
+	recipient := newTestWallet(t, false)
+	sender := newTestWallet(t, false)
+	trusted := newTestWallet(t, false)
+
+	share := func(from *testWallet, refID string) {
+		item := (&wallets.WalletDataItem{ReferenceID: refID, DataSignature: "signature", EncryptedChunks: []string{uuid.New().String()}}).Json()
+		status, _ := from.send(t, "POST", from.url("/share/%s/data", urlEncode(recipient.walletID)), item)
+		assert.Equal(t, 200, status)
+	}
+	inbox := func() map[string]*wallets.ShareSummary {
+		status, b := recipient.send(t, "GET", recipient.url("/shares"), "")
+		assert.Equal(t, 200, status)
+		var list wallets.ShareList
+		_ = json.Unmarshal(b, &list)
+		items := map[string]*wallets.ShareSummary{}
+		for _, i := range list.Items {
+			items[i.ReferenceID] = i
+		}
+		return items
+	}
+	read := func(i *wallets.ShareSummary) int {
+		status, _ := recipient.send(t, "GET", recipient.url("/share/data/%s/%s/%s", urlEncode(i.FromWalletID), i.ReferenceID, i.VersionHash), "")
+		return status
+	}
+
+	// shares wait for acceptance, except those from auto-accepted senders
+	acceptance, _ := json.Marshal(&wallets.ShareAcceptance{Required: true, AutoAccept: []string{trusted.walletID}})
+	status, _ := recipient.send(t, "PUT", recipient.url("/share-acceptance"), string(acceptance))
+	assert.Equal(t, 200, status)
+
+	share(sender, "pending")
+	share(sender, "unwanted")
+	share(trusted, "trusted")
+	items := inbox()
+	if !assert.Len(t, items, 3) {
+		return
+	}
+	assert.Equal(t, wallets.SharePending, items["pending"].Status)
+	assert.Equal(t, wallets.ShareAccepted, items["trusted"].Status)
+	assert.Equal(t, 403, read(items["pending"]))
+	assert.Equal(t, 200, read(items["trusted"]))
+
+	// an accepted share becomes readable, a rejected one is gone
+	status, _ = recipient.send(t, "POST", recipient.url("/shares/%s/pending/accept", urlEncode(sender.walletID)), "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 200, read(items["pending"]))
+
+	status, _ = recipient.send(t, "POST", recipient.url("/shares/%s/unwanted/reject", urlEncode(sender.walletID)), "")
+	assert.Equal(t, 200, status)
+	assert.NotEqual(t, 200, read(items["unwanted"]))
+	status, _ = recipient.send(t, "POST", recipient.url("/shares/%s/unwanted/accept", urlEncode(sender.walletID)), "")
+	assert.Equal(t, 400, status)
+
+	// only the recipient decides
+	status, _ = sender.send(t, "POST", recipient.url("/shares/%s/unwanted/accept", urlEncode(sender.walletID)), "")
+	assert.NotEqual(t, 200, status)
+}
+
+func TestBlockList(t *testing.T) {
+	recipient := newTestWallet(t, false)
+	spammer := newTestWallet(t, false)
+	item := (&wallets.WalletDataItem{ReferenceID: "spam", DataSignature: "signature", EncryptedChunks: []string{uuid.New().String()}}).Json()
+	shareURL := spammer.url("/share/%s/data", urlEncode(recipient.walletID))
+	blockURL := recipient.url("/blocked/%s", urlEncode(spammer.walletID))
+
+	status, _ := recipient.send(t, "PUT", blockURL, "")
+	assert.Equal(t, 200, status)
+	status, _ = recipient.send(t, "PUT", blockURL, "")
+	assert.Equal(t, 200, status, "blocking again is a no-op")
+	status, _ = recipient.send(t, "PUT", recipient.url("/blocked/%s", urlEncode(recipient.walletID)), "")
+	assert.Equal(t, 400, status)
+
+	status, b := recipient.send(t, "GET", recipient.url("/blocked"), "")
+	assert.Equal(t, 200, status)
+	var list wallets.BlockList
+	_ = json.Unmarshal(b, &list)
+	if assert.Len(t, list.Blocked, 1) {
+		assert.Equal(t, spammer.walletID, list.Blocked[0].WalletID)
+	}
+
+	// a blocked sender gets the same error as for a wallet that does not exist
+	status, blocked := spammer.send(t, "POST", shareURL, item)
+	assert.Equal(t, 400, status)
+	missingID := uuid.New().String()
+	_, notFound := spammer.send(t, "POST", spammer.url("/share/%s/data", urlEncode(missingID)), item)
+	assert.Equal(t, strings.Replace(string(notFound), missingID, recipient.walletID, 1), string(blocked))
+
+	// only the wallet manages its block list
+	status, _ = spammer.send(t, "DELETE", blockURL, "")
+	assert.NotEqual(t, 200, status)
+
+	status, _ = recipient.send(t, "DELETE", blockURL, "")
+	assert.Equal(t, 200, status)
+	status, _ = recipient.send(t, "DELETE", blockURL, "")
+	assert.Equal(t, 400, status)
+	status, _ = spammer.send(t, "POST", shareURL, item)
+	assert.Equal(t, 200, status)
+}